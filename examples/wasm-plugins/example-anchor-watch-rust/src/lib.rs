@@ -5,6 +5,7 @@
 //! - PUT handler registration and handling
 //! - Custom HTTP endpoints (REST API)
 //! - Delta message emission
+//! - Resource provider publishing a live swing circle region
 //! - Plugin configuration via JSON schema
 
 use std::cell::RefCell;
@@ -20,8 +21,9 @@ extern "C" {
     fn sk_debug(ptr: *const u8, len: usize);
     fn sk_set_status(ptr: *const u8, len: usize);
     fn sk_set_error(ptr: *const u8, len: usize);
-    fn sk_handle_message(ptr: *const u8, len: usize);
+    fn sk_handle_message(ptr: *const u8, len: usize, version: i32);
     fn sk_register_put_handler(context_ptr: *const u8, context_len: usize, path_ptr: *const u8, path_len: usize) -> i32;
+    fn sk_register_resource_provider(type_ptr: *const u8, type_len: usize) -> i32;
 }
 
 // =============================================================================
@@ -41,13 +43,21 @@ fn set_error(msg: &str) {
 }
 
 fn handle_message(msg: &str) {
-    unsafe { sk_handle_message(msg.as_ptr(), msg.len()); }
+    unsafe { sk_handle_message(msg.as_ptr(), msg.len(), 1); }
+}
+
+fn handle_message_v2(msg: &str) {
+    unsafe { sk_handle_message(msg.as_ptr(), msg.len(), 2); }
 }
 
 fn register_put_handler(context: &str, path: &str) -> i32 {
     unsafe { sk_register_put_handler(context.as_ptr(), context.len(), path.as_ptr(), path.len()) }
 }
 
+fn register_resource_provider(resource_type: &str) -> i32 {
+    unsafe { sk_register_resource_provider(resource_type.as_ptr(), resource_type.len()) }
+}
+
 // =============================================================================
 // Plugin State
 // =============================================================================
@@ -203,6 +213,11 @@ pub extern "C" fn plugin_start(config_ptr: *const u8, config_len: usize) -> i32
         debug("Registered PUT handler for navigation.anchor.state");
     }
 
+    // Serve the swing circle as a region resource for chartplotters
+    if register_resource_provider("regions") == 1 {
+        debug("Registered as regions resource provider");
+    }
+
     // Plugin enabled = anchor watch active
     set_status("Anchor watch active");
     emit_anchor_state(true, parsed_config.anchor_lat, parsed_config.anchor_lon, parsed_config.max_radius);
@@ -345,6 +360,73 @@ pub extern "C" fn handle_put_vessels_self_navigation_anchor_state(
     write_string(result, response_ptr, response_max_len)
 }
 
+// =============================================================================
+// Resource Provider - Swing circle region
+// =============================================================================
+
+/// List regions: only the swing circle, while an anchor position is set
+#[no_mangle]
+pub extern "C" fn resources_list_resources(
+    _request_ptr: *const u8,
+    _request_len: usize,
+    response_ptr: *mut u8,
+    response_max_len: usize,
+) -> i32 {
+    let mut regions = serde_json::Map::new();
+    if let Some(region) = current_swing_region() {
+        regions.insert(SWING_REGION_ID.to_string(), region);
+    }
+    write_string(&serde_json::Value::Object(regions).to_string(), response_ptr, response_max_len)
+}
+
+/// Get a region by ID; an empty object means this plugin does not have it
+#[no_mangle]
+pub extern "C" fn resources_get_resource(
+    request_ptr: *const u8,
+    request_len: usize,
+    response_ptr: *mut u8,
+    response_max_len: usize,
+) -> i32 {
+    let request_json = unsafe {
+        let slice = std::slice::from_raw_parts(request_ptr, request_len);
+        String::from_utf8_lossy(slice).to_string()
+    };
+
+    #[derive(Deserialize)]
+    struct GetRequest {
+        id: String,
+    }
+
+    let region = match serde_json::from_str::<GetRequest>(&request_json) {
+        Ok(req) if req.id == SWING_REGION_ID => current_swing_region(),
+        _ => None,
+    };
+    let response = region.map_or_else(|| "{}".to_string(), |r| r.to_string());
+    write_string(&response, response_ptr, response_max_len)
+}
+
+/// The swing circle is derived from the anchor watch, so it cannot be edited
+#[no_mangle]
+pub extern "C" fn resources_set_resource(
+    _request_ptr: *const u8,
+    _request_len: usize,
+    response_ptr: *mut u8,
+    response_max_len: usize,
+) -> i32 {
+    write_string("Swing circle is read-only, move the anchor instead", response_ptr, response_max_len)
+}
+
+/// The swing circle disappears when the anchor watch stops
+#[no_mangle]
+pub extern "C" fn resources_delete_resource(
+    _request_ptr: *const u8,
+    _request_len: usize,
+    response_ptr: *mut u8,
+    response_max_len: usize,
+) -> i32 {
+    write_string("Swing circle is read-only, stop the anchor watch instead", response_ptr, response_max_len)
+}
+
 // =============================================================================
 // HTTP Endpoints - Custom REST API
 // =============================================================================
@@ -522,6 +604,76 @@ fn emit_anchor_state(enabled: bool, lat: f64, lon: f64, radius: f64) {
     };
 
     handle_message(&delta);
+    emit_swing_region(enabled, lat, lon, radius);
+}
+
+/// Fixed ID of the region resource describing the allowed swing circle
+static SWING_REGION_ID: &str = "5f0c7d8e-3b1a-4c2e-9a6f-8d4b2e1c7a90";
+
+/// Number of vertices approximating the swing circle
+const CIRCLE_SEGMENTS: usize = 36;
+
+/// Publish the swing circle as a resource delta so clients update live
+fn emit_swing_region(enabled: bool, lat: f64, lon: f64, radius: f64) {
+    // A null value tells clients the region no longer exists
+    let region = if enabled && (lat != 0.0 || lon != 0.0) {
+        swing_circle_region(lat, lon, radius)
+    } else {
+        serde_json::Value::Null
+    };
+    let delta = serde_json::json!({
+        "updates": [{
+            "values": [{
+                "path": format!("resources.regions.{}", SWING_REGION_ID),
+                "value": region
+            }]
+        }]
+    });
+
+    // Resource deltas are v2 only, like those emitted by the Resources API
+    handle_message_v2(&delta.to_string());
+}
+
+/// Swing circle region for the current state, if an anchor position is set
+fn current_swing_region() -> Option<serde_json::Value> {
+    STATE.with(|state| {
+        let s = state.borrow();
+        if s.is_running && (s.config.anchor_lat != 0.0 || s.config.anchor_lon != 0.0) {
+            Some(swing_circle_region(s.config.anchor_lat, s.config.anchor_lon, s.config.max_radius))
+        } else {
+            None
+        }
+    })
+}
+
+/// Build a Signal K region resource: a polygon approximating the circle of
+/// `radius` meters around the anchor
+fn swing_circle_region(lat: f64, lon: f64, radius: f64) -> serde_json::Value {
+    let mut ring: Vec<[f64; 2]> = (0..CIRCLE_SEGMENTS)
+        .map(|i| {
+            let bearing = 2.0 * PI * i as f64 / CIRCLE_SEGMENTS as f64;
+            let (point_lat, point_lon) = destination_point(lat, lon, bearing, radius);
+            [point_lon, point_lat]
+        })
+        .collect();
+    // GeoJSON polygon rings must be closed
+    ring.push(ring[0]);
+
+    serde_json::json!({
+        "name": "Anchor swing circle",
+        "description": format!("Allowed swing radius of {}m around the anchor", radius),
+        "feature": {
+            "type": "Feature",
+            "geometry": {
+                "type": "Polygon",
+                "coordinates": [ring]
+            },
+            "properties": {
+                "anchorPosition": { "latitude": lat, "longitude": lon },
+                "maxRadius": radius
+            }
+        }
+    })
 }
 
 fn write_string(s: &str, ptr: *mut u8, max_len: usize) -> i32 {
@@ -535,11 +687,11 @@ fn write_string(s: &str, ptr: *mut u8, max_len: usize) -> i32 {
     len as i32
 }
 
+const EARTH_RADIUS_M: f64 = 6_371_000.0;
+
 /// Calculate distance between two points using Haversine formula (meters)
 #[allow(dead_code)]
 fn haversine_distance(lat1: f64, lon1: f64, lat2: f64, lon2: f64) -> f64 {
-    const EARTH_RADIUS_M: f64 = 6_371_000.0;
-
     let lat1_rad = lat1 * PI / 180.0;
     let lat2_rad = lat2 * PI / 180.0;
     let delta_lat = (lat2 - lat1) * PI / 180.0;
@@ -551,3 +703,16 @@ fn haversine_distance(lat1: f64, lon1: f64, lat2: f64, lon2: f64) -> f64 {
 
     EARTH_RADIUS_M * c
 }
+
+/// Position `distance` meters from a point (degrees) along `bearing` (radians)
+fn destination_point(lat: f64, lon: f64, bearing: f64, distance: f64) -> (f64, f64) {
+    let lat1 = lat * PI / 180.0;
+    let lon1 = lon * PI / 180.0;
+    let angular = distance / EARTH_RADIUS_M;
+
+    let lat2 = (lat1.sin() * angular.cos() + lat1.cos() * angular.sin() * bearing.cos()).asin();
+    let lon2 = lon1
+        + (bearing.sin() * angular.sin() * lat1.cos()).atan2(angular.cos() - lat1.sin() * lat2.sin());
+
+    (lat2 * 180.0 / PI, lon2 * 180.0 / PI)
+}
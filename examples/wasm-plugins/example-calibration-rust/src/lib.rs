@@ -0,0 +1,439 @@
+//! Calibration WASM Plugin for Signal K
+//!
+//! A Rust implementation demonstrating:
+//! - Modifying incoming deltas through the delta_input_handler export
+//! - Array-valued configuration schemas
+//!
+//! Users configure per-path corrections: a scale and offset for plain
+//! numbers, or an offset and deviation table for angles such as compass
+//! heading or wind angle. Matching values of the own vessel are corrected
+//! before they reach the data model, so every consumer sees calibrated data.
+
+use std::cell::RefCell;
+use std::f64::consts::PI;
+use serde::Deserialize;
+
+// =============================================================================
+// FFI Imports - These must match what the SignalK WASM runtime provides in "env"
+// =============================================================================
+
+#[link(wasm_import_module = "env")]
+extern "C" {
+    fn sk_debug(ptr: *const u8, len: usize);
+    fn sk_set_status(ptr: *const u8, len: usize);
+    fn sk_set_error(ptr: *const u8, len: usize);
+    fn sk_get_setting(key_ptr: *const u8, key_len: usize, buf_ptr: *mut u8, buf_max_len: usize) -> i32;
+}
+
+// =============================================================================
+// Helper wrappers for FFI functions
+// =============================================================================
+
+fn debug(msg: &str) {
+    unsafe { sk_debug(msg.as_ptr(), msg.len()); }
+}
+
+fn set_status(msg: &str) {
+    unsafe { sk_set_status(msg.as_ptr(), msg.len()); }
+}
+
+fn set_error(msg: &str) {
+    unsafe { sk_set_error(msg.as_ptr(), msg.len()); }
+}
+
+/// Read a whitelisted server setting, parsed from its JSON encoding
+fn get_setting(key: &str) -> Option<serde_json::Value> {
+    let mut buf = vec![0u8; 256];
+    let len = unsafe { sk_get_setting(key.as_ptr(), key.len(), buf.as_mut_ptr(), buf.len()) };
+    if len <= 0 {
+        return None;
+    }
+    serde_json::from_slice(&buf[..len as usize]).ok()
+}
+
+// =============================================================================
+// Plugin State
+// =============================================================================
+
+thread_local! {
+    static STATE: RefCell<PluginState> = RefCell::new(PluginState::default());
+}
+
+#[derive(Debug, Clone, Deserialize, Default)]
+struct PluginConfig {
+    #[serde(default)]
+    calibrations: Vec<Calibration>,
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Deserialize)]
+#[serde(rename_all = "lowercase")]
+enum Kind {
+    /// Plain number: value * scale + offset
+    Linear,
+    /// Angle in radians: value + offset + deviation, wrapped to a full circle
+    Angle,
+}
+
+impl Default for Kind {
+    fn default() -> Self { Kind::Linear }
+}
+
+#[derive(Debug, Clone, Deserialize)]
+#[serde(rename_all = "camelCase")]
+struct Calibration {
+    path: String,
+    /// Only correct values from this $source, all sources if empty
+    #[serde(default)]
+    source: Option<String>,
+    #[serde(default)]
+    kind: Kind,
+    #[serde(default = "default_scale")]
+    scale: f64,
+    /// Offset in the path's units, or degrees for angles
+    #[serde(default)]
+    offset: f64,
+    /// Deviation (degrees) by heading (degrees), for angles only
+    #[serde(default)]
+    deviation_table: Vec<DeviationPoint>,
+}
+
+fn default_scale() -> f64 { 1.0 }
+
+#[derive(Debug, Clone, Copy, Deserialize)]
+struct DeviationPoint {
+    heading: f64,
+    deviation: f64,
+}
+
+#[derive(Debug, Default)]
+struct PluginState {
+    is_running: bool,
+    /// Contexts that refer to this vessel in received deltas
+    self_contexts: Vec<String>,
+    calibrations: Vec<Calibration>,
+}
+
+// =============================================================================
+// Memory Allocation for string passing
+// =============================================================================
+
+/// Allocate memory for string passing from host
+#[no_mangle]
+pub extern "C" fn allocate(size: usize) -> *mut u8 {
+    let mut buf = Vec::with_capacity(size);
+    let ptr = buf.as_mut_ptr();
+    std::mem::forget(buf);
+    ptr
+}
+
+/// Deallocate memory
+#[no_mangle]
+pub extern "C" fn deallocate(ptr: *mut u8, size: usize) {
+    unsafe {
+        let _ = Vec::from_raw_parts(ptr, 0, size);
+    }
+}
+
+// =============================================================================
+// Plugin Exports - Core plugin interface
+// =============================================================================
+
+static PLUGIN_ID: &str = "calibration-rust";
+static PLUGIN_NAME: &str = "Calibration (Rust)";
+static PLUGIN_SCHEMA: &str = r#"{
+    "type": "object",
+    "title": "Calibration Configuration",
+    "properties": {
+        "calibrations": {
+            "type": "array",
+            "title": "Calibrations",
+            "items": {
+                "type": "object",
+                "required": ["path"],
+                "properties": {
+                    "path": {
+                        "type": "string",
+                        "title": "Signal K Path",
+                        "description": "For example navigation.headingMagnetic or environment.wind.angleApparent"
+                    },
+                    "source": {
+                        "type": "string",
+                        "title": "Source",
+                        "description": "Only correct values from this $source, leave empty for all sources"
+                    },
+                    "kind": {
+                        "type": "string",
+                        "title": "Kind",
+                        "enum": ["linear", "angle"],
+                        "enumNames": ["Number (scale and offset)", "Angle (offset and deviation table)"],
+                        "default": "linear"
+                    },
+                    "scale": {
+                        "type": "number",
+                        "title": "Scale",
+                        "description": "Multiplier for numbers, ignored for angles",
+                        "default": 1
+                    },
+                    "offset": {
+                        "type": "number",
+                        "title": "Offset",
+                        "description": "Added after scaling, in the path's units or degrees for angles",
+                        "default": 0
+                    },
+                    "deviationTable": {
+                        "type": "array",
+                        "title": "Deviation Table",
+                        "description": "Deviation by heading for angles, interpolated between entries",
+                        "items": {
+                            "type": "object",
+                            "required": ["heading", "deviation"],
+                            "properties": {
+                                "heading": {
+                                    "type": "number",
+                                    "title": "Heading (degrees)",
+                                    "minimum": 0,
+                                    "maximum": 360
+                                },
+                                "deviation": {
+                                    "type": "number",
+                                    "title": "Deviation (degrees, east positive)"
+                                }
+                            }
+                        }
+                    }
+                }
+            }
+        }
+    }
+}"#;
+
+/// Return the plugin ID
+#[no_mangle]
+pub extern "C" fn plugin_id(out_ptr: *mut u8, out_max_len: usize) -> i32 {
+    write_string(PLUGIN_ID, out_ptr, out_max_len)
+}
+
+/// Return the plugin name
+#[no_mangle]
+pub extern "C" fn plugin_name(out_ptr: *mut u8, out_max_len: usize) -> i32 {
+    write_string(PLUGIN_NAME, out_ptr, out_max_len)
+}
+
+/// Return the plugin JSON schema
+#[no_mangle]
+pub extern "C" fn plugin_schema(out_ptr: *mut u8, out_max_len: usize) -> i32 {
+    write_string(PLUGIN_SCHEMA, out_ptr, out_max_len)
+}
+
+/// Start the plugin with configuration
+#[no_mangle]
+pub extern "C" fn plugin_start(config_ptr: *const u8, config_len: usize) -> i32 {
+    let config_json = unsafe {
+        let slice = std::slice::from_raw_parts(config_ptr, config_len);
+        String::from_utf8_lossy(slice).to_string()
+    };
+
+    let mut parsed_config: PluginConfig = match serde_json::from_str(&config_json) {
+        Ok(c) => c,
+        Err(e) => {
+            set_error(&format!("Failed to parse config: {}", e));
+            return 1;
+        }
+    };
+    parsed_config.calibrations.retain(|c| !c.path.is_empty());
+    for calibration in &mut parsed_config.calibrations {
+        calibration
+            .deviation_table
+            .sort_by(|a, b| a.heading.partial_cmp(&b.heading).unwrap_or(std::cmp::Ordering::Equal));
+    }
+
+    // The server rewrites vessels.self to the vessel's identity before
+    // deltas reach delta_input_handler, using the MMSI when one is configured
+    let mut self_contexts = vec!["vessels.self".to_string()];
+    if let Some(serde_json::Value::String(mmsi)) = get_setting("vessel.mmsi") {
+        self_contexts.push(format!("vessels.urn:mrn:imo:mmsi:{}", mmsi));
+    } else if let Some(serde_json::Value::String(uuid)) = get_setting("vessel.uuid") {
+        self_contexts.push(format!("vessels.{}", uuid));
+    }
+
+    let count = parsed_config.calibrations.len();
+    STATE.with(|state| {
+        let mut s = state.borrow_mut();
+        s.is_running = true;
+        s.self_contexts = self_contexts;
+        s.calibrations = parsed_config.calibrations;
+    });
+
+    debug(&format!("Calibration started with {} path(s)", count));
+    set_status(&format!("Calibrating {} path(s)", count));
+
+    0
+}
+
+/// Stop the plugin
+#[no_mangle]
+pub extern "C" fn plugin_stop() -> i32 {
+    STATE.with(|state| {
+        let mut s = state.borrow_mut();
+        s.is_running = false;
+        s.calibrations.clear();
+    });
+    debug("Calibration stopped");
+    set_status("Stopped");
+
+    0
+}
+
+// =============================================================================
+// Delta Input Handler - correct values before they reach the data model
+// =============================================================================
+
+/// Receive incoming deltas and write the corrected delta to the output buffer
+/// Returns 0 to forward the delta unchanged
+#[no_mangle]
+pub extern "C" fn delta_input_handler(
+    delta_ptr: *const u8,
+    delta_len: usize,
+    out_ptr: *mut u8,
+    out_max_len: usize,
+) -> i32 {
+    let delta_json = unsafe {
+        let slice = std::slice::from_raw_parts(delta_ptr, delta_len);
+        String::from_utf8_lossy(slice).to_string()
+    };
+
+    let corrected = STATE.with(|state| {
+        let s = state.borrow();
+        if !s.is_running {
+            return None;
+        }
+        // Filter early: every delta passes through here, and most carry
+        // none of the calibrated paths
+        if !s.calibrations.iter().any(|c| delta_json.contains(c.path.as_str())) {
+            return None;
+        }
+        let mut delta: serde_json::Value = serde_json::from_str(&delta_json).ok()?;
+        let context = delta.get("context").and_then(|c| c.as_str()).unwrap_or("vessels.self");
+        if !s.self_contexts.iter().any(|c| c == context) {
+            return None;
+        }
+        if calibrate_delta(&mut delta, &s.calibrations) {
+            Some(delta.to_string())
+        } else {
+            None
+        }
+    });
+
+    match corrected {
+        // A truncated delta would be invalid JSON, forward the original instead
+        Some(json) if json.len() <= out_max_len => write_string(&json, out_ptr, out_max_len),
+        _ => 0,
+    }
+}
+
+/// Apply the calibrations to all matching values in place
+/// Returns true if any value was changed
+fn calibrate_delta(delta: &mut serde_json::Value, calibrations: &[Calibration]) -> bool {
+    let updates = match delta.get_mut("updates").and_then(|u| u.as_array_mut()) {
+        Some(updates) => updates,
+        None => return false,
+    };
+
+    let mut changed = false;
+    for update in updates {
+        let source = update.get("$source").and_then(|s| s.as_str()).map(|s| s.to_string());
+        let values = match update.get_mut("values").and_then(|v| v.as_array_mut()) {
+            Some(values) => values,
+            None => continue,
+        };
+        for pv in values {
+            let path = match pv.get("path").and_then(|p| p.as_str()) {
+                Some(path) => path.to_string(),
+                None => continue,
+            };
+            let calibration = calibrations.iter().find(|c| {
+                c.path == path
+                    && match c.source.as_deref() {
+                        None | Some("") => true,
+                        Some(wanted) => source.as_deref() == Some(wanted),
+                    }
+            });
+            let calibration = match calibration {
+                Some(c) => c,
+                None => continue,
+            };
+            if let Some(value) = pv.get("value").and_then(|v| v.as_f64()) {
+                pv["value"] = serde_json::json!(apply(calibration, value));
+                changed = true;
+            }
+        }
+    }
+    changed
+}
+
+fn apply(calibration: &Calibration, value: f64) -> f64 {
+    match calibration.kind {
+        Kind::Linear => value * calibration.scale + calibration.offset,
+        Kind::Angle => {
+            let deviation = interpolate_deviation(&calibration.deviation_table, value.to_degrees());
+            let corrected = value + (calibration.offset + deviation).to_radians();
+            wrap_angle(corrected, is_signed_angle(&calibration.path))
+        }
+    }
+}
+
+/// Deviation (degrees) at a heading (degrees), interpolated linearly between
+/// table entries and across north
+fn interpolate_deviation(table: &[DeviationPoint], heading: f64) -> f64 {
+    match table.len() {
+        0 => return 0.0,
+        1 => return table[0].deviation,
+        _ => {}
+    }
+    let heading = heading.rem_euclid(360.0);
+
+    // The table is sorted by heading: find the entries on either side,
+    // wrapping from the last entry to the first one past 360
+    let next = table.iter().position(|p| p.heading > heading).unwrap_or(0);
+    let prev = if next == 0 { table.len() - 1 } else { next - 1 };
+    let (a, b) = (table[prev], table[next]);
+
+    let span = (b.heading - a.heading).rem_euclid(360.0);
+    if span == 0.0 {
+        return a.deviation;
+    }
+    let t = (heading - a.heading).rem_euclid(360.0) / span;
+    a.deviation + (b.deviation - a.deviation) * t
+}
+
+/// Angles relative to the bow (wind angles, rudder angle) are signed, while
+/// headings, courses and directions run from 0 to 2π
+fn is_signed_angle(path: &str) -> bool {
+    let name = path.rsplit('.').next().unwrap_or(path);
+    name.starts_with("angle") || name.ends_with("Angle")
+}
+
+/// Wrap an angle to [0, 2π), or to (-π, π] for signed angles
+fn wrap_angle(angle: f64, signed: bool) -> f64 {
+    let wrapped = angle.rem_euclid(2.0 * PI);
+    if signed && wrapped > PI {
+        wrapped - 2.0 * PI
+    } else {
+        wrapped
+    }
+}
+
+// =============================================================================
+// Helper Functions
+// =============================================================================
+
+fn write_string(s: &str, ptr: *mut u8, max_len: usize) -> i32 {
+    let bytes = s.as_bytes();
+    let len = bytes.len().min(max_len);
+
+    unsafe {
+        std::ptr::copy_nonoverlapping(bytes.as_ptr(), ptr, len);
+    }
+
+    len as i32
+}
@@ -0,0 +1,730 @@
+//! Data Quality Monitor WASM Plugin for Signal K
+//!
+//! A Rust implementation demonstrating:
+//! - Receiving deltas through the delta_handler export
+//! - Periodic work through the poll export
+//! - Raising and clearing notifications
+//! - Custom HTTP endpoints (REST API)
+//!
+//! The plugin tracks how often each configured path is updated, per source.
+//! It publishes a status per path under sensors.dataQuality, flags sources
+//! that keep dropping out and coming back, and raises notifications when
+//! data stops arriving - as an alarm for critical data such as position.
+
+use std::cell::RefCell;
+use serde::Deserialize;
+
+// =============================================================================
+// FFI Imports - These must match what the SignalK WASM runtime provides in "env"
+// =============================================================================
+
+#[link(wasm_import_module = "env")]
+extern "C" {
+    fn sk_debug(ptr: *const u8, len: usize);
+    fn sk_set_status(ptr: *const u8, len: usize);
+    fn sk_set_error(ptr: *const u8, len: usize);
+    fn sk_handle_message(ptr: *const u8, len: usize, version: i32);
+    fn sk_monotonic_ms() -> f64;
+    fn sk_get_setting(key_ptr: *const u8, key_len: usize, buf_ptr: *mut u8, buf_max_len: usize) -> i32;
+}
+
+// =============================================================================
+// Helper wrappers for FFI functions
+// =============================================================================
+
+fn debug(msg: &str) {
+    unsafe { sk_debug(msg.as_ptr(), msg.len()); }
+}
+
+fn set_status(msg: &str) {
+    unsafe { sk_set_status(msg.as_ptr(), msg.len()); }
+}
+
+fn set_error(msg: &str) {
+    unsafe { sk_set_error(msg.as_ptr(), msg.len()); }
+}
+
+fn handle_message(msg: &str) {
+    unsafe { sk_handle_message(msg.as_ptr(), msg.len(), 1); }
+}
+
+fn monotonic_ms() -> f64 {
+    unsafe { sk_monotonic_ms() }
+}
+
+/// Read a whitelisted server setting, parsed from its JSON encoding
+fn get_setting(key: &str) -> Option<serde_json::Value> {
+    let mut buf = vec![0u8; 256];
+    let len = unsafe { sk_get_setting(key.as_ptr(), key.len(), buf.as_mut_ptr(), buf.len()) };
+    if len <= 0 {
+        return None;
+    }
+    serde_json::from_slice(&buf[..len as usize]).ok()
+}
+
+// =============================================================================
+// Plugin State
+// =============================================================================
+
+thread_local! {
+    static STATE: RefCell<PluginState> = RefCell::new(PluginState::default());
+}
+
+#[derive(Debug, Clone, Deserialize)]
+#[serde(rename_all = "camelCase")]
+struct PluginConfig {
+    #[serde(default = "default_paths")]
+    paths: Vec<MonitoredPath>,
+    #[serde(default = "default_flapping_count")]
+    flapping_count: usize,
+    #[serde(default = "default_flapping_window")]
+    flapping_window: f64,
+    #[serde(default = "default_rate_interval")]
+    rate_interval: f64,
+}
+
+#[derive(Debug, Clone, Deserialize)]
+#[serde(rename_all = "camelCase")]
+struct MonitoredPath {
+    path: String,
+    /// Seconds without an update before the data counts as stale
+    #[serde(default = "default_max_age")]
+    max_age: f64,
+    /// Raise an alarm instead of a warning when the data goes stale
+    #[serde(default)]
+    critical: bool,
+}
+
+fn default_paths() -> Vec<MonitoredPath> {
+    vec![
+        MonitoredPath { path: "navigation.position".to_string(), max_age: 5.0, critical: true },
+        MonitoredPath { path: "environment.depth.belowTransducer".to_string(), max_age: 5.0, critical: true },
+        MonitoredPath { path: "navigation.headingMagnetic".to_string(), max_age: 5.0, critical: false },
+        MonitoredPath { path: "environment.wind.speedApparent".to_string(), max_age: 5.0, critical: false },
+    ]
+}
+fn default_max_age() -> f64 { 5.0 }
+fn default_flapping_count() -> usize { 3 }
+fn default_flapping_window() -> f64 { 300.0 }
+fn default_rate_interval() -> f64 { 10.0 }
+
+impl Default for PluginConfig {
+    fn default() -> Self {
+        PluginConfig {
+            paths: default_paths(),
+            flapping_count: default_flapping_count(),
+            flapping_window: default_flapping_window(),
+            rate_interval: default_rate_interval(),
+        }
+    }
+}
+
+#[derive(Debug, Clone, Copy, PartialEq)]
+enum Status {
+    /// Nothing received yet, still within max_age of starting
+    Waiting,
+    /// At least one source is updating
+    Ok,
+    /// Updating, but a source keeps dropping out and coming back
+    Flapping,
+    /// No source has updated within max_age
+    Stale,
+}
+
+impl Status {
+    fn as_str(&self) -> &'static str {
+        match self {
+            Status::Waiting => "waiting",
+            Status::Ok => "ok",
+            Status::Flapping => "flapping",
+            Status::Stale => "stale",
+        }
+    }
+}
+
+#[derive(Debug)]
+struct SourceStats {
+    source: String,
+    last_ms: f64,
+    updates: u64,
+    stale: bool,
+    /// When the source came back after being stale, within flapping_window
+    recoveries: Vec<f64>,
+}
+
+#[derive(Debug)]
+struct PathState {
+    config: MonitoredPath,
+    status: Status,
+    sources: Vec<SourceStats>,
+    /// Updates since the rate was last published
+    updates_in_interval: u64,
+    rate: f64,
+}
+
+#[derive(Debug, Default)]
+struct PluginState {
+    config: PluginConfig,
+    is_running: bool,
+    /// Contexts that refer to this vessel in received deltas
+    self_contexts: Vec<String>,
+    started_ms: f64,
+    rate_published_ms: f64,
+    paths: Vec<PathState>,
+}
+
+impl PathState {
+    fn evaluate(&self, now: f64, started_ms: f64, flapping_count: usize) -> Status {
+        let max_age_ms = self.config.max_age * 1000.0;
+        if self.sources.is_empty() {
+            return if now - started_ms > max_age_ms { Status::Stale } else { Status::Waiting };
+        }
+        if self.sources.iter().all(|s| s.stale) {
+            return Status::Stale;
+        }
+        if self.sources.iter().any(|s| s.recoveries.len() >= flapping_count) {
+            return Status::Flapping;
+        }
+        Status::Ok
+    }
+
+    fn describe(&self, now: f64) -> String {
+        match self.status {
+            Status::Stale if self.sources.is_empty() => {
+                format!("{}: no data received", self.config.path)
+            }
+            Status::Stale => {
+                let last = self.sources.iter().map(|s| s.last_ms).fold(0.0, f64::max);
+                format!("{}: no data for {:.0} s", self.config.path, (now - last) / 1000.0)
+            }
+            Status::Flapping => {
+                let sources: Vec<&str> = self
+                    .sources
+                    .iter()
+                    .filter(|s| !s.recoveries.is_empty())
+                    .map(|s| s.source.as_str())
+                    .collect();
+                format!("{}: intermittent data from {}", self.config.path, sources.join(", "))
+            }
+            _ => format!("{}: data ok", self.config.path),
+        }
+    }
+}
+
+// =============================================================================
+// Memory Allocation for string passing
+// =============================================================================
+
+/// Allocate memory for string passing from host
+#[no_mangle]
+pub extern "C" fn allocate(size: usize) -> *mut u8 {
+    let mut buf = Vec::with_capacity(size);
+    let ptr = buf.as_mut_ptr();
+    std::mem::forget(buf);
+    ptr
+}
+
+/// Deallocate memory
+#[no_mangle]
+pub extern "C" fn deallocate(ptr: *mut u8, size: usize) {
+    unsafe {
+        let _ = Vec::from_raw_parts(ptr, 0, size);
+    }
+}
+
+// =============================================================================
+// Plugin Exports - Core plugin interface
+// =============================================================================
+
+static PLUGIN_ID: &str = "data-quality-rust";
+static PLUGIN_NAME: &str = "Data Quality Monitor (Rust)";
+static PLUGIN_SCHEMA: &str = r#"{
+    "type": "object",
+    "title": "Data Quality Monitor Configuration",
+    "properties": {
+        "paths": {
+            "type": "array",
+            "title": "Monitored Paths",
+            "default": [
+                { "path": "navigation.position", "maxAge": 5, "critical": true },
+                { "path": "environment.depth.belowTransducer", "maxAge": 5, "critical": true },
+                { "path": "navigation.headingMagnetic", "maxAge": 5, "critical": false },
+                { "path": "environment.wind.speedApparent", "maxAge": 5, "critical": false }
+            ],
+            "items": {
+                "type": "object",
+                "required": ["path"],
+                "properties": {
+                    "path": {
+                        "type": "string",
+                        "title": "Signal K Path"
+                    },
+                    "maxAge": {
+                        "type": "number",
+                        "title": "Maximum Age (seconds)",
+                        "description": "Data counts as stale when no source has updated it for this long",
+                        "default": 5,
+                        "minimum": 1
+                    },
+                    "critical": {
+                        "type": "boolean",
+                        "title": "Critical",
+                        "description": "Raise an alarm instead of a warning when the data goes stale",
+                        "default": false
+                    }
+                }
+            }
+        },
+        "flappingCount": {
+            "type": "number",
+            "title": "Flapping Threshold",
+            "description": "Flag a source as flapping after it dropped out and came back this many times",
+            "default": 3,
+            "minimum": 1
+        },
+        "flappingWindow": {
+            "type": "number",
+            "title": "Flapping Window (seconds)",
+            "description": "Period over which dropouts are counted",
+            "default": 300,
+            "minimum": 10
+        },
+        "rateInterval": {
+            "type": "number",
+            "title": "Update Rate Interval (seconds)",
+            "description": "How often the measured update rates are published",
+            "default": 10,
+            "minimum": 1
+        }
+    }
+}"#;
+
+/// Return the plugin ID
+#[no_mangle]
+pub extern "C" fn plugin_id(out_ptr: *mut u8, out_max_len: usize) -> i32 {
+    write_string(PLUGIN_ID, out_ptr, out_max_len)
+}
+
+/// Return the plugin name
+#[no_mangle]
+pub extern "C" fn plugin_name(out_ptr: *mut u8, out_max_len: usize) -> i32 {
+    write_string(PLUGIN_NAME, out_ptr, out_max_len)
+}
+
+/// Return the plugin JSON schema
+#[no_mangle]
+pub extern "C" fn plugin_schema(out_ptr: *mut u8, out_max_len: usize) -> i32 {
+    write_string(PLUGIN_SCHEMA, out_ptr, out_max_len)
+}
+
+/// Start the plugin with configuration
+#[no_mangle]
+pub extern "C" fn plugin_start(config_ptr: *const u8, config_len: usize) -> i32 {
+    let config_json = unsafe {
+        let slice = std::slice::from_raw_parts(config_ptr, config_len);
+        String::from_utf8_lossy(slice).to_string()
+    };
+
+    let parsed_config: PluginConfig = match serde_json::from_str(&config_json) {
+        Ok(c) => c,
+        Err(e) => {
+            set_error(&format!("Failed to parse config: {}", e));
+            return 1;
+        }
+    };
+
+    // The server rewrites vessels.self to the vessel's identity before
+    // deltas reach delta_handler, using the MMSI when one is configured
+    let mut self_contexts = vec!["vessels.self".to_string()];
+    if let Some(serde_json::Value::String(mmsi)) = get_setting("vessel.mmsi") {
+        self_contexts.push(format!("vessels.urn:mrn:imo:mmsi:{}", mmsi));
+    } else if let Some(serde_json::Value::String(uuid)) = get_setting("vessel.uuid") {
+        self_contexts.push(format!("vessels.{}", uuid));
+    }
+
+    let now = monotonic_ms();
+    let paths: Vec<PathState> = parsed_config
+        .paths
+        .iter()
+        .filter(|p| !p.path.is_empty())
+        .map(|p| PathState {
+            config: p.clone(),
+            status: Status::Waiting,
+            sources: Vec::new(),
+            updates_in_interval: 0,
+            rate: 0.0,
+        })
+        .collect();
+    let count = paths.len();
+
+    STATE.with(|state| {
+        let mut s = state.borrow_mut();
+        *s = PluginState::default();
+        s.config = parsed_config;
+        s.is_running = true;
+        s.self_contexts = self_contexts;
+        s.started_ms = now;
+        s.rate_published_ms = now;
+        s.paths = paths;
+    });
+
+    debug(&format!("Data quality monitor started for {} path(s)", count));
+    set_status(&format!("Monitoring {} path(s)", count));
+
+    0
+}
+
+/// Stop the plugin
+#[no_mangle]
+pub extern "C" fn plugin_stop() -> i32 {
+    // Clear any notifications this plugin raised
+    let raised: Vec<String> = STATE.with(|state| {
+        let mut s = state.borrow_mut();
+        s.is_running = false;
+        s.paths
+            .iter()
+            .filter(|p| p.status == Status::Stale || p.status == Status::Flapping)
+            .map(|p| p.config.path.clone())
+            .collect()
+    });
+    for path in raised {
+        emit_notification(&path, "normal", &format!("{}: monitoring stopped", path));
+    }
+    debug("Data quality monitor stopped");
+    set_status("Stopped");
+
+    0
+}
+
+// =============================================================================
+// Delta Handler - count updates per path and source
+// =============================================================================
+
+#[derive(Deserialize)]
+struct Delta {
+    context: Option<String>,
+    #[serde(default)]
+    updates: Vec<DeltaUpdate>,
+}
+
+#[derive(Deserialize)]
+struct DeltaUpdate {
+    #[serde(rename = "$source")]
+    source_ref: Option<String>,
+    #[serde(default)]
+    values: Vec<PathValue>,
+}
+
+#[derive(Deserialize)]
+struct PathValue {
+    path: String,
+    value: serde_json::Value,
+}
+
+/// Receive deltas from the server
+#[no_mangle]
+pub extern "C" fn delta_handler(delta_ptr: *const u8, delta_len: usize) {
+    let delta_json = unsafe {
+        let slice = std::slice::from_raw_parts(delta_ptr, delta_len);
+        String::from_utf8_lossy(slice).to_string()
+    };
+
+    STATE.with(|state| {
+        let mut s = state.borrow_mut();
+        if !s.is_running {
+            return;
+        }
+        // Filter early: most deltas carry none of the monitored paths
+        if !s.paths.iter().any(|p| delta_json.contains(p.config.path.as_str())) {
+            return;
+        }
+        let delta: Delta = match serde_json::from_str(&delta_json) {
+            Ok(d) => d,
+            Err(_) => return,
+        };
+        let context = delta.context.as_deref().unwrap_or("vessels.self");
+        if !s.self_contexts.iter().any(|c| c == context) {
+            return;
+        }
+
+        let now = monotonic_ms();
+        for update in &delta.updates {
+            let source = update.source_ref.as_deref().unwrap_or("unknown");
+            for pv in &update.values {
+                // A null value clears the path, it is not fresh data
+                if pv.value.is_null() {
+                    continue;
+                }
+                if let Some(path) = s.paths.iter_mut().find(|p| p.config.path == pv.path) {
+                    record_update(path, source, now);
+                }
+            }
+        }
+    });
+}
+
+fn record_update(path: &mut PathState, source: &str, now: f64) {
+    path.updates_in_interval += 1;
+    match path.sources.iter_mut().find(|s| s.source == source) {
+        Some(stats) => {
+            if stats.stale {
+                stats.stale = false;
+                stats.recoveries.push(now);
+            }
+            stats.last_ms = now;
+            stats.updates += 1;
+        }
+        None => path.sources.push(SourceStats {
+            source: source.to_string(),
+            last_ms: now,
+            updates: 1,
+            stale: false,
+            recoveries: Vec::new(),
+        }),
+    }
+}
+
+// =============================================================================
+// Poll - detect stale and flapping data once per second
+// =============================================================================
+
+/// Called by the server about once per second
+#[no_mangle]
+pub extern "C" fn poll() -> i32 {
+    let now = monotonic_ms();
+
+    struct Change {
+        path: String,
+        previous: Status,
+        status: Status,
+        critical: bool,
+        message: String,
+    }
+
+    let (changes, rates) = STATE.with(|state| {
+        let mut s = state.borrow_mut();
+        if !s.is_running {
+            return (Vec::new(), None);
+        }
+        let started_ms = s.started_ms;
+        let flapping_count = s.config.flapping_count.max(1);
+        let flapping_window_ms = s.config.flapping_window * 1000.0;
+
+        let mut changes = Vec::new();
+        for path in s.paths.iter_mut() {
+            let max_age_ms = path.config.max_age * 1000.0;
+            for stats in path.sources.iter_mut() {
+                if !stats.stale && now - stats.last_ms > max_age_ms {
+                    stats.stale = true;
+                }
+                stats.recoveries.retain(|t| now - t <= flapping_window_ms);
+            }
+
+            let status = path.evaluate(now, started_ms, flapping_count);
+            if status != path.status {
+                let previous = path.status;
+                path.status = status;
+                changes.push(Change {
+                    path: path.config.path.clone(),
+                    previous,
+                    status,
+                    critical: path.config.critical,
+                    message: path.describe(now),
+                });
+            }
+        }
+
+        // Publish measured update rates at the configured interval
+        let elapsed = now - s.rate_published_ms;
+        let rates = if elapsed >= s.config.rate_interval * 1000.0 {
+            s.rate_published_ms = now;
+            let rates: Vec<(String, f64)> = s
+                .paths
+                .iter_mut()
+                .map(|p| {
+                    p.rate = p.updates_in_interval as f64 * 1000.0 / elapsed;
+                    p.updates_in_interval = 0;
+                    (p.config.path.clone(), p.rate)
+                })
+                .collect();
+            Some(rates)
+        } else {
+            None
+        };
+        (changes, rates)
+    });
+
+    for change in &changes {
+        debug(&change.message);
+        emit_status(&change.path, change.status);
+        // Data arriving for the first time has no notification to clear
+        if change.previous == Status::Waiting && change.status == Status::Ok {
+            continue;
+        }
+        let state = match change.status {
+            Status::Stale if change.critical => "alarm",
+            Status::Stale | Status::Flapping => "warn",
+            _ => "normal",
+        };
+        emit_notification(&change.path, state, &change.message);
+    }
+    if !changes.is_empty() {
+        update_plugin_status();
+    }
+    if let Some(rates) = rates {
+        emit_rates(&rates);
+    }
+
+    0
+}
+
+fn update_plugin_status() {
+    let (total, problems) = STATE.with(|state| {
+        let s = state.borrow();
+        let problems: Vec<String> = s
+            .paths
+            .iter()
+            .filter(|p| p.status == Status::Stale || p.status == Status::Flapping)
+            .map(|p| format!("{} {}", p.config.path, p.status.as_str()))
+            .collect();
+        (s.paths.len(), problems)
+    });
+    if problems.is_empty() {
+        set_status(&format!("Monitoring {} path(s), all ok", total));
+    } else {
+        set_status(&format!("Monitoring {} path(s): {}", total, problems.join(", ")));
+    }
+}
+
+// =============================================================================
+// HTTP Endpoints - Custom REST API
+// =============================================================================
+
+/// Export HTTP endpoint definitions
+/// Returns JSON array of endpoint definitions
+#[no_mangle]
+pub extern "C" fn http_endpoints(out_ptr: *mut u8, out_max_len: usize) -> i32 {
+    let endpoints = r#"[
+        {"method": "GET", "path": "/api/status", "handler": "http_get_status", "permission": "read"}
+    ]"#;
+    write_string(endpoints, out_ptr, out_max_len)
+}
+
+/// GET /api/status - Return per-path and per-source statistics
+#[no_mangle]
+pub extern "C" fn http_get_status(
+    _request_ptr: *const u8,
+    _request_len: usize,
+    response_ptr: *mut u8,
+    response_max_len: usize,
+) -> i32 {
+    debug("HTTP GET /api/status");
+
+    let now = monotonic_ms();
+    let body = STATE.with(|state| {
+        let s = state.borrow();
+        let paths: Vec<serde_json::Value> = s
+            .paths
+            .iter()
+            .map(|p| {
+                let sources: Vec<serde_json::Value> = p
+                    .sources
+                    .iter()
+                    .map(|src| {
+                        serde_json::json!({
+                            "source": src.source,
+                            "age": (now - src.last_ms) / 1000.0,
+                            "updates": src.updates,
+                            "stale": src.stale,
+                            "recentDropouts": src.recoveries.len()
+                        })
+                    })
+                    .collect();
+                serde_json::json!({
+                    "path": p.config.path,
+                    "status": p.status.as_str(),
+                    "critical": p.config.critical,
+                    "maxAge": p.config.max_age,
+                    "updateRate": p.rate,
+                    "sources": sources
+                })
+            })
+            .collect();
+        serde_json::json!({
+            "running": s.is_running,
+            "paths": paths
+        })
+    });
+
+    let response = serde_json::json!({
+        "statusCode": 200,
+        "headers": { "Content-Type": "application/json" },
+        "body": body.to_string()
+    });
+    write_string(&response.to_string(), response_ptr, response_max_len)
+}
+
+// =============================================================================
+// Helper Functions
+// =============================================================================
+
+fn emit_status(path: &str, status: Status) {
+    let delta = serde_json::json!({
+        "context": "vessels.self",
+        "updates": [{
+            "values": [
+                { "path": format!("sensors.dataQuality.{}.status", path), "value": status.as_str() }
+            ]
+        }]
+    });
+    handle_message(&delta.to_string());
+}
+
+fn emit_rates(rates: &[(String, f64)]) {
+    let values: Vec<serde_json::Value> = rates
+        .iter()
+        .map(|(path, rate)| {
+            serde_json::json!({
+                "path": format!("sensors.dataQuality.{}.updateRate", path),
+                "value": (rate * 100.0).round() / 100.0
+            })
+        })
+        .collect();
+    if values.is_empty() {
+        return;
+    }
+    let delta = serde_json::json!({
+        "context": "vessels.self",
+        "updates": [{ "values": values }]
+    });
+    handle_message(&delta.to_string());
+}
+
+fn emit_notification(path: &str, state: &str, message: &str) {
+    let method: Vec<&str> = match state {
+        "normal" => vec![],
+        "warn" => vec!["visual"],
+        _ => vec!["visual", "sound"],
+    };
+    let delta = serde_json::json!({
+        "context": "vessels.self",
+        "updates": [{
+            "values": [{
+                "path": format!("notifications.dataQuality.{}", path),
+                "value": { "state": state, "method": method, "message": message }
+            }]
+        }]
+    });
+    handle_message(&delta.to_string());
+}
+
+fn write_string(s: &str, ptr: *mut u8, max_len: usize) -> i32 {
+    let bytes = s.as_bytes();
+    let len = bytes.len().min(max_len);
+
+    unsafe {
+        std::ptr::copy_nonoverlapping(bytes.as_ptr(), ptr, len);
+    }
+
+    len as i32
+}
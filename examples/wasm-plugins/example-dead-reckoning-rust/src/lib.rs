@@ -0,0 +1,588 @@
+//! Dead Reckoning WASM Plugin for Signal K
+//!
+//! A Rust implementation demonstrating:
+//! - Receiving deltas through the delta_handler export
+//! - Periodic work through the poll export
+//! - Publishing data under a distinct source label
+//! - Custom HTTP endpoints (REST API)
+//!
+//! When GNSS position updates stop arriving, the plugin estimates the vessel
+//! position from true heading and speed through water and publishes it as
+//! navigation.position with its own source. The estimated error grows with
+//! distance run, and estimation stops as soon as real fixes return.
+
+use std::cell::RefCell;
+use std::f64::consts::PI;
+use serde::{Deserialize, Serialize};
+
+// =============================================================================
+// FFI Imports - These must match what the SignalK WASM runtime provides in "env"
+// =============================================================================
+
+#[link(wasm_import_module = "env")]
+extern "C" {
+    fn sk_debug(ptr: *const u8, len: usize);
+    fn sk_set_status(ptr: *const u8, len: usize);
+    fn sk_set_error(ptr: *const u8, len: usize);
+    fn sk_handle_message(ptr: *const u8, len: usize, version: i32);
+    fn sk_monotonic_ms() -> f64;
+    fn sk_get_setting(key_ptr: *const u8, key_len: usize, buf_ptr: *mut u8, buf_max_len: usize) -> i32;
+}
+
+// =============================================================================
+// Helper wrappers for FFI functions
+// =============================================================================
+
+fn debug(msg: &str) {
+    unsafe { sk_debug(msg.as_ptr(), msg.len()); }
+}
+
+fn set_status(msg: &str) {
+    unsafe { sk_set_status(msg.as_ptr(), msg.len()); }
+}
+
+fn set_error(msg: &str) {
+    unsafe { sk_set_error(msg.as_ptr(), msg.len()); }
+}
+
+fn handle_message(msg: &str) {
+    unsafe { sk_handle_message(msg.as_ptr(), msg.len(), 1); }
+}
+
+fn monotonic_ms() -> f64 {
+    unsafe { sk_monotonic_ms() }
+}
+
+/// Read a whitelisted server setting, parsed from its JSON encoding
+fn get_setting(key: &str) -> Option<serde_json::Value> {
+    let mut buf = vec![0u8; 256];
+    let len = unsafe { sk_get_setting(key.as_ptr(), key.len(), buf.as_mut_ptr(), buf.len()) };
+    if len <= 0 {
+        return None;
+    }
+    serde_json::from_slice(&buf[..len as usize]).ok()
+}
+
+// =============================================================================
+// Plugin State
+// =============================================================================
+
+thread_local! {
+    static STATE: RefCell<PluginState> = RefCell::new(PluginState::default());
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(rename_all = "camelCase")]
+struct PluginConfig {
+    #[serde(default = "default_gnss_timeout")]
+    gnss_timeout: f64,
+    #[serde(default = "default_max_duration")]
+    max_duration: f64,
+    #[serde(default = "default_initial_error")]
+    initial_error: f64,
+    #[serde(default = "default_error_rate")]
+    error_rate: f64,
+}
+
+fn default_gnss_timeout() -> f64 { 10.0 }
+fn default_max_duration() -> f64 { 60.0 }
+fn default_initial_error() -> f64 { 10.0 }
+fn default_error_rate() -> f64 { 5.0 }
+
+impl Default for PluginConfig {
+    fn default() -> Self {
+        PluginConfig {
+            gnss_timeout: default_gnss_timeout(),
+            max_duration: default_max_duration(),
+            initial_error: default_initial_error(),
+            error_rate: default_error_rate(),
+        }
+    }
+}
+
+#[derive(Debug, Clone, Copy, PartialEq)]
+enum Mode {
+    /// Real fixes are arriving
+    Gnss,
+    /// Fixes stopped, publishing estimated positions
+    Estimating,
+    /// Estimation ran longer than max_duration and was abandoned
+    Expired,
+}
+
+impl Default for Mode {
+    fn default() -> Self { Mode::Gnss }
+}
+
+#[derive(Debug, Default)]
+struct PluginState {
+    config: PluginConfig,
+    is_running: bool,
+    /// Contexts that refer to this vessel in received deltas
+    self_contexts: Vec<String>,
+    mode: Mode,
+    last_fix: Option<(f64, f64)>,
+    last_fix_ms: f64,
+    heading_true: Option<f64>,
+    speed_through_water: Option<f64>,
+    /// Current estimate while estimating
+    estimate: (f64, f64),
+    estimate_ms: f64,
+    estimate_started_ms: f64,
+    distance_run: f64,
+}
+
+impl PluginState {
+    fn estimated_error(&self) -> f64 {
+        self.config.initial_error + self.distance_run * self.config.error_rate / 100.0
+    }
+}
+
+// =============================================================================
+// Memory Allocation for string passing
+// =============================================================================
+
+/// Allocate memory for string passing from host
+#[no_mangle]
+pub extern "C" fn allocate(size: usize) -> *mut u8 {
+    let mut buf = Vec::with_capacity(size);
+    let ptr = buf.as_mut_ptr();
+    std::mem::forget(buf);
+    ptr
+}
+
+/// Deallocate memory
+#[no_mangle]
+pub extern "C" fn deallocate(ptr: *mut u8, size: usize) {
+    unsafe {
+        let _ = Vec::from_raw_parts(ptr, 0, size);
+    }
+}
+
+// =============================================================================
+// Plugin Exports - Core plugin interface
+// =============================================================================
+
+static PLUGIN_ID: &str = "dead-reckoning-rust";
+static PLUGIN_NAME: &str = "Dead Reckoning (Rust)";
+static PLUGIN_SCHEMA: &str = r#"{
+    "type": "object",
+    "title": "Dead Reckoning Configuration",
+    "properties": {
+        "gnssTimeout": {
+            "type": "number",
+            "title": "GNSS Timeout (seconds)",
+            "description": "Start estimating when no position has been received for this long",
+            "default": 10,
+            "minimum": 2,
+            "maximum": 300
+        },
+        "maxDuration": {
+            "type": "number",
+            "title": "Maximum Duration (minutes)",
+            "description": "Stop publishing estimates after this long without a fix",
+            "default": 60,
+            "minimum": 1,
+            "maximum": 1440
+        },
+        "initialError": {
+            "type": "number",
+            "title": "Initial Error (meters)",
+            "description": "Estimated error of the last GNSS fix",
+            "default": 10,
+            "minimum": 0
+        },
+        "errorRate": {
+            "type": "number",
+            "title": "Error Growth (% of distance run)",
+            "description": "How fast the estimated error grows as the vessel moves",
+            "default": 5,
+            "minimum": 0,
+            "maximum": 100
+        }
+    }
+}"#;
+
+/// Source label of estimated positions, distinct from any GNSS receiver
+static SOURCE_LABEL: &str = "dead-reckoning";
+
+/// Return the plugin ID
+#[no_mangle]
+pub extern "C" fn plugin_id(out_ptr: *mut u8, out_max_len: usize) -> i32 {
+    write_string(PLUGIN_ID, out_ptr, out_max_len)
+}
+
+/// Return the plugin name
+#[no_mangle]
+pub extern "C" fn plugin_name(out_ptr: *mut u8, out_max_len: usize) -> i32 {
+    write_string(PLUGIN_NAME, out_ptr, out_max_len)
+}
+
+/// Return the plugin JSON schema
+#[no_mangle]
+pub extern "C" fn plugin_schema(out_ptr: *mut u8, out_max_len: usize) -> i32 {
+    write_string(PLUGIN_SCHEMA, out_ptr, out_max_len)
+}
+
+/// Start the plugin with configuration
+#[no_mangle]
+pub extern "C" fn plugin_start(config_ptr: *const u8, config_len: usize) -> i32 {
+    let config_json = unsafe {
+        let slice = std::slice::from_raw_parts(config_ptr, config_len);
+        String::from_utf8_lossy(slice).to_string()
+    };
+
+    let parsed_config: PluginConfig = match serde_json::from_str(&config_json) {
+        Ok(c) => c,
+        Err(e) => {
+            set_error(&format!("Failed to parse config: {}", e));
+            return 1;
+        }
+    };
+
+    // The server rewrites vessels.self to the vessel's identity before
+    // deltas reach delta_handler, using the MMSI when one is configured
+    let mut self_contexts = vec!["vessels.self".to_string()];
+    if let Some(serde_json::Value::String(mmsi)) = get_setting("vessel.mmsi") {
+        self_contexts.push(format!("vessels.urn:mrn:imo:mmsi:{}", mmsi));
+    } else if let Some(serde_json::Value::String(uuid)) = get_setting("vessel.uuid") {
+        self_contexts.push(format!("vessels.{}", uuid));
+    }
+
+    STATE.with(|state| {
+        let mut s = state.borrow_mut();
+        *s = PluginState::default();
+        s.config = parsed_config.clone();
+        s.is_running = true;
+        s.self_contexts = self_contexts;
+    });
+
+    debug(&format!(
+        "Dead reckoning started: gnssTimeout={}s, maxDuration={}min",
+        parsed_config.gnss_timeout,
+        parsed_config.max_duration
+    ));
+    set_status("Waiting for GNSS position");
+
+    0
+}
+
+/// Stop the plugin
+#[no_mangle]
+pub extern "C" fn plugin_stop() -> i32 {
+    let was_estimating = STATE.with(|state| {
+        let mut s = state.borrow_mut();
+        s.is_running = false;
+        s.mode != Mode::Gnss
+    });
+
+    if was_estimating {
+        emit_estimate_cleared();
+        emit_gnss_notification("normal", "Dead reckoning stopped");
+    }
+    debug("Dead reckoning stopped");
+    set_status("Stopped");
+
+    0
+}
+
+// =============================================================================
+// Delta Handler - track GNSS fixes, heading and speed
+// =============================================================================
+
+#[derive(Deserialize)]
+struct Delta {
+    context: Option<String>,
+    #[serde(default)]
+    updates: Vec<DeltaUpdate>,
+}
+
+#[derive(Deserialize)]
+struct DeltaUpdate {
+    #[serde(rename = "$source")]
+    source_ref: Option<String>,
+    #[serde(default)]
+    values: Vec<PathValue>,
+}
+
+#[derive(Deserialize)]
+struct PathValue {
+    path: String,
+    value: serde_json::Value,
+}
+
+/// Receive deltas from the server
+#[no_mangle]
+pub extern "C" fn delta_handler(delta_ptr: *const u8, delta_len: usize) {
+    let delta_json = unsafe {
+        let slice = std::slice::from_raw_parts(delta_ptr, delta_len);
+        String::from_utf8_lossy(slice).to_string()
+    };
+
+    // Filter early: most deltas carry nothing this plugin uses
+    if !delta_json.contains("navigation.") {
+        return;
+    }
+    let delta: Delta = match serde_json::from_str(&delta_json) {
+        Ok(d) => d,
+        Err(_) => return,
+    };
+
+    let regained_fix = STATE.with(|state| {
+        let mut s = state.borrow_mut();
+        if !s.is_running {
+            return false;
+        }
+        let context = delta.context.as_deref().unwrap_or("vessels.self");
+        if !s.self_contexts.iter().any(|c| c == context) {
+            return false;
+        }
+
+        let mut regained_fix = false;
+        for update in &delta.updates {
+            // Ignore our own estimates echoed back by the server
+            if update.source_ref.as_deref() == Some(SOURCE_LABEL) {
+                continue;
+            }
+            for pv in &update.values {
+                match pv.path.as_str() {
+                    "navigation.position" => {
+                        let lat = pv.value.get("latitude").and_then(|v| v.as_f64());
+                        let lon = pv.value.get("longitude").and_then(|v| v.as_f64());
+                        if let (Some(lat), Some(lon)) = (lat, lon) {
+                            s.last_fix = Some((lat, lon));
+                            s.last_fix_ms = monotonic_ms();
+                            if s.mode != Mode::Gnss {
+                                s.mode = Mode::Gnss;
+                                regained_fix = true;
+                            }
+                        }
+                    }
+                    "navigation.headingTrue" => s.heading_true = pv.value.as_f64(),
+                    "navigation.speedThroughWater" => s.speed_through_water = pv.value.as_f64(),
+                    _ => {}
+                }
+            }
+        }
+        regained_fix
+    });
+
+    if regained_fix {
+        debug("GNSS position restored, dead reckoning ended");
+        set_status("GNSS position available");
+        emit_estimate_cleared();
+        emit_gnss_notification("normal", "GNSS position available");
+    }
+}
+
+// =============================================================================
+// Poll - advance the estimate once per second
+// =============================================================================
+
+/// Called by the server about once per second
+#[no_mangle]
+pub extern "C" fn poll() -> i32 {
+    let now = monotonic_ms();
+
+    enum Action {
+        None,
+        Started,
+        Estimate(f64, f64, f64),
+        Expired,
+    }
+
+    let action = STATE.with(|state| {
+        let mut s = state.borrow_mut();
+        let fix = match s.last_fix {
+            Some(fix) if s.is_running => fix,
+            _ => return Action::None,
+        };
+
+        match s.mode {
+            Mode::Expired => Action::None,
+            Mode::Gnss => {
+                if now - s.last_fix_ms < s.config.gnss_timeout * 1000.0 {
+                    return Action::None;
+                }
+                // Start from the last fix, as if the vessel had kept moving
+                // since then at the current heading and speed
+                s.mode = Mode::Estimating;
+                s.estimate = fix;
+                s.estimate_ms = s.last_fix_ms;
+                s.estimate_started_ms = now;
+                s.distance_run = 0.0;
+                Action::Started
+            }
+            Mode::Estimating => {
+                if now - s.estimate_started_ms > s.config.max_duration * 60000.0 {
+                    s.mode = Mode::Expired;
+                    return Action::Expired;
+                }
+                let (heading, speed) = match (s.heading_true, s.speed_through_water) {
+                    (Some(h), Some(v)) => (h, v),
+                    _ => return Action::None,
+                };
+                let distance = speed.max(0.0) * (now - s.estimate_ms) / 1000.0;
+                s.estimate = destination_point(s.estimate.0, s.estimate.1, heading, distance);
+                s.estimate_ms = now;
+                s.distance_run += distance;
+                Action::Estimate(s.estimate.0, s.estimate.1, s.estimated_error())
+            }
+        }
+    });
+
+    match action {
+        Action::None => {}
+        Action::Started => {
+            debug("GNSS position lost, starting dead reckoning");
+            set_status("GNSS lost - publishing dead reckoning position");
+            emit_gnss_notification("warn", "GNSS position lost, using dead reckoning");
+        }
+        Action::Estimate(lat, lon, error) => emit_estimate(lat, lon, error),
+        Action::Expired => {
+            debug("Dead reckoning maximum duration reached");
+            set_status("GNSS lost - dead reckoning stopped after maximum duration");
+            emit_estimate_cleared();
+            emit_gnss_notification("alarm", "GNSS position lost, dead reckoning expired");
+        }
+    }
+
+    0
+}
+
+// =============================================================================
+// HTTP Endpoints - Custom REST API
+// =============================================================================
+
+/// Export HTTP endpoint definitions
+/// Returns JSON array of endpoint definitions
+#[no_mangle]
+pub extern "C" fn http_endpoints(out_ptr: *mut u8, out_max_len: usize) -> i32 {
+    let endpoints = r#"[
+        {"method": "GET", "path": "/api/status", "handler": "http_get_status", "permission": "read"}
+    ]"#;
+    write_string(endpoints, out_ptr, out_max_len)
+}
+
+/// GET /api/status - Return current dead reckoning state
+#[no_mangle]
+pub extern "C" fn http_get_status(
+    _request_ptr: *const u8,
+    _request_len: usize,
+    response_ptr: *mut u8,
+    response_max_len: usize,
+) -> i32 {
+    debug("HTTP GET /api/status");
+
+    let body = STATE.with(|state| {
+        let s = state.borrow();
+        let mode = match s.mode {
+            Mode::Gnss => "gnss",
+            Mode::Estimating => "estimating",
+            Mode::Expired => "expired",
+        };
+        let estimate = if s.mode == Mode::Estimating {
+            serde_json::json!({
+                "position": { "latitude": s.estimate.0, "longitude": s.estimate.1 },
+                "estimatedError": s.estimated_error(),
+                "distanceRun": s.distance_run
+            })
+        } else {
+            serde_json::Value::Null
+        };
+        serde_json::json!({
+            "running": s.is_running,
+            "mode": mode,
+            "lastFix": s.last_fix.map(|(lat, lon)| serde_json::json!({ "latitude": lat, "longitude": lon })),
+            "headingTrue": s.heading_true,
+            "speedThroughWater": s.speed_through_water,
+            "estimate": estimate
+        })
+    });
+
+    let response = serde_json::json!({
+        "statusCode": 200,
+        "headers": { "Content-Type": "application/json" },
+        "body": body.to_string()
+    });
+    write_string(&response.to_string(), response_ptr, response_max_len)
+}
+
+// =============================================================================
+// Helper Functions
+// =============================================================================
+
+/// Publish an estimated position under the dead reckoning source
+fn emit_estimate(lat: f64, lon: f64, error: f64) {
+    // An explicit source keeps estimates apart from GNSS positions, so
+    // source priorities and clients can tell them apart
+    let delta = serde_json::json!({
+        "context": "vessels.self",
+        "updates": [{
+            "source": { "label": SOURCE_LABEL, "type": "plugin" },
+            "values": [
+                { "path": "navigation.position", "value": { "latitude": lat, "longitude": lon } },
+                { "path": "navigation.deadReckoning.estimatedError", "value": error }
+            ]
+        }]
+    });
+    handle_message(&delta.to_string());
+}
+
+/// Clear the estimated error once no estimate is being published
+fn emit_estimate_cleared() {
+    let delta = serde_json::json!({
+        "context": "vessels.self",
+        "updates": [{
+            "source": { "label": SOURCE_LABEL, "type": "plugin" },
+            "values": [
+                { "path": "navigation.deadReckoning.estimatedError", "value": null }
+            ]
+        }]
+    });
+    handle_message(&delta.to_string());
+}
+
+fn emit_gnss_notification(state: &str, message: &str) {
+    let method: Vec<&str> = match state {
+        "normal" => vec![],
+        "warn" => vec!["visual"],
+        _ => vec!["visual", "sound"],
+    };
+    let delta = serde_json::json!({
+        "context": "vessels.self",
+        "updates": [{
+            "values": [{
+                "path": "notifications.navigation.gnss",
+                "value": { "state": state, "method": method, "message": message }
+            }]
+        }]
+    });
+    handle_message(&delta.to_string());
+}
+
+fn write_string(s: &str, ptr: *mut u8, max_len: usize) -> i32 {
+    let bytes = s.as_bytes();
+    let len = bytes.len().min(max_len);
+
+    unsafe {
+        std::ptr::copy_nonoverlapping(bytes.as_ptr(), ptr, len);
+    }
+
+    len as i32
+}
+
+const EARTH_RADIUS_M: f64 = 6_371_000.0;
+
+/// Position `distance` meters from a point (degrees) along `bearing` (radians)
+fn destination_point(lat: f64, lon: f64, bearing: f64, distance: f64) -> (f64, f64) {
+    let lat1 = lat * PI / 180.0;
+    let lon1 = lon * PI / 180.0;
+    let angular = distance / EARTH_RADIUS_M;
+
+    let lat2 = (lat1.sin() * angular.cos() + lat1.cos() * angular.sin() * bearing.cos()).asin();
+    let lon2 = lon1
+        + (bearing.sin() * angular.sin() * lat1.cos()).atan2(angular.cos() - lat1.sin() * lat2.sin());
+
+    (lat2 * 180.0 / PI, lon2 * 180.0 / PI)
+}
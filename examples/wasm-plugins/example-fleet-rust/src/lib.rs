@@ -0,0 +1,673 @@
+//! Buddy Boat Fleet Tracker WASM Plugin for Signal K
+//!
+//! A Rust implementation demonstrating:
+//! - Declaring subscriptions through the plugin_subscriptions export
+//! - Registering a custom resource type (buddies)
+//! - Publishing data for other vessel contexts
+//!
+//! The plugin follows the positions of a configured list of buddy boats.
+//! Positions arrive either from AIS, as deltas for the buddy's vessel
+//! context, or through the Resources API from a remote tracker or app
+//! that has no AIS link. All buddies are available as
+//! /signalk/v2/api/resources/buddies, and positions received through the
+//! API are published into the data model so chart plotters show them
+//! like AIS targets.
+
+use std::cell::RefCell;
+use serde::Deserialize;
+
+// =============================================================================
+// FFI Imports - These must match what the SignalK WASM runtime provides in "env"
+// =============================================================================
+
+#[link(wasm_import_module = "env")]
+extern "C" {
+    fn sk_debug(ptr: *const u8, len: usize);
+    fn sk_set_status(ptr: *const u8, len: usize);
+    fn sk_set_error(ptr: *const u8, len: usize);
+    fn sk_handle_message(ptr: *const u8, len: usize, version: i32);
+    fn sk_now_ms() -> f64;
+    fn sk_register_resource_provider(type_ptr: *const u8, type_len: usize) -> i32;
+}
+
+// =============================================================================
+// Helper wrappers for FFI functions
+// =============================================================================
+
+fn debug(msg: &str) {
+    unsafe { sk_debug(msg.as_ptr(), msg.len()); }
+}
+
+fn set_status(msg: &str) {
+    unsafe { sk_set_status(msg.as_ptr(), msg.len()); }
+}
+
+fn set_error(msg: &str) {
+    unsafe { sk_set_error(msg.as_ptr(), msg.len()); }
+}
+
+fn handle_message(msg: &str) {
+    unsafe { sk_handle_message(msg.as_ptr(), msg.len(), 1); }
+}
+
+fn now_ms() -> f64 {
+    unsafe { sk_now_ms() }
+}
+
+fn register_resource_provider(resource_type: &str) -> bool {
+    unsafe { sk_register_resource_provider(resource_type.as_ptr(), resource_type.len()) == 1 }
+}
+
+// =============================================================================
+// Plugin State
+// =============================================================================
+
+static RESOURCE_TYPE: &str = "buddies";
+static MMSI_CONTEXT_PREFIX: &str = "vessels.urn:mrn:imo:mmsi:";
+
+thread_local! {
+    static STATE: RefCell<PluginState> = RefCell::new(PluginState::default());
+}
+
+#[derive(Debug, Clone, Deserialize)]
+#[serde(rename_all = "camelCase")]
+struct PluginConfig {
+    #[serde(default)]
+    buddies: Vec<BuddyConfig>,
+    #[serde(default = "default_max_age")]
+    max_age: f64,
+    #[serde(default = "default_accept_unknown")]
+    accept_unknown: bool,
+}
+
+#[derive(Debug, Clone, Deserialize)]
+struct BuddyConfig {
+    mmsi: String,
+    #[serde(default)]
+    name: String,
+}
+
+fn default_max_age() -> f64 { 900.0 }
+fn default_accept_unknown() -> bool { false }
+
+impl Default for PluginConfig {
+    fn default() -> Self {
+        PluginConfig {
+            buddies: Vec::new(),
+            max_age: default_max_age(),
+            accept_unknown: default_accept_unknown(),
+        }
+    }
+}
+
+#[derive(Debug, Clone, Copy, PartialEq)]
+enum PositionSource {
+    Ais,
+    Api,
+}
+
+impl PositionSource {
+    fn as_str(&self) -> &'static str {
+        match self {
+            PositionSource::Ais => "ais",
+            PositionSource::Api => "api",
+        }
+    }
+}
+
+#[derive(Debug, Clone)]
+struct Fix {
+    latitude: f64,
+    longitude: f64,
+    speed_over_ground: Option<f64>,
+    course_over_ground_true: Option<f64>,
+    /// ISO 8601 timestamp of the fix
+    timestamp: String,
+    received_ms: f64,
+    source: PositionSource,
+}
+
+#[derive(Debug)]
+struct Buddy {
+    mmsi: String,
+    name: String,
+    /// False for boats added through the Resources API
+    configured: bool,
+    fix: Option<Fix>,
+}
+
+#[derive(Debug, Default)]
+struct PluginState {
+    config: PluginConfig,
+    is_running: bool,
+    buddies: Vec<Buddy>,
+}
+
+impl Buddy {
+    fn to_resource(&self, now: f64, max_age: f64) -> serde_json::Value {
+        let mut resource = serde_json::json!({
+            "name": self.name,
+            "mmsi": self.mmsi
+        });
+        if let Some(fix) = &self.fix {
+            resource["position"] = serde_json::json!({
+                "latitude": fix.latitude,
+                "longitude": fix.longitude
+            });
+            if let Some(sog) = fix.speed_over_ground {
+                resource["speedOverGround"] = sog.into();
+            }
+            if let Some(cog) = fix.course_over_ground_true {
+                resource["courseOverGroundTrue"] = cog.into();
+            }
+            resource["timestamp"] = fix.timestamp.clone().into();
+            resource["source"] = fix.source.as_str().into();
+            resource["stale"] = (now - fix.received_ms > max_age * 1000.0).into();
+        }
+        resource
+    }
+}
+
+// =============================================================================
+// Memory Allocation for string passing
+// =============================================================================
+
+/// Allocate memory for string passing from host
+#[no_mangle]
+pub extern "C" fn allocate(size: usize) -> *mut u8 {
+    let mut buf = Vec::with_capacity(size);
+    let ptr = buf.as_mut_ptr();
+    std::mem::forget(buf);
+    ptr
+}
+
+/// Deallocate memory
+#[no_mangle]
+pub extern "C" fn deallocate(ptr: *mut u8, size: usize) {
+    unsafe {
+        let _ = Vec::from_raw_parts(ptr, 0, size);
+    }
+}
+
+// =============================================================================
+// Plugin Exports - Core plugin interface
+// =============================================================================
+
+static PLUGIN_ID: &str = "fleet-rust";
+static PLUGIN_NAME: &str = "Buddy Boat Fleet Tracker (Rust)";
+static PLUGIN_SCHEMA: &str = r#"{
+    "type": "object",
+    "title": "Fleet Tracker Configuration",
+    "properties": {
+        "buddies": {
+            "type": "array",
+            "title": "Buddy Boats",
+            "default": [],
+            "items": {
+                "type": "object",
+                "required": ["mmsi"],
+                "properties": {
+                    "mmsi": {
+                        "type": "string",
+                        "title": "MMSI",
+                        "pattern": "^[0-9]{9}$"
+                    },
+                    "name": {
+                        "type": "string",
+                        "title": "Name"
+                    }
+                }
+            }
+        },
+        "maxAge": {
+            "type": "number",
+            "title": "Maximum Age (seconds)",
+            "description": "Positions older than this are marked stale",
+            "default": 900,
+            "minimum": 10
+        },
+        "acceptUnknown": {
+            "type": "boolean",
+            "title": "Accept Unknown Boats",
+            "description": "Add boats that are not in the list when their position is posted to the Resources API",
+            "default": false
+        }
+    }
+}"#;
+
+/// Return the plugin ID
+#[no_mangle]
+pub extern "C" fn plugin_id(out_ptr: *mut u8, out_max_len: usize) -> i32 {
+    write_string(PLUGIN_ID, out_ptr, out_max_len)
+}
+
+/// Return the plugin name
+#[no_mangle]
+pub extern "C" fn plugin_name(out_ptr: *mut u8, out_max_len: usize) -> i32 {
+    write_string(PLUGIN_NAME, out_ptr, out_max_len)
+}
+
+/// Return the plugin JSON schema
+#[no_mangle]
+pub extern "C" fn plugin_schema(out_ptr: *mut u8, out_max_len: usize) -> i32 {
+    write_string(PLUGIN_SCHEMA, out_ptr, out_max_len)
+}
+
+/// Declare the subscriptions the server sets up for delta_handler
+#[no_mangle]
+pub extern "C" fn plugin_subscriptions(out_ptr: *mut u8, out_max_len: usize) -> i32 {
+    let subscriptions = r#"[
+        {"context": "vessels.*", "path": "navigation.position", "period": 5000},
+        {"context": "vessels.*", "path": "navigation.speedOverGround", "period": 5000},
+        {"context": "vessels.*", "path": "navigation.courseOverGroundTrue", "period": 5000}
+    ]"#;
+    write_string(subscriptions, out_ptr, out_max_len)
+}
+
+/// Start the plugin with configuration
+#[no_mangle]
+pub extern "C" fn plugin_start(config_ptr: *const u8, config_len: usize) -> i32 {
+    let config_json = unsafe {
+        let slice = std::slice::from_raw_parts(config_ptr, config_len);
+        String::from_utf8_lossy(slice).to_string()
+    };
+
+    let parsed_config: PluginConfig = match serde_json::from_str(&config_json) {
+        Ok(c) => c,
+        Err(e) => {
+            set_error(&format!("Failed to parse config: {}", e));
+            return 1;
+        }
+    };
+
+    let buddies: Vec<Buddy> = parsed_config
+        .buddies
+        .iter()
+        .filter(|b| is_mmsi(&b.mmsi))
+        .map(|b| Buddy {
+            mmsi: b.mmsi.clone(),
+            name: if b.name.is_empty() { b.mmsi.clone() } else { b.name.clone() },
+            configured: true,
+            fix: None,
+        })
+        .collect();
+
+    if !register_resource_provider(RESOURCE_TYPE) {
+        set_error("Failed to register as buddies resource provider");
+        return 1;
+    }
+
+    let count = buddies.len();
+    STATE.with(|state| {
+        let mut s = state.borrow_mut();
+        s.config = parsed_config;
+        s.is_running = true;
+        s.buddies = buddies;
+    });
+
+    debug(&format!("Fleet tracker started for {} buddy boat(s)", count));
+    update_plugin_status();
+
+    0
+}
+
+/// Stop the plugin
+#[no_mangle]
+pub extern "C" fn plugin_stop() -> i32 {
+    STATE.with(|state| {
+        state.borrow_mut().is_running = false;
+    });
+    debug("Fleet tracker stopped");
+    set_status("Stopped");
+
+    0
+}
+
+// =============================================================================
+// Delta Handler - positions of buddy boats received over AIS
+// =============================================================================
+
+#[derive(Deserialize)]
+struct Delta {
+    context: Option<String>,
+    #[serde(default)]
+    updates: Vec<DeltaUpdate>,
+}
+
+#[derive(Deserialize)]
+struct DeltaUpdate {
+    #[serde(rename = "$source")]
+    source_ref: Option<String>,
+    timestamp: Option<String>,
+    #[serde(default)]
+    values: Vec<PathValue>,
+}
+
+#[derive(Deserialize)]
+struct PathValue {
+    path: String,
+    value: serde_json::Value,
+}
+
+/// Receive deltas for the subscribed paths
+#[no_mangle]
+pub extern "C" fn delta_handler(delta_ptr: *const u8, delta_len: usize) {
+    let delta_json = unsafe {
+        let slice = std::slice::from_raw_parts(delta_ptr, delta_len);
+        String::from_utf8_lossy(slice).to_string()
+    };
+
+    let delta: Delta = match serde_json::from_str(&delta_json) {
+        Ok(d) => d,
+        Err(_) => return,
+    };
+    let mmsi = match delta.context.as_deref().and_then(|c| c.strip_prefix(MMSI_CONTEXT_PREFIX)) {
+        Some(mmsi) => mmsi.to_string(),
+        None => return,
+    };
+
+    let received = STATE.with(|state| {
+        let mut s = state.borrow_mut();
+        if !s.is_running {
+            return false;
+        }
+        let buddy = match s.buddies.iter_mut().find(|b| b.mmsi == mmsi) {
+            Some(b) => b,
+            None => return false,
+        };
+
+        let now = now_ms();
+        let mut received = false;
+        for update in &delta.updates {
+            // Positions this plugin published from the Resources API
+            if update.source_ref.as_deref() == Some(PLUGIN_ID) {
+                continue;
+            }
+            let timestamp = update.timestamp.clone().unwrap_or_else(|| iso_timestamp(now));
+            for pv in &update.values {
+                match pv.path.as_str() {
+                    "navigation.position" => {
+                        let (lat, lon) = match (
+                            pv.value.get("latitude").and_then(|v| v.as_f64()),
+                            pv.value.get("longitude").and_then(|v| v.as_f64()),
+                        ) {
+                            (Some(lat), Some(lon)) => (lat, lon),
+                            _ => continue,
+                        };
+                        let previous = buddy.fix.take();
+                        buddy.fix = Some(Fix {
+                            latitude: lat,
+                            longitude: lon,
+                            speed_over_ground: previous.as_ref().and_then(|f| f.speed_over_ground),
+                            course_over_ground_true: previous
+                                .as_ref()
+                                .and_then(|f| f.course_over_ground_true),
+                            timestamp: timestamp.clone(),
+                            received_ms: now,
+                            source: PositionSource::Ais,
+                        });
+                        received = true;
+                    }
+                    "navigation.speedOverGround" => {
+                        if let Some(fix) = buddy.fix.as_mut() {
+                            fix.speed_over_ground = pv.value.as_f64();
+                        }
+                    }
+                    "navigation.courseOverGroundTrue" => {
+                        if let Some(fix) = buddy.fix.as_mut() {
+                            fix.course_over_ground_true = pv.value.as_f64();
+                        }
+                    }
+                    _ => {}
+                }
+            }
+        }
+        received
+    });
+
+    if received {
+        update_plugin_status();
+    }
+}
+
+// =============================================================================
+// Resource Provider - the buddies resource type
+// =============================================================================
+
+#[derive(Deserialize)]
+struct ResourceRequest {
+    id: Option<String>,
+    value: Option<serde_json::Value>,
+}
+
+fn read_request(ptr: *const u8, len: usize) -> Option<ResourceRequest> {
+    let json = unsafe {
+        let slice = std::slice::from_raw_parts(ptr, len);
+        String::from_utf8_lossy(slice).to_string()
+    };
+    serde_json::from_str(&json).ok()
+}
+
+/// GET /signalk/v2/api/resources/buddies
+#[no_mangle]
+pub extern "C" fn resources_list_resources(
+    _request_ptr: *const u8,
+    _request_len: usize,
+    response_ptr: *mut u8,
+    response_max_len: usize,
+) -> i32 {
+    let now = now_ms();
+    let resources = STATE.with(|state| {
+        let s = state.borrow();
+        let mut resources = serde_json::Map::new();
+        for buddy in &s.buddies {
+            resources.insert(buddy.mmsi.clone(), buddy.to_resource(now, s.config.max_age));
+        }
+        serde_json::Value::Object(resources)
+    });
+    write_string(&resources.to_string(), response_ptr, response_max_len)
+}
+
+/// GET /signalk/v2/api/resources/buddies/{mmsi}
+#[no_mangle]
+pub extern "C" fn resources_get_resource(
+    request_ptr: *const u8,
+    request_len: usize,
+    response_ptr: *mut u8,
+    response_max_len: usize,
+) -> i32 {
+    let id = read_request(request_ptr, request_len).and_then(|r| r.id).unwrap_or_default();
+    let now = now_ms();
+    let resource = STATE.with(|state| {
+        let s = state.borrow();
+        match s.buddies.iter().find(|b| b.mmsi == id) {
+            Some(buddy) => buddy.to_resource(now, s.config.max_age),
+            None => serde_json::json!({ "error": format!("Unknown buddy boat ({})", id) }),
+        }
+    });
+    write_string(&resource.to_string(), response_ptr, response_max_len)
+}
+
+/// PUT /signalk/v2/api/resources/buddies/{mmsi} - report a position
+///
+/// The request body takes the same fields as the resources returned by
+/// GET, for example `{"position": {"latitude": 60.1, "longitude": 24.9}}`.
+#[no_mangle]
+pub extern "C" fn resources_set_resource(
+    request_ptr: *const u8,
+    request_len: usize,
+    response_ptr: *mut u8,
+    response_max_len: usize,
+) -> i32 {
+    let result = match read_request(request_ptr, request_len) {
+        Some(ResourceRequest { id: Some(id), value: Some(value) }) => set_position(&id, &value),
+        _ => Err("Invalid request".to_string()),
+    };
+    match result {
+        Ok(()) => {
+            update_plugin_status();
+            write_string("", response_ptr, response_max_len)
+        }
+        Err(e) => {
+            debug(&format!("Rejected buddy position: {}", e));
+            write_string(&e, response_ptr, response_max_len)
+        }
+    }
+}
+
+/// DELETE /signalk/v2/api/resources/buddies/{mmsi}
+///
+/// Forgets the last position; boats added through the API are removed.
+#[no_mangle]
+pub extern "C" fn resources_delete_resource(
+    request_ptr: *const u8,
+    request_len: usize,
+    response_ptr: *mut u8,
+    response_max_len: usize,
+) -> i32 {
+    let id = read_request(request_ptr, request_len).and_then(|r| r.id).unwrap_or_default();
+    STATE.with(|state| {
+        let mut s = state.borrow_mut();
+        s.buddies.retain(|b| b.configured || b.mmsi != id);
+        if let Some(buddy) = s.buddies.iter_mut().find(|b| b.mmsi == id) {
+            buddy.fix = None;
+        }
+    });
+    update_plugin_status();
+    write_string("", response_ptr, response_max_len)
+}
+
+fn set_position(mmsi: &str, value: &serde_json::Value) -> Result<(), String> {
+    if !is_mmsi(mmsi) {
+        return Err(format!("Resource id must be a 9 digit MMSI ({})", mmsi));
+    }
+    let position = value.get("position").ok_or("Missing position")?;
+    let latitude = position
+        .get("latitude")
+        .and_then(|v| v.as_f64())
+        .filter(|lat| (-90.0..=90.0).contains(lat))
+        .ok_or("Invalid latitude")?;
+    let longitude = position
+        .get("longitude")
+        .and_then(|v| v.as_f64())
+        .filter(|lon| (-180.0..=180.0).contains(lon))
+        .ok_or("Invalid longitude")?;
+
+    let now = now_ms();
+    let fix = Fix {
+        latitude,
+        longitude,
+        speed_over_ground: value.get("speedOverGround").and_then(|v| v.as_f64()),
+        course_over_ground_true: value.get("courseOverGroundTrue").and_then(|v| v.as_f64()),
+        timestamp: value
+            .get("timestamp")
+            .and_then(|v| v.as_str())
+            .map(|t| t.to_string())
+            .unwrap_or_else(|| iso_timestamp(now)),
+        received_ms: now,
+        source: PositionSource::Api,
+    };
+    let name = value.get("name").and_then(|v| v.as_str()).unwrap_or(mmsi).to_string();
+
+    let name = STATE.with(|state| {
+        let mut s = state.borrow_mut();
+        if !s.buddies.iter().any(|b| b.mmsi == mmsi) {
+            if !s.config.accept_unknown {
+                return Err(format!("Unknown buddy boat ({})", mmsi));
+            }
+            s.buddies.push(Buddy {
+                mmsi: mmsi.to_string(),
+                name,
+                configured: false,
+                fix: None,
+            });
+        }
+        let buddy = s.buddies.iter_mut().find(|b| b.mmsi == mmsi).unwrap();
+        buddy.fix = Some(fix.clone());
+        Ok(buddy.name.clone())
+    })?;
+
+    emit_vessel(mmsi, &name, &fix);
+    Ok(())
+}
+
+// =============================================================================
+// Helper Functions
+// =============================================================================
+
+/// Publish a position received through the API on the buddy's vessel
+/// context, where chart plotters pick it up like an AIS target
+fn emit_vessel(mmsi: &str, name: &str, fix: &Fix) {
+    let mut values = vec![
+        serde_json::json!({ "path": "", "value": { "name": name, "mmsi": mmsi } }),
+        serde_json::json!({
+            "path": "navigation.position",
+            "value": { "latitude": fix.latitude, "longitude": fix.longitude }
+        }),
+    ];
+    if let Some(sog) = fix.speed_over_ground {
+        values.push(serde_json::json!({ "path": "navigation.speedOverGround", "value": sog }));
+    }
+    if let Some(cog) = fix.course_over_ground_true {
+        values.push(serde_json::json!({ "path": "navigation.courseOverGroundTrue", "value": cog }));
+    }
+    let delta = serde_json::json!({
+        "context": format!("{}{}", MMSI_CONTEXT_PREFIX, mmsi),
+        "updates": [{ "timestamp": fix.timestamp, "values": values }]
+    });
+    handle_message(&delta.to_string());
+}
+
+fn update_plugin_status() {
+    let (total, located) = STATE.with(|state| {
+        let s = state.borrow();
+        let located = s.buddies.iter().filter(|b| b.fix.is_some()).count();
+        (s.buddies.len(), located)
+    });
+    set_status(&format!("Tracking {} buddy boat(s), {} with a position", total, located));
+}
+
+fn is_mmsi(id: &str) -> bool {
+    id.len() == 9 && id.bytes().all(|b| b.is_ascii_digit())
+}
+
+/// Format epoch milliseconds as an ISO 8601 UTC timestamp
+fn iso_timestamp(ms: f64) -> String {
+    let total_secs = (ms / 1000.0).floor() as i64;
+    let millis = (ms - total_secs as f64 * 1000.0) as i64;
+    let days = total_secs.div_euclid(86400);
+    let secs = total_secs.rem_euclid(86400);
+
+    // Civil date from days since 1970-01-01 (Howard Hinnant's algorithm)
+    let z = days + 719468;
+    let era = z.div_euclid(146097);
+    let doe = z - era * 146097;
+    let yoe = (doe - doe / 1460 + doe / 36524 - doe / 146096) / 365;
+    let doy = doe - (365 * yoe + yoe / 4 - yoe / 100);
+    let mp = (5 * doy + 2) / 153;
+    let day = doy - (153 * mp + 2) / 5 + 1;
+    let month = if mp < 10 { mp + 3 } else { mp - 9 };
+    let year = yoe + era * 400 + if month <= 2 { 1 } else { 0 };
+
+    format!(
+        "{:04}-{:02}-{:02}T{:02}:{:02}:{:02}.{:03}Z",
+        year,
+        month,
+        day,
+        secs / 3600,
+        secs % 3600 / 60,
+        secs % 60,
+        millis
+    )
+}
+
+fn write_string(s: &str, ptr: *mut u8, max_len: usize) -> i32 {
+    let bytes = s.as_bytes();
+    let len = bytes.len().min(max_len);
+
+    unsafe {
+        std::ptr::copy_nonoverlapping(bytes.as_ptr(), ptr, len);
+    }
+
+    len as i32
+}
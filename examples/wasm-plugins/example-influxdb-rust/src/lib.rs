@@ -0,0 +1,935 @@
+//! InfluxDB Exporter WASM Plugin for Signal K
+//!
+//! A Rust implementation demonstrating:
+//! - A durable outbound pipeline: batches survive network outages and
+//!   restarts in the plugin's VFS and are sent in order once the
+//!   database is reachable again
+//! - HTTP over a raw TCP socket (rawSockets capability)
+//! - Declaring subscriptions from the plugin configuration
+//!
+//! The plugin writes the configured paths to an InfluxDB 2.x bucket in
+//! line protocol. Each path is a measurement tagged with the context and
+//! source of the data; numbers are stored in a "value" field and object
+//! values such as navigation.position as one field per member.
+
+use std::cell::RefCell;
+use std::collections::VecDeque;
+use std::fs;
+use serde::Deserialize;
+
+// =============================================================================
+// FFI Imports - These must match what the SignalK WASM runtime provides in "env"
+// =============================================================================
+
+#[link(wasm_import_module = "env")]
+extern "C" {
+    fn sk_debug(ptr: *const u8, len: usize);
+    fn sk_set_status(ptr: *const u8, len: usize);
+    fn sk_set_error(ptr: *const u8, len: usize);
+    fn sk_now_ms() -> f64;
+    fn sk_monotonic_ms() -> f64;
+    fn sk_tcp_create() -> i32;
+    fn sk_tcp_connect(socket_id: i32, addr_ptr: *const u8, addr_len: usize, port: u16) -> i32;
+    fn sk_tcp_connected(socket_id: i32) -> i32;
+    fn sk_tcp_set_line_buffering(socket_id: i32, enabled: i32) -> i32;
+    fn sk_tcp_send(socket_id: i32, data_ptr: *const u8, data_len: usize) -> i32;
+    fn sk_tcp_recv_raw(socket_id: i32, buf_ptr: *mut u8, buf_max_len: usize) -> i32;
+    fn sk_tcp_close(socket_id: i32);
+}
+
+// =============================================================================
+// Helper wrappers for FFI functions
+// =============================================================================
+
+fn debug(msg: &str) {
+    unsafe { sk_debug(msg.as_ptr(), msg.len()); }
+}
+
+fn set_status(msg: &str) {
+    unsafe { sk_set_status(msg.as_ptr(), msg.len()); }
+}
+
+fn set_error(msg: &str) {
+    unsafe { sk_set_error(msg.as_ptr(), msg.len()); }
+}
+
+fn now_ms() -> f64 {
+    unsafe { sk_now_ms() }
+}
+
+fn monotonic_ms() -> f64 {
+    unsafe { sk_monotonic_ms() }
+}
+
+/// Create a TCP socket in raw mode and start connecting it
+fn tcp_open(host: &str, port: u16) -> Option<i32> {
+    let socket = unsafe { sk_tcp_create() };
+    if socket < 0 {
+        return None;
+    }
+    // HTTP headers end with an empty line, which line buffering drops
+    unsafe { sk_tcp_set_line_buffering(socket, 0) };
+    if unsafe { sk_tcp_connect(socket, host.as_ptr(), host.len(), port) } < 0 {
+        unsafe { sk_tcp_close(socket) };
+        return None;
+    }
+    Some(socket)
+}
+
+// =============================================================================
+// Plugin State
+// =============================================================================
+
+thread_local! {
+    static STATE: RefCell<PluginState> = RefCell::new(PluginState::default());
+}
+
+#[derive(Debug, Clone, Deserialize)]
+#[serde(rename_all = "camelCase")]
+struct PluginConfig {
+    #[serde(default)]
+    host: String,
+    #[serde(default = "default_port")]
+    port: u16,
+    #[serde(default)]
+    org: String,
+    #[serde(default)]
+    bucket: String,
+    #[serde(default)]
+    token: String,
+    #[serde(default = "default_paths")]
+    paths: Vec<ExportedPath>,
+    #[serde(default = "default_batch_size")]
+    batch_size: usize,
+    #[serde(default = "default_flush_interval")]
+    flush_interval: f64,
+    #[serde(default = "default_max_buffered_lines")]
+    max_buffered_lines: usize,
+}
+
+#[derive(Debug, Clone, Deserialize)]
+#[serde(rename_all = "camelCase")]
+struct ExportedPath {
+    path: String,
+    /// Milliseconds between values written for the path
+    #[serde(default = "default_period")]
+    period: u32,
+}
+
+fn default_port() -> u16 { 8086 }
+fn default_period() -> u32 { 1000 }
+fn default_batch_size() -> usize { 500 }
+fn default_flush_interval() -> f64 { 10.0 }
+fn default_max_buffered_lines() -> usize { 500000 }
+
+fn default_paths() -> Vec<ExportedPath> {
+    [
+        "navigation.position",
+        "navigation.speedOverGround",
+        "navigation.courseOverGroundTrue",
+        "environment.wind.speedApparent",
+        "environment.wind.angleApparent",
+        "environment.depth.belowTransducer",
+        "electrical.batteries.*.voltage",
+    ]
+    .iter()
+    .map(|path| ExportedPath { path: path.to_string(), period: default_period() })
+    .collect()
+}
+
+impl Default for PluginConfig {
+    fn default() -> Self {
+        PluginConfig {
+            host: String::new(),
+            port: default_port(),
+            org: String::new(),
+            bucket: String::new(),
+            token: String::new(),
+            paths: default_paths(),
+            batch_size: default_batch_size(),
+            flush_interval: default_flush_interval(),
+            max_buffered_lines: default_max_buffered_lines(),
+        }
+    }
+}
+
+/// Directory in the VFS holding batches that could not be written yet
+const SPOOL_DIR: &str = "/data/spool";
+/// Longest wait between retries while the database is unreachable
+const MAX_RETRY_DELAY_MS: f64 = 300000.0;
+/// How long connecting may take before the attempt is given up
+const CONNECT_TIMEOUT_MS: f64 = 10000.0;
+/// How long a write may take before the connection is given up
+const REQUEST_TIMEOUT_MS: f64 = 30000.0;
+
+/// A batch written to the spool directory, named by its sequence number
+#[derive(Debug)]
+struct SpoolFile {
+    seq: u64,
+    lines: usize,
+}
+
+#[derive(Debug)]
+enum Batch {
+    /// Lines collected in memory, not yet on disk
+    Live(Vec<String>),
+    /// The oldest file in the spool
+    Spooled { seq: u64, lines: usize },
+}
+
+impl Batch {
+    fn lines(&self) -> usize {
+        match self {
+            Batch::Live(lines) => lines.len(),
+            Batch::Spooled { lines, .. } => *lines,
+        }
+    }
+}
+
+#[derive(Debug)]
+struct Request {
+    batch: Batch,
+    body: String,
+    started_ms: f64,
+    sent: bool,
+}
+
+#[derive(Debug, Default)]
+struct PluginState {
+    config: PluginConfig,
+    is_running: bool,
+    /// Lines received since the last flush
+    batch: Vec<String>,
+    last_flush_ms: f64,
+    spool: VecDeque<SpoolFile>,
+    next_seq: u64,
+    socket: Option<i32>,
+    /// Bytes of the response to the current request received so far
+    received: Vec<u8>,
+    request: Option<Request>,
+    retry_at_ms: f64,
+    retry_delay_ms: f64,
+    written: u64,
+    dropped: u64,
+}
+
+impl PluginState {
+    fn spooled_lines(&self) -> usize {
+        self.spool.iter().map(|f| f.lines).sum()
+    }
+}
+
+// =============================================================================
+// Line protocol
+// =============================================================================
+
+/// Escape a measurement name, tag key or tag value
+fn escape_key(value: &str) -> String {
+    let mut escaped = String::with_capacity(value.len());
+    for c in value.chars() {
+        if c == ',' || c == '=' || c == ' ' {
+            escaped.push('\\');
+        }
+        escaped.push(c);
+    }
+    escaped
+}
+
+/// Format a field value, or None for values line protocol cannot store
+fn field_value(value: &serde_json::Value) -> Option<String> {
+    match value {
+        serde_json::Value::Number(n) => {
+            let f = n.as_f64()?;
+            // Without an i suffix every number is a float, so a field
+            // never changes type between whole and fractional values
+            if f.is_finite() { Some(f.to_string()) } else { None }
+        }
+        serde_json::Value::Bool(b) => Some(b.to_string()),
+        serde_json::Value::String(s) => {
+            Some(format!("\"{}\"", s.replace('\\', "\\\\").replace('"', "\\\"")))
+        }
+        _ => None,
+    }
+}
+
+/// Build the line for one path value, or None if it has no storable fields
+fn line(path: &str, context: &str, source: &str, value: &serde_json::Value, ts_ms: i64) -> Option<String> {
+    let fields: Vec<String> = match value {
+        serde_json::Value::Object(members) => members
+            .iter()
+            .filter_map(|(key, member)| {
+                field_value(member).map(|v| format!("{}={}", escape_key(key), v))
+            })
+            .collect(),
+        _ => field_value(value).map(|v| vec![format!("value={}", v)]).unwrap_or_default(),
+    };
+    if fields.is_empty() {
+        return None;
+    }
+    Some(format!(
+        "{},context={},source={} {} {}",
+        escape_key(path),
+        escape_key(context),
+        escape_key(source),
+        fields.join(","),
+        ts_ms
+    ))
+}
+
+/// Parse a delta timestamp such as 2024-01-15T12:30:00.000Z into epoch ms
+fn parse_timestamp(timestamp: &str) -> Option<i64> {
+    let b = timestamp.as_bytes();
+    if b.len() < 20 || b[4] != b'-' || b[7] != b'-' || b[10] != b'T' || !timestamp.ends_with('Z') {
+        return None;
+    }
+    let num = |range: std::ops::Range<usize>| timestamp.get(range)?.parse::<i64>().ok();
+    let (year, month, day) = (num(0..4)?, num(5..7)?, num(8..10)?);
+    let (hour, minute, second) = (num(11..13)?, num(14..16)?, num(17..19)?);
+    let mut millis = 0;
+    if b[19] == b'.' {
+        let fraction = &timestamp[20..timestamp.len() - 1];
+        let digits: String = fraction.chars().chain("000".chars()).take(3).collect();
+        millis = digits.parse::<i64>().ok()?;
+    }
+
+    // Days since 1970-01-01 from the civil date (Howard Hinnant's algorithm)
+    let y = if month <= 2 { year - 1 } else { year };
+    let era = (if y >= 0 { y } else { y - 399 }) / 400;
+    let yoe = y - era * 400;
+    let mp = (month + 9) % 12;
+    let doy = (153 * mp + 2) / 5 + day - 1;
+    let doe = yoe * 365 + yoe / 4 - yoe / 100 + doy;
+    let days = era * 146097 + doe - 719468;
+
+    Some(((days * 24 + hour) * 60 + minute) * 60000 + second * 1000 + millis)
+}
+
+/// Percent-encode a query parameter value
+fn query_encode(value: &str) -> String {
+    let mut encoded = String::new();
+    for byte in value.bytes() {
+        match byte {
+            b'A'..=b'Z' | b'a'..=b'z' | b'0'..=b'9' | b'-' | b'_' | b'.' | b'~' => {
+                encoded.push(byte as char)
+            }
+            _ => encoded.push_str(&format!("%{:02X}", byte)),
+        }
+    }
+    encoded
+}
+
+// =============================================================================
+// Spool - batches kept in the VFS while the database is unreachable
+// =============================================================================
+
+fn spool_path(seq: u64) -> String {
+    format!("{}/{:010}.lp", SPOOL_DIR, seq)
+}
+
+/// Find the batches left over from earlier runs, oldest first
+fn load_spool() -> VecDeque<SpoolFile> {
+    let mut files: Vec<SpoolFile> = Vec::new();
+    if let Ok(entries) = fs::read_dir(SPOOL_DIR) {
+        for entry in entries.flatten() {
+            let name = entry.file_name().to_string_lossy().to_string();
+            let seq = match name.strip_suffix(".lp").and_then(|s| s.parse::<u64>().ok()) {
+                Some(seq) => seq,
+                None => continue,
+            };
+            let lines = fs::read_to_string(entry.path())
+                .map(|contents| contents.lines().count())
+                .unwrap_or(0);
+            files.push(SpoolFile { seq, lines });
+        }
+    }
+    files.sort_by_key(|f| f.seq);
+    files.into()
+}
+
+/// Write lines to a new spool file, dropping the oldest files over the limit
+fn spool_lines(s: &mut PluginState, lines: Vec<String>) {
+    if lines.is_empty() {
+        return;
+    }
+    let seq = s.next_seq;
+    let mut contents = lines.join("\n");
+    contents.push('\n');
+    if let Err(e) = fs::write(spool_path(seq), contents) {
+        s.dropped += lines.len() as u64;
+        set_error(&format!("Could not buffer {} line(s): {}", lines.len(), e));
+        return;
+    }
+    s.next_seq += 1;
+    s.spool.push_back(SpoolFile { seq, lines: lines.len() });
+
+    while s.spool.len() > 1 && s.spooled_lines() > s.config.max_buffered_lines {
+        // Never remove the file a request is sending
+        let sending = match &s.request {
+            Some(Request { batch: Batch::Spooled { seq, .. }, .. }) => Some(*seq),
+            _ => None,
+        };
+        let index = if sending == Some(s.spool[0].seq) { 1 } else { 0 };
+        if let Some(oldest) = s.spool.remove(index) {
+            let _ = fs::remove_file(spool_path(oldest.seq));
+            s.dropped += oldest.lines as u64;
+            debug(&format!("Buffer full, dropped {} oldest line(s)", oldest.lines));
+        }
+    }
+}
+
+// =============================================================================
+// Memory Allocation for string passing
+// =============================================================================
+
+/// Allocate memory for string passing from host
+#[no_mangle]
+pub extern "C" fn allocate(size: usize) -> *mut u8 {
+    let mut buf = Vec::with_capacity(size);
+    let ptr = buf.as_mut_ptr();
+    std::mem::forget(buf);
+    ptr
+}
+
+/// Deallocate memory
+#[no_mangle]
+pub extern "C" fn deallocate(ptr: *mut u8, size: usize) {
+    unsafe {
+        let _ = Vec::from_raw_parts(ptr, 0, size);
+    }
+}
+
+// =============================================================================
+// Plugin Exports - Core plugin interface
+// =============================================================================
+
+static PLUGIN_ID: &str = "influxdb-rust";
+static PLUGIN_NAME: &str = "InfluxDB Exporter (Rust)";
+static PLUGIN_SCHEMA: &str = r#"{
+    "type": "object",
+    "title": "InfluxDB Exporter Configuration",
+    "required": ["host", "org", "bucket"],
+    "properties": {
+        "host": {
+            "type": "string",
+            "title": "InfluxDB Host",
+            "description": "Host name or IP address of the InfluxDB server. Plain HTTP only."
+        },
+        "port": {
+            "type": "number",
+            "title": "Port",
+            "default": 8086
+        },
+        "org": {
+            "type": "string",
+            "title": "Organization"
+        },
+        "bucket": {
+            "type": "string",
+            "title": "Bucket"
+        },
+        "token": {
+            "type": "string",
+            "title": "API Token",
+            "description": "Token with write access to the bucket"
+        },
+        "paths": {
+            "type": "array",
+            "title": "Exported Paths",
+            "default": [
+                { "path": "navigation.position", "period": 1000 },
+                { "path": "navigation.speedOverGround", "period": 1000 },
+                { "path": "navigation.courseOverGroundTrue", "period": 1000 },
+                { "path": "environment.wind.speedApparent", "period": 1000 },
+                { "path": "environment.wind.angleApparent", "period": 1000 },
+                { "path": "environment.depth.belowTransducer", "period": 1000 },
+                { "path": "electrical.batteries.*.voltage", "period": 1000 }
+            ],
+            "items": {
+                "type": "object",
+                "required": ["path"],
+                "properties": {
+                    "path": {
+                        "type": "string",
+                        "title": "Signal K Path",
+                        "description": "May contain * wildcards"
+                    },
+                    "period": {
+                        "type": "number",
+                        "title": "Period (ms)",
+                        "description": "Write at most one value per source in this period",
+                        "default": 1000,
+                        "minimum": 100
+                    }
+                }
+            }
+        },
+        "batchSize": {
+            "type": "number",
+            "title": "Batch Size",
+            "description": "Write as soon as this many lines are collected",
+            "default": 500,
+            "minimum": 1
+        },
+        "flushInterval": {
+            "type": "number",
+            "title": "Flush Interval (seconds)",
+            "description": "Write collected lines at least this often",
+            "default": 10,
+            "minimum": 1
+        },
+        "maxBufferedLines": {
+            "type": "number",
+            "title": "Offline Buffer (lines)",
+            "description": "Lines kept on disk while InfluxDB is unreachable; the oldest are dropped beyond this",
+            "default": 500000,
+            "minimum": 1000
+        }
+    }
+}"#;
+
+/// Return the plugin ID
+#[no_mangle]
+pub extern "C" fn plugin_id(out_ptr: *mut u8, out_max_len: usize) -> i32 {
+    write_string(PLUGIN_ID, out_ptr, out_max_len)
+}
+
+/// Return the plugin name
+#[no_mangle]
+pub extern "C" fn plugin_name(out_ptr: *mut u8, out_max_len: usize) -> i32 {
+    write_string(PLUGIN_NAME, out_ptr, out_max_len)
+}
+
+/// Return the plugin JSON schema
+#[no_mangle]
+pub extern "C" fn plugin_schema(out_ptr: *mut u8, out_max_len: usize) -> i32 {
+    write_string(PLUGIN_SCHEMA, out_ptr, out_max_len)
+}
+
+/// Declare the configured paths as the subscriptions for delta_handler
+#[no_mangle]
+pub extern "C" fn plugin_subscriptions(out_ptr: *mut u8, out_max_len: usize) -> i32 {
+    let subscriptions = STATE.with(|state| {
+        let s = state.borrow();
+        let rows: Vec<serde_json::Value> = s
+            .config
+            .paths
+            .iter()
+            .filter(|p| !p.path.is_empty())
+            .map(|p| serde_json::json!({ "path": p.path, "period": p.period }))
+            .collect();
+        serde_json::Value::Array(rows).to_string()
+    });
+    write_string(&subscriptions, out_ptr, out_max_len)
+}
+
+/// Start the plugin with configuration
+#[no_mangle]
+pub extern "C" fn plugin_start(config_ptr: *const u8, config_len: usize) -> i32 {
+    let config_json = unsafe {
+        let slice = std::slice::from_raw_parts(config_ptr, config_len);
+        String::from_utf8_lossy(slice).to_string()
+    };
+
+    let parsed_config: PluginConfig = match serde_json::from_str(&config_json) {
+        Ok(c) => c,
+        Err(e) => {
+            set_error(&format!("Failed to parse config: {}", e));
+            return 1;
+        }
+    };
+    if parsed_config.host.is_empty() || parsed_config.org.is_empty() || parsed_config.bucket.is_empty() {
+        set_error("InfluxDB host, organization and bucket are required");
+        return 1;
+    }
+
+    if let Err(e) = fs::create_dir_all(SPOOL_DIR) {
+        set_error(&format!("Could not create {}: {}", SPOOL_DIR, e));
+        return 1;
+    }
+    let spool = load_spool();
+    let next_seq = spool.back().map(|f| f.seq + 1).unwrap_or(0);
+    let spooled: usize = spool.iter().map(|f| f.lines).sum();
+
+    debug(&format!(
+        "Exporting {} path(s) to {}:{} bucket {}, {} line(s) buffered",
+        parsed_config.paths.len(),
+        parsed_config.host,
+        parsed_config.port,
+        parsed_config.bucket,
+        spooled
+    ));
+    set_status(&format!("Exporting to {}:{}", parsed_config.host, parsed_config.port));
+
+    STATE.with(|state| {
+        let mut s = state.borrow_mut();
+        *s = PluginState::default();
+        s.config = parsed_config;
+        s.is_running = true;
+        s.spool = spool;
+        s.next_seq = next_seq;
+        s.last_flush_ms = monotonic_ms();
+    });
+
+    0
+}
+
+/// Stop the plugin, keeping unsent lines for the next start
+#[no_mangle]
+pub extern "C" fn plugin_stop() -> i32 {
+    STATE.with(|state| {
+        let mut s = state.borrow_mut();
+        s.is_running = false;
+        if let Some(request) = s.request.take() {
+            if let Batch::Live(lines) = request.batch {
+                spool_lines(&mut s, lines);
+            }
+        }
+        let lines = std::mem::take(&mut s.batch);
+        spool_lines(&mut s, lines);
+        if let Some(socket) = s.socket.take() {
+            unsafe { sk_tcp_close(socket) };
+        }
+    });
+    debug("InfluxDB exporter stopped");
+    set_status("Stopped");
+
+    0
+}
+
+// =============================================================================
+// Delta Handler - turn subscribed values into line protocol
+// =============================================================================
+
+#[derive(Deserialize)]
+struct Delta {
+    context: Option<String>,
+    #[serde(default)]
+    updates: Vec<DeltaUpdate>,
+}
+
+#[derive(Deserialize)]
+struct DeltaUpdate {
+    #[serde(rename = "$source")]
+    source_ref: Option<String>,
+    timestamp: Option<String>,
+    #[serde(default)]
+    values: Vec<PathValue>,
+}
+
+#[derive(Deserialize)]
+struct PathValue {
+    path: String,
+    value: serde_json::Value,
+}
+
+/// Receive the subscribed deltas from the server
+#[no_mangle]
+pub extern "C" fn delta_handler(delta_ptr: *const u8, delta_len: usize) {
+    let delta_json = unsafe {
+        let slice = std::slice::from_raw_parts(delta_ptr, delta_len);
+        String::from_utf8_lossy(slice).to_string()
+    };
+    let delta: Delta = match serde_json::from_str(&delta_json) {
+        Ok(d) => d,
+        Err(_) => return,
+    };
+    let context = delta.context.as_deref().unwrap_or("vessels.self");
+
+    STATE.with(|state| {
+        let mut s = state.borrow_mut();
+        if !s.is_running {
+            return;
+        }
+        for update in &delta.updates {
+            let source = update.source_ref.as_deref().unwrap_or("unknown");
+            let ts_ms = update
+                .timestamp
+                .as_deref()
+                .and_then(parse_timestamp)
+                .unwrap_or_else(|| now_ms() as i64);
+            for pv in &update.values {
+                if let Some(line) = line(&pv.path, context, source, &pv.value, ts_ms) {
+                    s.batch.push(line);
+                }
+            }
+        }
+    });
+}
+
+// =============================================================================
+// Poll - flush batches and drive the HTTP write requests
+// =============================================================================
+
+/// Called by the server about once per second
+#[no_mangle]
+pub extern "C" fn poll() -> i32 {
+    let now = monotonic_ms();
+
+    STATE.with(|state| {
+        let mut s = state.borrow_mut();
+        if !s.is_running {
+            return;
+        }
+
+        if s.request.is_some() {
+            drive_request(&mut s, now);
+        }
+
+        let due = now - s.last_flush_ms >= s.config.flush_interval * 1000.0
+            || s.batch.len() >= s.config.batch_size.max(1);
+        if due && !s.batch.is_empty() {
+            let offline = now < s.retry_at_ms;
+            if offline || !s.spool.is_empty() {
+                // Keep the order: older spooled lines are sent first
+                s.last_flush_ms = now;
+                let lines = std::mem::take(&mut s.batch);
+                spool_lines(&mut s, lines);
+            } else if s.request.is_none() {
+                s.last_flush_ms = now;
+                let lines = std::mem::take(&mut s.batch);
+                start_request(&mut s, Batch::Live(lines), now);
+            }
+        } else if due {
+            s.last_flush_ms = now;
+        }
+
+        // Drain the spool one batch at a time while the database is up
+        if s.request.is_none() && now >= s.retry_at_ms {
+            if let Some(oldest) = s.spool.front() {
+                let batch = Batch::Spooled { seq: oldest.seq, lines: oldest.lines };
+                start_request(&mut s, batch, now);
+            }
+        }
+    });
+
+    0
+}
+
+fn start_request(s: &mut PluginState, batch: Batch, now: f64) {
+    let body = match &batch {
+        Batch::Live(lines) => {
+            let mut body = lines.join("\n");
+            body.push('\n');
+            body
+        }
+        Batch::Spooled { seq, .. } => match fs::read_to_string(spool_path(*seq)) {
+            Ok(body) => body,
+            Err(e) => {
+                // Unreadable, so it can never be sent
+                debug(&format!("Removing spool file {}: {}", seq, e));
+                let _ = fs::remove_file(spool_path(*seq));
+                s.spool.pop_front();
+                return;
+            }
+        },
+    };
+
+    // Reuse the keep-alive connection unless the server has closed it
+    if let Some(socket) = s.socket {
+        if unsafe { sk_tcp_connected(socket) } != 1 {
+            unsafe { sk_tcp_close(socket) };
+            s.socket = None;
+        }
+    }
+    if s.socket.is_none() {
+        s.socket = tcp_open(&s.config.host, s.config.port);
+    }
+    s.request = Some(Request { batch, body, started_ms: now, sent: false });
+    s.received.clear();
+    drive_request(s, now);
+}
+
+fn drive_request(s: &mut PluginState, now: f64) {
+    let socket = match s.socket {
+        Some(socket) => socket,
+        None => return fail(s, now, "could not create TCP socket"),
+    };
+    let (started_ms, sent) = match &s.request {
+        Some(request) => (request.started_ms, request.sent),
+        None => return,
+    };
+    let connected = unsafe { sk_tcp_connected(socket) };
+
+    if !sent {
+        if connected == 1 {
+            let http = http_request(&s.config, &s.request.as_ref().unwrap().body);
+            if unsafe { sk_tcp_send(socket, http.as_ptr(), http.len()) } < 0 {
+                return fail(s, now, "send failed");
+            }
+            if let Some(request) = s.request.as_mut() {
+                request.sent = true;
+            }
+        } else if connected < 0 || now - started_ms > CONNECT_TIMEOUT_MS {
+            return fail(s, now, "could not connect");
+        }
+        return;
+    }
+
+    let mut buf = [0u8; 4096];
+    loop {
+        let len = unsafe { sk_tcp_recv_raw(socket, buf.as_mut_ptr(), buf.len()) };
+        if len <= 0 {
+            break;
+        }
+        s.received.extend_from_slice(&buf[..len as usize]);
+    }
+    match parse_response(&s.received) {
+        Some((status, message, keep_alive)) => {
+            s.received.clear();
+            if !keep_alive {
+                unsafe { sk_tcp_close(socket) };
+                s.socket = None;
+            }
+            complete(s, now, status, &message);
+        }
+        None if connected != 1 => fail(s, now, "connection closed before the response"),
+        None if now - started_ms > REQUEST_TIMEOUT_MS => fail(s, now, "no response"),
+        None => {}
+    }
+}
+
+fn http_request(config: &PluginConfig, body: &str) -> String {
+    let mut http = format!(
+        "POST /api/v2/write?org={}&bucket={}&precision=ms HTTP/1.1\r\n\
+         Host: {}:{}\r\n\
+         Content-Type: text/plain; charset=utf-8\r\n\
+         Content-Length: {}\r\n",
+        query_encode(&config.org),
+        query_encode(&config.bucket),
+        config.host,
+        config.port,
+        body.len()
+    );
+    if !config.token.is_empty() {
+        http.push_str(&format!("Authorization: Token {}\r\n", config.token));
+    }
+    http.push_str("\r\n");
+    http.push_str(body);
+    http
+}
+
+/// Parse a complete HTTP response into its status, body and whether the
+/// connection can be reused; None until the whole response has arrived
+fn parse_response(received: &[u8]) -> Option<(u16, String, bool)> {
+    let header_end = received.windows(4).position(|w| w == b"\r\n\r\n")?;
+    let head = String::from_utf8_lossy(&received[..header_end]).to_string();
+    let mut lines = head.split("\r\n");
+    let status = lines.next()?.split_whitespace().nth(1)?.parse::<u16>().ok()?;
+
+    let mut content_length: Option<usize> = None;
+    let mut keep_alive = true;
+    for header in lines {
+        let (name, value) = match header.split_once(':') {
+            Some((name, value)) => (name.trim().to_ascii_lowercase(), value.trim()),
+            None => continue,
+        };
+        match name.as_str() {
+            "content-length" => content_length = value.parse().ok(),
+            "connection" if value.eq_ignore_ascii_case("close") => keep_alive = false,
+            _ => {}
+        }
+    }
+
+    // Successful writes answer 204, which never has a body
+    if status == 204 {
+        content_length = Some(0);
+    }
+    let body = &received[header_end + 4..];
+    match content_length {
+        Some(length) if body.len() < length => None,
+        Some(length) => Some((status, String::from_utf8_lossy(&body[..length]).to_string(), keep_alive)),
+        // Without a length the end of the body is unknown, so close
+        None => Some((status, String::from_utf8_lossy(body).to_string(), false)),
+    }
+}
+
+/// Finish the current request according to the response status
+fn complete(s: &mut PluginState, now: f64, status: u16, message: &str) {
+    let request = match s.request.take() {
+        Some(request) => request,
+        None => return,
+    };
+    let lines = request.batch.lines();
+    match status {
+        200..=299 => {
+            s.written += lines as u64;
+            s.retry_at_ms = 0.0;
+            s.retry_delay_ms = 0.0;
+            finish(s, request.batch);
+            report(s);
+        }
+        // The database rejected the data itself; retrying would not help
+        400 | 413 | 422 => {
+            s.dropped += lines as u64;
+            set_error(&format!("InfluxDB rejected {} line(s): {} {}", lines, status, message.trim()));
+            finish(s, request.batch);
+        }
+        // Authorization, a missing bucket or an overloaded server
+        _ => {
+            s.request = Some(request);
+            fail(s, now, &format!("HTTP {} {}", status, message.trim()));
+        }
+    }
+}
+
+/// Forget a batch that has been written or rejected
+fn finish(s: &mut PluginState, batch: Batch) {
+    if let Batch::Spooled { seq, .. } = batch {
+        let _ = fs::remove_file(spool_path(seq));
+        s.spool.retain(|f| f.seq != seq);
+    }
+}
+
+/// Give up on the current request for now and retry it later
+fn fail(s: &mut PluginState, now: f64, reason: &str) {
+    if let Some(socket) = s.socket.take() {
+        unsafe { sk_tcp_close(socket) };
+    }
+    s.received.clear();
+    if let Some(request) = s.request.take() {
+        if let Batch::Live(lines) = request.batch {
+            spool_lines(s, lines);
+        }
+    }
+    s.retry_delay_ms = (s.retry_delay_ms * 2.0)
+        .max(s.config.flush_interval * 1000.0)
+        .min(MAX_RETRY_DELAY_MS);
+    s.retry_at_ms = now + s.retry_delay_ms;
+    let message = format!(
+        "Cannot write to {}:{}: {}, {} line(s) buffered, retrying in {:.0} s",
+        s.config.host,
+        s.config.port,
+        reason,
+        s.spooled_lines(),
+        s.retry_delay_ms / 1000.0
+    );
+    debug(&message);
+    set_error(&message);
+}
+
+fn report(s: &PluginState) {
+    let spooled = s.spooled_lines();
+    let mut status = format!("Exporting to {}:{}, {} line(s) written", s.config.host, s.config.port, s.written);
+    if spooled > 0 {
+        status.push_str(&format!(", {} buffered", spooled));
+    }
+    if s.dropped > 0 {
+        status.push_str(&format!(", {} dropped", s.dropped));
+    }
+    set_status(&status);
+}
+
+// =============================================================================
+// Helper Functions
+// =============================================================================
+
+fn write_string(s: &str, ptr: *mut u8, max_len: usize) -> i32 {
+    let bytes = s.as_bytes();
+    let len = bytes.len().min(max_len);
+
+    unsafe {
+        std::ptr::copy_nonoverlapping(bytes.as_ptr(), ptr, len);
+    }
+
+    len as i32
+}
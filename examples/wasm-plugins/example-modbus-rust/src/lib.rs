@@ -0,0 +1,787 @@
+//! Modbus TCP Client WASM Plugin for Signal K
+//!
+//! A Rust implementation demonstrating:
+//! - Talking to a device over a raw TCP socket (rawSockets capability)
+//! - A binary request/response protocol driven from the poll export
+//! - Reconnecting after the device or network goes away
+//! - A register map configured through the plugin schema
+//!
+//! The plugin polls holding and input registers of a Modbus TCP device,
+//! such as a shore power meter or a genset controller, and publishes each
+//! register as the Signal K path given in its register map entry.
+
+use std::cell::RefCell;
+use serde::Deserialize;
+
+// =============================================================================
+// FFI Imports - These must match what the SignalK WASM runtime provides in "env"
+// =============================================================================
+
+#[link(wasm_import_module = "env")]
+extern "C" {
+    fn sk_debug(ptr: *const u8, len: usize);
+    fn sk_set_status(ptr: *const u8, len: usize);
+    fn sk_set_error(ptr: *const u8, len: usize);
+    fn sk_handle_message(ptr: *const u8, len: usize, version: i32);
+    fn sk_monotonic_ms() -> f64;
+    fn sk_tcp_create() -> i32;
+    fn sk_tcp_connect(socket_id: i32, addr_ptr: *const u8, addr_len: usize, port: u16) -> i32;
+    fn sk_tcp_connected(socket_id: i32) -> i32;
+    fn sk_tcp_set_line_buffering(socket_id: i32, enabled: i32) -> i32;
+    fn sk_tcp_send(socket_id: i32, data_ptr: *const u8, data_len: usize) -> i32;
+    fn sk_tcp_recv_raw(socket_id: i32, buf_ptr: *mut u8, buf_max_len: usize) -> i32;
+    fn sk_tcp_close(socket_id: i32);
+}
+
+// =============================================================================
+// Helper wrappers for FFI functions
+// =============================================================================
+
+fn debug(msg: &str) {
+    unsafe { sk_debug(msg.as_ptr(), msg.len()); }
+}
+
+fn set_status(msg: &str) {
+    unsafe { sk_set_status(msg.as_ptr(), msg.len()); }
+}
+
+fn set_error(msg: &str) {
+    unsafe { sk_set_error(msg.as_ptr(), msg.len()); }
+}
+
+fn handle_message(msg: &str) {
+    unsafe { sk_handle_message(msg.as_ptr(), msg.len(), 1); }
+}
+
+fn monotonic_ms() -> f64 {
+    unsafe { sk_monotonic_ms() }
+}
+
+/// Create a TCP socket in raw mode and start connecting it
+fn tcp_open(host: &str, port: u16) -> Option<i32> {
+    let socket = unsafe { sk_tcp_create() };
+    if socket < 0 {
+        return None;
+    }
+    // Modbus is binary, so turn off the default line buffering
+    unsafe { sk_tcp_set_line_buffering(socket, 0) };
+    if unsafe { sk_tcp_connect(socket, host.as_ptr(), host.len(), port) } < 0 {
+        unsafe { sk_tcp_close(socket) };
+        return None;
+    }
+    Some(socket)
+}
+
+// =============================================================================
+// Plugin State
+// =============================================================================
+
+thread_local! {
+    static STATE: RefCell<PluginState> = RefCell::new(PluginState::default());
+}
+
+#[derive(Debug, Clone, Deserialize)]
+#[serde(rename_all = "camelCase")]
+struct PluginConfig {
+    #[serde(default)]
+    host: String,
+    #[serde(default = "default_port")]
+    port: u16,
+    #[serde(default = "default_unit_id")]
+    unit_id: u8,
+    #[serde(default = "default_poll_interval")]
+    poll_interval: f64,
+    #[serde(default = "default_timeout")]
+    timeout: f64,
+    #[serde(default = "default_registers")]
+    registers: Vec<Register>,
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, PartialOrd, Ord, Deserialize)]
+#[serde(rename_all = "camelCase")]
+enum Table {
+    /// Function code 3, read/write registers
+    Holding,
+    /// Function code 4, read-only registers
+    Input,
+}
+
+impl Table {
+    fn function_code(&self) -> u8 {
+        match self {
+            Table::Holding => 3,
+            Table::Input => 4,
+        }
+    }
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Deserialize)]
+#[serde(rename_all = "camelCase")]
+enum RegisterType {
+    Uint16,
+    Int16,
+    Uint32,
+    Int32,
+    Float32,
+}
+
+impl RegisterType {
+    fn words(&self) -> u16 {
+        match self {
+            RegisterType::Uint16 | RegisterType::Int16 => 1,
+            _ => 2,
+        }
+    }
+}
+
+#[derive(Debug, Clone, Deserialize)]
+#[serde(rename_all = "camelCase")]
+struct Register {
+    path: String,
+    /// Zero-based register address as sent on the wire
+    address: u16,
+    #[serde(default = "default_table")]
+    table: Table,
+    #[serde(rename = "type", default = "default_register_type")]
+    register_type: RegisterType,
+    /// 32-bit values with the low word in the first register
+    #[serde(default)]
+    swap_words: bool,
+    #[serde(default = "default_scale")]
+    scale: f64,
+    #[serde(default)]
+    offset: f64,
+}
+
+fn default_port() -> u16 { 502 }
+fn default_unit_id() -> u8 { 1 }
+fn default_poll_interval() -> f64 { 5.0 }
+fn default_timeout() -> f64 { 3.0 }
+fn default_table() -> Table { Table::Holding }
+fn default_register_type() -> RegisterType { RegisterType::Uint16 }
+fn default_scale() -> f64 { 1.0 }
+
+fn default_registers() -> Vec<Register> {
+    let float = |path: &str, address: u16| Register {
+        path: path.to_string(),
+        address,
+        table: Table::Input,
+        register_type: RegisterType::Float32,
+        swap_words: false,
+        scale: 1.0,
+        offset: 0.0,
+    };
+    vec![
+        float("electrical.ac.shore.phase.A.lineNeutralVoltage", 0),
+        float("electrical.ac.shore.phase.A.current", 6),
+        float("electrical.ac.shore.phase.A.realPower", 12),
+        float("electrical.ac.shore.phase.A.frequency", 70),
+    ]
+}
+
+impl Default for PluginConfig {
+    fn default() -> Self {
+        PluginConfig {
+            host: String::new(),
+            port: default_port(),
+            unit_id: default_unit_id(),
+            poll_interval: default_poll_interval(),
+            timeout: default_timeout(),
+            registers: default_registers(),
+        }
+    }
+}
+
+/// Most registers a single read request may ask for
+const MAX_READ_REGISTERS: u16 = 125;
+
+/// Contiguous registers of one table fetched with a single read request
+#[derive(Debug)]
+struct Block {
+    table: Table,
+    start: u16,
+    count: u16,
+    /// Indexes into the register map
+    registers: Vec<usize>,
+}
+
+#[derive(Debug)]
+enum Connection {
+    /// No socket; connect again once the retry time has passed
+    Closed { retry_ms: f64 },
+    Connecting { socket: i32, since_ms: f64 },
+    Connected { socket: i32 },
+}
+
+impl Default for Connection {
+    fn default() -> Self {
+        Connection::Closed { retry_ms: 0.0 }
+    }
+}
+
+#[derive(Debug)]
+struct Pending {
+    transaction: u16,
+    block: usize,
+    sent_ms: f64,
+}
+
+#[derive(Debug, Default)]
+struct PluginState {
+    config: PluginConfig,
+    is_running: bool,
+    blocks: Vec<Block>,
+    connection: Connection,
+    /// Bytes received that do not form a complete response yet
+    received: Vec<u8>,
+    transaction: u16,
+    pending: Option<Pending>,
+    /// Next block to read in the current cycle, None between cycles
+    next_block: Option<usize>,
+    cycle_started_ms: f64,
+    values: Vec<(String, f64)>,
+    cycles: u64,
+    errors: u64,
+}
+
+// =============================================================================
+// Modbus TCP framing
+// =============================================================================
+
+/// Group the register map into as few read requests as possible
+fn plan_blocks(registers: &[Register]) -> Vec<Block> {
+    let mut order: Vec<usize> = (0..registers.len()).collect();
+    order.sort_by_key(|&i| (registers[i].table, registers[i].address));
+
+    let mut blocks: Vec<Block> = Vec::new();
+    for i in order {
+        let register = &registers[i];
+        let end = register.address as u32 + register.register_type.words() as u32;
+        if let Some(block) = blocks.last_mut() {
+            if block.table == register.table
+                && end - block.start as u32 <= MAX_READ_REGISTERS as u32
+            {
+                block.count = block.count.max((end - block.start as u32) as u16);
+                block.registers.push(i);
+                continue;
+            }
+        }
+        blocks.push(Block {
+            table: register.table,
+            start: register.address,
+            count: register.register_type.words(),
+            registers: vec![i],
+        });
+    }
+    blocks
+}
+
+/// Build a read request: MBAP header followed by the PDU
+fn read_request(transaction: u16, unit_id: u8, block: &Block) -> Vec<u8> {
+    let mut frame = Vec::with_capacity(12);
+    frame.extend_from_slice(&transaction.to_be_bytes());
+    frame.extend_from_slice(&0u16.to_be_bytes()); // Protocol id, always 0
+    frame.extend_from_slice(&6u16.to_be_bytes()); // Bytes that follow
+    frame.push(unit_id);
+    frame.push(block.table.function_code());
+    frame.extend_from_slice(&block.start.to_be_bytes());
+    frame.extend_from_slice(&block.count.to_be_bytes());
+    frame
+}
+
+enum Response {
+    /// Register values, one word per register
+    Registers(Vec<u16>),
+    /// The device rejected the request with an exception code
+    Exception(u8),
+}
+
+/// Take the next complete response off the receive buffer
+/// Returns the transaction id and response, or Err if the stream is garbled
+fn take_response(received: &mut Vec<u8>) -> Result<Option<(u16, Response)>, String> {
+    if received.len() < 7 {
+        return Ok(None);
+    }
+    let length = u16::from_be_bytes([received[4], received[5]]) as usize;
+    if received[2] != 0 || received[3] != 0 || !(3..=254).contains(&length) {
+        return Err("invalid Modbus TCP header".to_string());
+    }
+    if received.len() < 6 + length {
+        return Ok(None);
+    }
+    let frame: Vec<u8> = received.drain(..6 + length).collect();
+    let transaction = u16::from_be_bytes([frame[0], frame[1]]);
+    let function = frame[7];
+    if function & 0x80 != 0 {
+        return Ok(Some((transaction, Response::Exception(frame[8]))));
+    }
+    let byte_count = frame[8] as usize;
+    if byte_count % 2 != 0 || frame.len() < 9 + byte_count {
+        return Err("truncated Modbus response".to_string());
+    }
+    let words = frame[9..9 + byte_count]
+        .chunks(2)
+        .map(|pair| u16::from_be_bytes([pair[0], pair[1]]))
+        .collect();
+    Ok(Some((transaction, Response::Registers(words))))
+}
+
+fn exception_name(code: u8) -> &'static str {
+    match code {
+        1 => "illegal function",
+        2 => "illegal data address",
+        3 => "illegal data value",
+        4 => "device failure",
+        6 => "device busy",
+        10 => "gateway path unavailable",
+        11 => "gateway target did not respond",
+        _ => "exception",
+    }
+}
+
+/// Decode one register map entry from the words of its block
+fn decode(register: &Register, words: &[u16]) -> Option<f64> {
+    let (first, second) = match register.register_type.words() {
+        1 => (*words.first()?, 0),
+        _ => (*words.first()?, *words.get(1)?),
+    };
+    let (high, low) = if register.swap_words { (second, first) } else { (first, second) };
+    let combined = ((high as u32) << 16) | low as u32;
+    let raw = match register.register_type {
+        RegisterType::Uint16 => first as f64,
+        RegisterType::Int16 => first as i16 as f64,
+        RegisterType::Uint32 => combined as f64,
+        RegisterType::Int32 => combined as i32 as f64,
+        RegisterType::Float32 => f32::from_bits(combined) as f64,
+    };
+    if !raw.is_finite() {
+        return None;
+    }
+    Some(raw * register.scale + register.offset)
+}
+
+// =============================================================================
+// Memory Allocation for string passing
+// =============================================================================
+
+/// Allocate memory for string passing from host
+#[no_mangle]
+pub extern "C" fn allocate(size: usize) -> *mut u8 {
+    let mut buf = Vec::with_capacity(size);
+    let ptr = buf.as_mut_ptr();
+    std::mem::forget(buf);
+    ptr
+}
+
+/// Deallocate memory
+#[no_mangle]
+pub extern "C" fn deallocate(ptr: *mut u8, size: usize) {
+    unsafe {
+        let _ = Vec::from_raw_parts(ptr, 0, size);
+    }
+}
+
+// =============================================================================
+// Plugin Exports - Core plugin interface
+// =============================================================================
+
+static PLUGIN_ID: &str = "modbus-rust";
+static PLUGIN_NAME: &str = "Modbus TCP Client (Rust)";
+static PLUGIN_SCHEMA: &str = r#"{
+    "type": "object",
+    "title": "Modbus TCP Client Configuration",
+    "required": ["host"],
+    "properties": {
+        "host": {
+            "type": "string",
+            "title": "Device Host",
+            "description": "Host name or IP address of the Modbus TCP device or gateway"
+        },
+        "port": {
+            "type": "number",
+            "title": "Port",
+            "default": 502
+        },
+        "unitId": {
+            "type": "number",
+            "title": "Unit ID",
+            "description": "Modbus unit (slave) id; gateways use it to address the device behind them",
+            "default": 1,
+            "minimum": 0,
+            "maximum": 255
+        },
+        "pollInterval": {
+            "type": "number",
+            "title": "Poll Interval (seconds)",
+            "default": 5,
+            "minimum": 1
+        },
+        "timeout": {
+            "type": "number",
+            "title": "Response Timeout (seconds)",
+            "default": 3,
+            "minimum": 1
+        },
+        "registers": {
+            "type": "array",
+            "title": "Register Map",
+            "default": [
+                { "path": "electrical.ac.shore.phase.A.lineNeutralVoltage", "address": 0, "table": "input", "type": "float32" },
+                { "path": "electrical.ac.shore.phase.A.current", "address": 6, "table": "input", "type": "float32" },
+                { "path": "electrical.ac.shore.phase.A.realPower", "address": 12, "table": "input", "type": "float32" },
+                { "path": "electrical.ac.shore.phase.A.frequency", "address": 70, "table": "input", "type": "float32" }
+            ],
+            "items": {
+                "type": "object",
+                "required": ["path", "address"],
+                "properties": {
+                    "path": {
+                        "type": "string",
+                        "title": "Signal K Path"
+                    },
+                    "address": {
+                        "type": "number",
+                        "title": "Register Address",
+                        "description": "Zero-based address; register 30007 or 40007 in device manuals is address 6",
+                        "minimum": 0,
+                        "maximum": 65535
+                    },
+                    "table": {
+                        "type": "string",
+                        "title": "Register Table",
+                        "enum": ["holding", "input"],
+                        "default": "holding"
+                    },
+                    "type": {
+                        "type": "string",
+                        "title": "Data Type",
+                        "enum": ["uint16", "int16", "uint32", "int32", "float32"],
+                        "default": "uint16"
+                    },
+                    "swapWords": {
+                        "type": "boolean",
+                        "title": "Low Word First",
+                        "description": "For 32-bit types, the device sends the low word in the first register",
+                        "default": false
+                    },
+                    "scale": {
+                        "type": "number",
+                        "title": "Scale",
+                        "description": "Multiplier converting the register value to SI units",
+                        "default": 1
+                    },
+                    "offset": {
+                        "type": "number",
+                        "title": "Offset",
+                        "description": "Added after scaling, e.g. 273.15 for a temperature in Celsius",
+                        "default": 0
+                    }
+                }
+            }
+        }
+    }
+}"#;
+
+/// Return the plugin ID
+#[no_mangle]
+pub extern "C" fn plugin_id(out_ptr: *mut u8, out_max_len: usize) -> i32 {
+    write_string(PLUGIN_ID, out_ptr, out_max_len)
+}
+
+/// Return the plugin name
+#[no_mangle]
+pub extern "C" fn plugin_name(out_ptr: *mut u8, out_max_len: usize) -> i32 {
+    write_string(PLUGIN_NAME, out_ptr, out_max_len)
+}
+
+/// Return the plugin JSON schema
+#[no_mangle]
+pub extern "C" fn plugin_schema(out_ptr: *mut u8, out_max_len: usize) -> i32 {
+    write_string(PLUGIN_SCHEMA, out_ptr, out_max_len)
+}
+
+/// Start the plugin with configuration
+#[no_mangle]
+pub extern "C" fn plugin_start(config_ptr: *const u8, config_len: usize) -> i32 {
+    let config_json = unsafe {
+        let slice = std::slice::from_raw_parts(config_ptr, config_len);
+        String::from_utf8_lossy(slice).to_string()
+    };
+
+    let parsed_config: PluginConfig = match serde_json::from_str(&config_json) {
+        Ok(c) => c,
+        Err(e) => {
+            set_error(&format!("Failed to parse config: {}", e));
+            return 1;
+        }
+    };
+    if parsed_config.host.is_empty() {
+        set_error("No device host configured");
+        return 1;
+    }
+
+    let blocks = plan_blocks(&parsed_config.registers);
+    debug(&format!(
+        "Modbus client for {}:{} unit {}: {} register(s) in {} request(s)",
+        parsed_config.host,
+        parsed_config.port,
+        parsed_config.unit_id,
+        parsed_config.registers.len(),
+        blocks.len()
+    ));
+    set_status(&format!("Connecting to {}:{}", parsed_config.host, parsed_config.port));
+
+    STATE.with(|state| {
+        let mut s = state.borrow_mut();
+        *s = PluginState::default();
+        s.config = parsed_config;
+        s.blocks = blocks;
+        s.is_running = true;
+    });
+
+    0
+}
+
+/// Stop the plugin
+#[no_mangle]
+pub extern "C" fn plugin_stop() -> i32 {
+    STATE.with(|state| {
+        let mut s = state.borrow_mut();
+        s.is_running = false;
+        close(&mut s, 0.0);
+    });
+    debug("Modbus client stopped");
+    set_status("Stopped");
+
+    0
+}
+
+// =============================================================================
+// Poll - drive the connection and the request cycle once per second
+// =============================================================================
+
+/// Called by the server about once per second
+#[no_mangle]
+pub extern "C" fn poll() -> i32 {
+    let now = monotonic_ms();
+
+    let values = STATE.with(|state| {
+        let mut s = state.borrow_mut();
+        if !s.is_running {
+            return None;
+        }
+        let socket = match connect(&mut s, now) {
+            Some(socket) => socket,
+            None => return None,
+        };
+        receive(&mut s, socket);
+
+        let completed = match process_responses(&mut s) {
+            Ok(completed) => completed,
+            Err(e) => {
+                fail(&mut s, now, &e);
+                return None;
+            }
+        };
+        if let Some(pending) = &s.pending {
+            if now - pending.sent_ms > s.config.timeout * 1000.0 {
+                let message = format!("No response from unit {}", s.config.unit_id);
+                fail(&mut s, now, &message);
+                return None;
+            }
+        }
+
+        if s.next_block.is_none()
+            && now - s.cycle_started_ms >= s.config.poll_interval * 1000.0
+        {
+            s.next_block = Some(0);
+            s.cycle_started_ms = now;
+            s.values.clear();
+        }
+        if s.pending.is_none() {
+            send_next(&mut s, socket, now);
+        }
+        completed
+    });
+
+    if let Some(values) = values {
+        emit_values(&values);
+    }
+
+    0
+}
+
+/// Keep the socket connected, returning it once it is ready for requests
+fn connect(s: &mut PluginState, now: f64) -> Option<i32> {
+    let retry_ms = now + s.config.poll_interval.max(10.0) * 1000.0;
+    match s.connection {
+        Connection::Closed { retry_ms: at } if now >= at => {
+            match tcp_open(&s.config.host, s.config.port) {
+                Some(socket) => s.connection = Connection::Connecting { socket, since_ms: now },
+                None => {
+                    set_error("Could not create TCP socket");
+                    s.connection = Connection::Closed { retry_ms };
+                }
+            }
+            None
+        }
+        Connection::Closed { .. } => None,
+        Connection::Connecting { socket, since_ms } => match unsafe { sk_tcp_connected(socket) } {
+            1 => {
+                debug(&format!("Connected to {}:{}", s.config.host, s.config.port));
+                set_status(&format!("Connected to {}:{}", s.config.host, s.config.port));
+                s.connection = Connection::Connected { socket };
+                s.cycle_started_ms = f64::NEG_INFINITY;
+                Some(socket)
+            }
+            0 if now - since_ms < s.config.timeout * 1000.0 => None,
+            _ => {
+                unsafe { sk_tcp_close(socket) };
+                set_error(&format!("Could not connect to {}:{}", s.config.host, s.config.port));
+                s.connection = Connection::Closed { retry_ms };
+                None
+            }
+        },
+        // The host drops the socket when the device closes the connection
+        Connection::Connected { socket } => match unsafe { sk_tcp_connected(socket) } {
+            1 => Some(socket),
+            _ => {
+                fail(s, now, "Connection closed by device");
+                None
+            }
+        },
+    }
+}
+
+/// Close the connection and forget any request in flight
+fn close(s: &mut PluginState, retry_ms: f64) {
+    if let Connection::Connecting { socket, .. } | Connection::Connected { socket } = s.connection {
+        unsafe { sk_tcp_close(socket) };
+    }
+    s.connection = Connection::Closed { retry_ms };
+    s.received.clear();
+    s.pending = None;
+    s.next_block = None;
+}
+
+/// Report an error and reconnect, which also resynchronizes the stream
+fn fail(s: &mut PluginState, now: f64, message: &str) {
+    s.errors += 1;
+    debug(message);
+    set_error(&format!("{}:{}: {}", s.config.host, s.config.port, message));
+    close(s, now + s.config.poll_interval * 1000.0);
+}
+
+fn receive(s: &mut PluginState, socket: i32) {
+    let mut buf = [0u8; 1024];
+    loop {
+        let len = unsafe { sk_tcp_recv_raw(socket, buf.as_mut_ptr(), buf.len()) };
+        if len <= 0 {
+            break;
+        }
+        s.received.extend_from_slice(&buf[..len as usize]);
+    }
+}
+
+/// Decode received responses; returns the values once a cycle completes
+fn process_responses(s: &mut PluginState) -> Result<Option<Vec<(String, f64)>>, String> {
+    let mut completed = None;
+    while let Some((transaction, response)) = take_response(&mut s.received)? {
+        let block_index = match &s.pending {
+            Some(pending) if pending.transaction == transaction => pending.block,
+            // A late answer to a request that already timed out
+            _ => continue,
+        };
+        s.pending = None;
+
+        let block = &s.blocks[block_index];
+        match response {
+            Response::Registers(words) if words.len() >= block.count as usize => {
+                for &i in &block.registers {
+                    let register = &s.config.registers[i];
+                    let offset = (register.address - block.start) as usize;
+                    if let Some(value) = decode(register, &words[offset..]) {
+                        s.values.push((register.path.clone(), value));
+                    }
+                }
+            }
+            Response::Registers(_) => {
+                return Err(format!("short response for registers {}+{}", block.start, block.count));
+            }
+            // Skip the block but keep polling the rest of the map
+            Response::Exception(code) => {
+                s.errors += 1;
+                debug(&format!(
+                    "Registers {}+{}: {} ({})",
+                    block.start,
+                    block.count,
+                    exception_name(code),
+                    code
+                ));
+            }
+        }
+
+        if s.next_block == Some(s.blocks.len()) {
+            s.next_block = None;
+            s.cycles += 1;
+            if s.cycles == 1 || s.errors > 0 {
+                set_status(&format!(
+                    "Connected to {}:{}, {} of {} register(s) read",
+                    s.config.host,
+                    s.config.port,
+                    s.values.len(),
+                    s.config.registers.len()
+                ));
+                s.errors = 0;
+            }
+            completed = Some(std::mem::take(&mut s.values));
+        }
+    }
+    Ok(completed)
+}
+
+/// Send the read request for the next block of the cycle, if any
+fn send_next(s: &mut PluginState, socket: i32, now: f64) {
+    let block_index = match s.next_block {
+        Some(i) if i < s.blocks.len() => i,
+        _ => return,
+    };
+    s.transaction = s.transaction.wrapping_add(1);
+    let request = read_request(s.transaction, s.config.unit_id, &s.blocks[block_index]);
+    if unsafe { sk_tcp_send(socket, request.as_ptr(), request.len()) } < 0 {
+        fail(s, now, "Send failed");
+        return;
+    }
+    s.pending = Some(Pending { transaction: s.transaction, block: block_index, sent_ms: now });
+    s.next_block = Some(block_index + 1);
+}
+
+// =============================================================================
+// Helper Functions
+// =============================================================================
+
+fn emit_values(values: &[(String, f64)]) {
+    if values.is_empty() {
+        return;
+    }
+    let values: Vec<serde_json::Value> = values
+        .iter()
+        .map(|(path, value)| serde_json::json!({ "path": path, "value": value }))
+        .collect();
+    let delta = serde_json::json!({
+        "context": "vessels.self",
+        "updates": [{ "values": values }]
+    });
+    handle_message(&delta.to_string());
+}
+
+fn write_string(s: &str, ptr: *mut u8, max_len: usize) -> i32 {
+    let bytes = s.as_bytes();
+    let len = bytes.len().min(max_len);
+
+    unsafe {
+        std::ptr::copy_nonoverlapping(bytes.as_ptr(), ptr, len);
+    }
+
+    len as i32
+}
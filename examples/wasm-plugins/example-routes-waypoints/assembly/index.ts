@@ -6,13 +6,15 @@
  * - Routes: Navigation routes with GeoJSON LineString geometry
  * - Waypoints: Navigation points with GeoJSON Point geometry
  * - Full CRUD operations (list, get, set, delete)
+ * - GPX and KML import, GPX and GeoJSON export through HTTP endpoints
  */
 
 import {
   Plugin,
   setStatus,
   setError,
-  debug
+  debug,
+  JSON
 } from '@signalk/assemblyscript-plugin-sdk/assembly'
 
 import {
@@ -20,6 +22,20 @@ import {
   ResourceGetRequest
 } from '@signalk/assemblyscript-plugin-sdk/assembly/resources'
 
+import {
+  GeoCollection,
+  GeoPoint,
+  GeoRoute,
+  jsonString,
+  parseGpx,
+  parseKml,
+  routeDistance,
+  routeResource,
+  toGeoJson,
+  toGpx,
+  waypointResource
+} from '@signalk/assemblyscript-plugin-sdk/assembly/convert'
+
 // ===== Data Types =====
 
 /**
@@ -600,3 +616,254 @@ export function resources_delete_resource(requestJson: string): string {
 
   return 'Unknown resource type'
 }
+
+// ===== Format Conversion =====
+
+function storedCollection(): GeoCollection {
+  const collection = new GeoCollection()
+  for (let i = 0; i < waypoints.length; i++) {
+    const point = new GeoPoint()
+    point.name = waypoints[i].name
+    point.description = waypoints[i].description
+    point.type = waypoints[i].type
+    point.latitude = waypoints[i].latitude
+    point.longitude = waypoints[i].longitude
+    collection.waypoints.push(point)
+  }
+  for (let i = 0; i < routes.length; i++) {
+    const route = new GeoRoute()
+    route.name = routes[i].name
+    route.description = routes[i].description
+    for (let j = 0; j < routes[i].points.length; j++) {
+      const point = new GeoPoint()
+      point.name = routes[i].points[j].name
+      point.latitude = routes[i].points[j].latitude
+      point.longitude = routes[i].points[j].longitude
+      route.points.push(point)
+    }
+    collection.routes.push(route)
+  }
+  return collection
+}
+
+function importCollection(collection: GeoCollection): void {
+  for (let i = 0; i < collection.waypoints.length; i++) {
+    const point = collection.waypoints[i]
+    const wp = new Waypoint()
+    wp.id = generateId()
+    wp.name = point.name
+    wp.description = point.description
+    if (point.type.length > 0) wp.type = point.type
+    wp.latitude = point.latitude
+    wp.longitude = point.longitude
+    waypoints.push(wp)
+  }
+  for (let i = 0; i < collection.routes.length; i++) {
+    const geoRoute = collection.routes[i]
+    const route = new Route()
+    route.id = generateId()
+    route.name = geoRoute.name
+    route.description = geoRoute.description
+    route.distance = Math.round(routeDistance(geoRoute))
+    for (let j = 0; j < geoRoute.points.length; j++) {
+      const point = new RoutePoint()
+      point.name = geoRoute.points[j].name
+      point.latitude = geoRoute.points[j].latitude
+      point.longitude = geoRoute.points[j].longitude
+      route.points.push(point)
+    }
+    routes.push(route)
+  }
+}
+
+/**
+ * Read a GPX or KML document, detecting the format if it is not given
+ */
+function readDocument(document: string, format: string): GeoCollection | null {
+  if (format.length == 0) {
+    format = document.indexOf('<kml') >= 0 ? 'kml' : 'gpx'
+  }
+  if (format == 'gpx') {
+    return parseGpx(document)
+  }
+  if (format == 'kml') {
+    return parseKml(document)
+  }
+  return null
+}
+
+function signalkResources(collection: GeoCollection): string {
+  const wps: string[] = []
+  for (let i = 0; i < collection.waypoints.length; i++) {
+    wps.push(waypointResource(collection.waypoints[i]))
+  }
+  const rts: string[] = []
+  for (let i = 0; i < collection.routes.length; i++) {
+    rts.push(routeResource(collection.routes[i]))
+  }
+  return (
+    '{"waypoints":[' + wps.join(',') + '],"routes":[' + rts.join(',') + ']}'
+  )
+}
+
+// ===== HTTP Endpoints =====
+// Served at /plugins/<plugin-id>/api/...
+
+export function http_endpoints(): string {
+  return `[
+    {
+      "method": "POST",
+      "path": "/api/convert",
+      "handler": "handle_convert",
+      "permission": "read"
+    },
+    {
+      "method": "POST",
+      "path": "/api/import",
+      "handler": "handle_import",
+      "permission": "write"
+    },
+    {
+      "method": "GET",
+      "path": "/api/export",
+      "handler": "handle_export",
+      "permission": "read"
+    }
+  ]`
+}
+
+class HttpRequest {
+  body: string | null = null
+  query: JSON.Obj | null = null
+
+  queryParam(name: string): string {
+    const query = this.query
+    if (query === null) return ''
+    const value = query.getString(name)
+    return value !== null ? value.valueOf() : ''
+  }
+}
+
+function parseRequest(requestPtr: usize): HttpRequest {
+  // The server passes the request context as an AssemblyScript string
+  const requestJson = changetype<string>(requestPtr)
+  const request = new HttpRequest()
+  const parsed = JSON.parse(requestJson)
+  if (parsed.isObj) {
+    const obj = parsed as JSON.Obj
+    const body = obj.getString('body')
+    if (body !== null) {
+      request.body = body.valueOf()
+    }
+    request.query = obj.getObj('query')
+  }
+  return request
+}
+
+function httpResponse(
+  statusCode: i32,
+  contentType: string,
+  body: string
+): string {
+  return (
+    '{"statusCode":' +
+    statusCode.toString() +
+    ',"headers":{"Content-Type":' +
+    jsonString(contentType) +
+    '},"body":' +
+    jsonString(body) +
+    '}'
+  )
+}
+
+function errorResponse(statusCode: i32, message: string): string {
+  return httpResponse(
+    statusCode,
+    'application/json',
+    '{"message":' + jsonString(message) + '}'
+  )
+}
+
+/**
+ * Write a collection in the requested format: gpx, geojson or signalk
+ */
+function formatResponse(collection: GeoCollection, format: string): string {
+  if (format == 'gpx') {
+    return httpResponse(200, 'application/gpx+xml', toGpx(collection))
+  }
+  if (format == 'geojson') {
+    return httpResponse(200, 'application/geo+json', toGeoJson(collection))
+  }
+  if (format == 'signalk') {
+    return httpResponse(200, 'application/json', signalkResources(collection))
+  }
+  return errorResponse(400, 'Unsupported format: ' + format)
+}
+
+/**
+ * Handle POST /api/convert?from=gpx|kml&to=gpx|geojson|signalk
+ * Converts the GPX or KML document in the request body without storing it
+ */
+export function handle_convert(requestPtr: usize, requestLen: usize): string {
+  const request = parseRequest(requestPtr)
+  const body = request.body
+  if (body === null) {
+    return errorResponse(400, 'Expected a GPX or KML document')
+  }
+  const collection = readDocument(body, request.queryParam('from'))
+  if (collection === null) {
+    return errorResponse(400, 'Unsupported format, use gpx or kml')
+  }
+  const to = request.queryParam('to')
+  return formatResponse(collection, to.length > 0 ? to : 'signalk')
+}
+
+/**
+ * Handle POST /api/import?format=gpx|kml
+ * Adds the waypoints and routes of the document in the request body
+ */
+export function handle_import(requestPtr: usize, requestLen: usize): string {
+  const request = parseRequest(requestPtr)
+  const body = request.body
+  if (body === null) {
+    return errorResponse(400, 'Expected a GPX or KML document')
+  }
+  const collection = readDocument(body, request.queryParam('format'))
+  if (collection === null) {
+    return errorResponse(400, 'Unsupported format, use gpx or kml')
+  }
+  importCollection(collection)
+  debug(
+    'Imported ' +
+      collection.waypoints.length.toString() +
+      ' waypoints and ' +
+      collection.routes.length.toString() +
+      ' routes'
+  )
+  setStatus(
+    'Providing ' +
+      waypoints.length.toString() +
+      ' waypoints and ' +
+      routes.length.toString() +
+      ' routes'
+  )
+  return httpResponse(
+    200,
+    'application/json',
+    '{"waypoints":' +
+      collection.waypoints.length.toString() +
+      ',"routes":' +
+      collection.routes.length.toString() +
+      '}'
+  )
+}
+
+/**
+ * Handle GET /api/export?format=gpx|geojson
+ * Returns all stored waypoints and routes
+ */
+export function handle_export(requestPtr: usize, requestLen: usize): string {
+  const request = parseRequest(requestPtr)
+  const format = request.queryParam('format')
+  return formatResponse(storedCollection(), format.length > 0 ? format : 'gpx')
+}
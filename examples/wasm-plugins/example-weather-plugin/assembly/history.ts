@@ -0,0 +1,143 @@
+/**
+ * Observation history for the weather plugin
+ *
+ * Samples are kept in fixed-size ring buffers and persisted to the plugin's
+ * VFS as plain "timestamp,value" lines, so the history survives restarts
+ * without needing a JSON parser.
+ */
+
+export class Sample {
+  timestamp: f64
+  value: f64
+
+  constructor(timestamp: f64, value: f64) {
+    this.timestamp = timestamp
+    this.value = value
+  }
+}
+
+export class RingBuffer {
+  private timestamps: Float64Array
+  private values: Float64Array
+  private head: i32 = 0
+  private count: i32 = 0
+  capacity: i32
+
+  constructor(capacity: i32) {
+    this.capacity = capacity
+    this.timestamps = new Float64Array(capacity)
+    this.values = new Float64Array(capacity)
+  }
+
+  get length(): i32 {
+    return this.count
+  }
+
+  push(timestamp: f64, value: f64): void {
+    this.timestamps[this.head] = timestamp
+    this.values[this.head] = value
+    this.head = (this.head + 1) % this.capacity
+    if (this.count < this.capacity) {
+      this.count++
+    }
+  }
+
+  /**
+   * Get a sample by age order (0 = oldest)
+   */
+  at(index: i32): Sample {
+    const start = (this.head - this.count + this.capacity) % this.capacity
+    const i = (start + index) % this.capacity
+    return new Sample(this.timestamps[i], this.values[i])
+  }
+
+  latest(): Sample | null {
+    if (this.count === 0) {
+      return null
+    }
+    return this.at(this.count - 1)
+  }
+
+  /**
+   * Find the newest sample taken at or before the given time
+   */
+  sampleAtOrBefore(timestamp: f64): Sample | null {
+    for (let i = this.count - 1; i >= 0; i--) {
+      const sample = this.at(i)
+      if (sample.timestamp <= timestamp) {
+        return sample
+      }
+    }
+    return null
+  }
+
+  /**
+   * Average samples newer than `since` into at most `maxPoints` equal time
+   * buckets. Buckets without samples are left out.
+   */
+  downsample(since: f64, until: f64, maxPoints: i32): Sample[] {
+    const result: Sample[] = []
+    if (maxPoints <= 0 || until <= since) {
+      return result
+    }
+    const bucketMs = (until - since) / f64(maxPoints)
+    let bucket: i32 = -1
+    let sum: f64 = 0.0
+    let timeSum: f64 = 0.0
+    let n: i32 = 0
+
+    for (let i = 0; i < this.count; i++) {
+      const sample = this.at(i)
+      if (sample.timestamp < since) {
+        continue
+      }
+      let b = i32((sample.timestamp - since) / bucketMs)
+      if (b >= maxPoints) {
+        b = maxPoints - 1
+      }
+      if (b !== bucket && n > 0) {
+        result.push(new Sample(Math.round(timeSum / f64(n)), sum / f64(n)))
+        sum = 0.0
+        timeSum = 0.0
+        n = 0
+      }
+      bucket = b
+      sum += sample.value
+      timeSum += sample.timestamp
+      n++
+    }
+    if (n > 0) {
+      result.push(new Sample(Math.round(timeSum / f64(n)), sum / f64(n)))
+    }
+    return result
+  }
+
+  serialize(): string {
+    const lines: string[] = []
+    for (let i = 0; i < this.count; i++) {
+      const sample = this.at(i)
+      lines.push(
+        i64(sample.timestamp).toString() + ',' + sample.value.toString()
+      )
+    }
+    return lines.join('\n')
+  }
+
+  /**
+   * Restore samples written by serialize(), skipping malformed lines
+   */
+  load(text: string): void {
+    const lines = text.split('\n')
+    for (let i = 0; i < lines.length; i++) {
+      const comma = lines[i].indexOf(',')
+      if (comma <= 0) {
+        continue
+      }
+      const timestamp = parseFloat(lines[i].substring(0, comma))
+      const value = parseFloat(lines[i].substring(comma + 1))
+      if (!isNaN(timestamp) && !isNaN(value)) {
+        this.push(timestamp, value)
+      }
+    }
+  }
+}
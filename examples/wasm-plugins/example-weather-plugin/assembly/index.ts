@@ -5,14 +5,23 @@
  * - Network capability by fetching weather data from OpenWeatherMap API
  * - Resource provider capability for serving weather data via REST API
  * - Delta emission for real-time weather updates
+ * - Observation history persisted to the VFS, served via HTTP endpoints
+ * - Pressure trend alarms for rapidly falling barometric pressure
  */
 
 import {
   Plugin,
+  Delta,
+  Update,
+  PathValue,
+  Notification,
+  NotificationState,
+  NotificationMethod,
   emit,
   setStatus,
   setError,
   debug,
+  getSelfPath,
   createSimpleDelta
 } from '@signalk/assemblyscript-plugin-sdk/assembly'
 
@@ -23,15 +32,46 @@ import {
   ResourceGetRequest
 } from '@signalk/assemblyscript-plugin-sdk/assembly/resources'
 
+import {
+  CsvExport,
+  csvNumber,
+  csvResponse,
+  csvTimestamp
+} from '@signalk/assemblyscript-plugin-sdk/assembly/csv'
+
+import {
+  ensureDir,
+  readFile,
+  writeFile
+} from '@signalk/assemblyscript-plugin-sdk/assembly/vfs'
+
 import { fetchSync } from 'as-fetch/sync'
 import { Response } from 'as-fetch/assembly'
 
+import { RingBuffer, Sample } from './history'
+
+@external("env", "sk_now_ms")
+declare function sk_now_ms(): f64
+
+// ===== Observation History =====
+
+const PRESSURE_PATH = 'environment.outside.pressure'
+const TEMPERATURE_PATH = 'environment.outside.temperature'
+const HISTORY_DIR = 'data'
+const SAMPLE_INTERVAL_MS: i32 = 300000 // one sample every 5 minutes
+const HISTORY_CAPACITY: i32 = 2016 // 7 days of samples
+const MAX_HISTORY_HOURS: f64 = 168.0
+const MAX_HISTORY_POINTS: i32 = 120
+const TREND_WINDOW_MS: f64 = 3.0 * 3600000.0 // pressure tendency over 3 hours
+
 // Configuration interface
 class WeatherConfig {
   apiKey: string = ''
   latitude: f64 = 0.0
   longitude: f64 = 0.0
   updateInterval: i32 = 600000 // 10 minutes default
+  pressureFallWarning: f64 = 3.6 // hPa per 3 hours
+  pressureFallAlarm: f64 = 6.0 // hPa per 3 hours
 }
 
 // Simple JSON parsing helpers
@@ -164,6 +204,191 @@ class WeatherData {
 let cachedWeatherData: WeatherData | null = null
 let cachedConfig: WeatherConfig = new WeatherConfig()
 
+const pressureHistory = new RingBuffer(HISTORY_CAPACITY)
+const temperatureHistory = new RingBuffer(HISTORY_CAPACITY)
+let elapsedMs: i32 = 0
+let pressureTrendState = NotificationState.normal
+
+/**
+ * Read a number from a config JSON field, e.g. "pressureFallAlarm": 6
+ */
+function parseConfigNumber(
+  configJson: string,
+  key: string,
+  fallback: f64
+): f64 {
+  const keyMatch = configJson.indexOf('"' + key + '"')
+  if (keyMatch < 0) {
+    return fallback
+  }
+  let start = configJson.indexOf(':', keyMatch) + 1
+  while (
+    start < configJson.length &&
+    (configJson.charCodeAt(start) === 32 || configJson.charCodeAt(start) === 9)
+  ) {
+    start++
+  }
+  let end = start
+  while (
+    end < configJson.length &&
+    ((configJson.charCodeAt(end) >= 48 && configJson.charCodeAt(end) <= 57) ||
+      configJson.charCodeAt(end) === 46 ||
+      configJson.charCodeAt(end) === 45)
+  ) {
+    end++
+  }
+  if (end === start) {
+    return fallback
+  }
+  return parseFloat(configJson.substring(start, end))
+}
+
+/**
+ * History file for a Signal K path, relative to the VFS root
+ */
+function historyFile(path: string): string {
+  return HISTORY_DIR + '/history-' + path + '.txt'
+}
+
+function historyFor(path: string): RingBuffer | null {
+  if (path === PRESSURE_PATH) {
+    return pressureHistory
+  }
+  if (path === TEMPERATURE_PATH) {
+    return temperatureHistory
+  }
+  return null
+}
+
+/**
+ * Read the current numeric value of a vessels.self path
+ * @returns The value, or NaN if the path has no numeric value
+ */
+function readSelfNumber(path: string): f64 {
+  const json = getSelfPath(path)
+  if (json === null) {
+    return NaN
+  }
+  // getSelfPath returns the full leaf: {"value":101300,"$source":...}
+  const valueMatch = json.indexOf('"value":')
+  const start = valueMatch >= 0 ? valueMatch + 8 : 0
+  let end = start
+  while (
+    end < json.length &&
+    json.charCodeAt(end) !== 44 &&
+    json.charCodeAt(end) !== 125
+  ) {
+    end++
+  }
+  return parseFloat(json.substring(start, end))
+}
+
+function loadHistory(): void {
+  const pressureText = readFile(historyFile(PRESSURE_PATH))
+  if (pressureText !== null) {
+    pressureHistory.load(pressureText)
+  }
+  const temperatureText = readFile(historyFile(TEMPERATURE_PATH))
+  if (temperatureText !== null) {
+    temperatureHistory.load(temperatureText)
+  }
+  debug(
+    'Loaded ' +
+      pressureHistory.length.toString() +
+      ' pressure and ' +
+      temperatureHistory.length.toString() +
+      ' temperature samples from VFS'
+  )
+}
+
+/**
+ * Record the current value of a path and persist its history
+ */
+function recordSample(path: string, history: RingBuffer, now: f64): void {
+  const value = readSelfNumber(path)
+  if (isNaN(value)) {
+    return
+  }
+  history.push(now, value)
+  if (!writeFile(historyFile(path), history.serialize())) {
+    debug('Failed to persist history for ' + path)
+  }
+}
+
+/**
+ * Raise a notification when pressure falls faster than the configured
+ * thresholds over the trend window, and clear it once the fall eases
+ */
+function checkPressureTrend(now: f64): void {
+  const latest = pressureHistory.latest()
+  const reference = pressureHistory.sampleAtOrBefore(now - TREND_WINDOW_MS)
+  if (latest === null || reference === null) {
+    return
+  }
+  // Pa to hPa
+  const fall = (reference.value - latest.value) / 100.0
+  const fallText = (Math.round(fall * 10.0) / 10.0).toString()
+
+  let state = NotificationState.normal
+  let message = 'Barometric pressure steady'
+  if (fall >= cachedConfig.pressureFallAlarm) {
+    state = NotificationState.alarm
+    message = 'Rapid pressure fall: ' + fallText + ' hPa in 3 hours'
+  } else if (fall >= cachedConfig.pressureFallWarning) {
+    state = NotificationState.warn
+    message = 'Pressure falling: ' + fallText + ' hPa in 3 hours'
+  }
+  if (state === pressureTrendState) {
+    return
+  }
+  pressureTrendState = state
+
+  const notification = new Notification(state, message)
+  if (state !== NotificationState.normal) {
+    notification.method = [NotificationMethod.visual, NotificationMethod.sound]
+  }
+  const pathValue = new PathValue(
+    'notifications.' + PRESSURE_PATH,
+    notification.toJSON()
+  )
+  emit(new Delta('vessels.self', [new Update([pathValue])]))
+  debug('Pressure trend: ' + message)
+}
+
+/**
+ * Read a query parameter from an HTTP request context
+ * Query values are always strings, e.g. "query":{"hours":"24"}
+ */
+function queryParam(requestJson: string, name: string): string | null {
+  const queryMatch = requestJson.indexOf('"query"')
+  if (queryMatch < 0) {
+    return null
+  }
+  const queryEnd = requestJson.indexOf('}', queryMatch)
+  const keyMatch = requestJson.indexOf('"' + name + '"', queryMatch)
+  if (keyMatch < 0 || keyMatch > queryEnd) {
+    return null
+  }
+  const colonPos = requestJson.indexOf(':', keyMatch)
+  const valueStart = requestJson.indexOf('"', colonPos)
+  const valueEnd = requestJson.indexOf('"', valueStart + 1)
+  if (valueStart < 0 || valueEnd < 0) {
+    return null
+  }
+  return requestJson.substring(valueStart + 1, valueEnd)
+}
+
+function jsonResponse(statusCode: i32, bodyJson: string): string {
+  const escapedBody = bodyJson.replaceAll('"', '\\"').replaceAll('\n', '\\n')
+  return (
+    '{"statusCode":' +
+    statusCode.toString() +
+    ',"headers":{"Content-Type":"application/json"},"body":"' +
+    escapedBody +
+    '"}'
+  )
+}
+
 // Weather plugin class
 class WeatherPlugin extends Plugin {
   private config: WeatherConfig = new WeatherConfig()
@@ -238,6 +463,17 @@ class WeatherPlugin extends Plugin {
         }
       }
 
+      this.config.pressureFallWarning = parseConfigNumber(
+        configJson,
+        'pressureFallWarning',
+        this.config.pressureFallWarning
+      )
+      this.config.pressureFallAlarm = parseConfigNumber(
+        configJson,
+        'pressureFallAlarm',
+        this.config.pressureFallAlarm
+      )
+
       const lonMatch = configJson.indexOf('"longitude"')
       if (lonMatch >= 0) {
         const colonPos = configJson.indexOf(':', lonMatch)
@@ -291,6 +527,15 @@ class WeatherPlugin extends Plugin {
       )
     }
 
+    // Restore observation history recorded before the last restart
+    if (ensureDir(HISTORY_DIR)) {
+      loadHistory()
+    } else {
+      debug('Warning: VFS not available - history will not be persisted')
+    }
+    elapsedMs = 0
+    pressureTrendState = NotificationState.normal
+
     // Fetch and emit real weather data using as-fetch
     // This demonstrates the Asyncify integration for synchronous-style async operations
     this.fetchWeatherData()
@@ -332,6 +577,18 @@ class WeatherPlugin extends Plugin {
           "title": "Update Interval (ms)",
           "description": "How often to fetch weather data",
           "default": 600000
+        },
+        "pressureFallWarning": {
+          "type": "number",
+          "title": "Pressure Fall Warning (hPa / 3h)",
+          "description": "Raise a warning when pressure falls at least this much in 3 hours",
+          "default": 3.6
+        },
+        "pressureFallAlarm": {
+          "type": "number",
+          "title": "Pressure Fall Alarm (hPa / 3h)",
+          "description": "Raise an alarm when pressure falls at least this much in 3 hours",
+          "default": 6.0
         }
       }
     }`
@@ -487,6 +744,184 @@ export function plugin_stop(): i32 {
   return plugin.stop()
 }
 
+/**
+ * Poll function - called by server every ~1000ms
+ * Records pressure and temperature history every SAMPLE_INTERVAL_MS
+ */
+export function poll(): i32 {
+  elapsedMs += 1000
+  if (elapsedMs < SAMPLE_INTERVAL_MS) {
+    return 0
+  }
+  elapsedMs = 0
+
+  const now = sk_now_ms()
+  recordSample(PRESSURE_PATH, pressureHistory, now)
+  recordSample(TEMPERATURE_PATH, temperatureHistory, now)
+  checkPressureTrend(now)
+  return 0
+}
+
+// ===== HTTP Endpoints =====
+// Served at /plugins/<plugin-id>/api/...
+
+export function http_endpoints(): string {
+  return `[
+    {
+      "method": "GET",
+      "path": "/api/history",
+      "handler": "handle_get_history",
+      "permission": "read",
+      "description": "Recorded pressure or temperature history as JSON"
+    },
+    {
+      "method": "GET",
+      "path": "/api/history.csv",
+      "handler": "handle_get_history_csv",
+      "permission": "read",
+      "description": "All recorded samples as a CSV download"
+    }
+  ]`
+}
+
+/**
+ * Read the hours query parameter, defaulting to 24
+ * @returns Hours, capped to the history length, or NaN if invalid
+ */
+function hoursParam(requestJson: string): f64 {
+  const param = queryParam(requestJson, 'hours')
+  if (param === null) {
+    return 24.0
+  }
+  const hours = parseFloat(param)
+  if (isNaN(hours) || hours <= 0.0) {
+    return NaN
+  }
+  return Math.min(hours, MAX_HISTORY_HOURS)
+}
+
+/**
+ * Handle GET /api/history?path=environment.outside.pressure&hours=24
+ * Returns recorded samples averaged into at most MAX_HISTORY_POINTS points
+ */
+export function handle_get_history(
+  requestPtr: usize,
+  requestLen: usize
+): string {
+  // The server passes the request context as an AssemblyScript string
+  const requestJson = changetype<string>(requestPtr)
+
+  const pathParam = queryParam(requestJson, 'path')
+  const path = pathParam !== null ? pathParam : PRESSURE_PATH
+  const history = historyFor(path)
+  if (history === null) {
+    return jsonResponse(
+      400,
+      '{"message":"Unsupported path, use ' +
+        PRESSURE_PATH +
+        ' or ' +
+        TEMPERATURE_PATH +
+        '"}'
+    )
+  }
+
+  const hours = hoursParam(requestJson)
+  if (isNaN(hours)) {
+    return jsonResponse(400, '{"message":"hours must be a positive number"}')
+  }
+
+  const now = sk_now_ms()
+  const samples: Sample[] = history.downsample(
+    now - hours * 3600000.0,
+    now,
+    MAX_HISTORY_POINTS
+  )
+  const points: string[] = []
+  for (let i = 0; i < samples.length; i++) {
+    points.push(
+      '{"timestamp":' +
+        i64(samples[i].timestamp).toString() +
+        ',"value":' +
+        samples[i].value.toString() +
+        '}'
+    )
+  }
+
+  return jsonResponse(
+    200,
+    '{"path":"' +
+      path +
+      '","hours":' +
+      hours.toString() +
+      ',"data":[' +
+      points.join(',') +
+      ']}'
+  )
+}
+
+/**
+ * Handle GET /api/history.csv?hours=24&columns=timestamp,pressure
+ * Returns all recorded samples, one row per sample time, for spreadsheets
+ */
+export function handle_get_history_csv(
+  requestPtr: usize,
+  requestLen: usize
+): string {
+  const requestJson = changetype<string>(requestPtr)
+
+  const hours = hoursParam(requestJson)
+  if (isNaN(hours)) {
+    return jsonResponse(400, '{"message":"hours must be a positive number"}')
+  }
+  const columnsParam = queryParam(requestJson, 'columns')
+  const csv = new CsvExport(
+    ['timestamp', 'pressure', 'temperature'],
+    columnsParam !== null ? columnsParam : ''
+  )
+  if (!csv.isValid()) {
+    return jsonResponse(
+      400,
+      '{"message":"columns must be timestamp, pressure or temperature"}'
+    )
+  }
+
+  // Both paths are sampled together, merge them by timestamp
+  const since = sk_now_ms() - hours * 3600000.0
+  let p = 0
+  let t = 0
+  while (p < pressureHistory.length || t < temperatureHistory.length) {
+    let pressure: Sample | null = null
+    if (p < pressureHistory.length) pressure = pressureHistory.at(p)
+    let temperature: Sample | null = null
+    if (t < temperatureHistory.length) temperature = temperatureHistory.at(t)
+    let timestamp: f64 = Infinity
+    if (pressure !== null) timestamp = pressure.timestamp
+    if (temperature !== null && temperature.timestamp < timestamp) {
+      timestamp = temperature.timestamp
+    }
+
+    let pressureValue: f64 = NaN
+    if (pressure !== null && pressure.timestamp === timestamp) {
+      pressureValue = pressure.value
+      p++
+    }
+    let temperatureValue: f64 = NaN
+    if (temperature !== null && temperature.timestamp === timestamp) {
+      temperatureValue = temperature.value
+      t++
+    }
+    if (timestamp >= since) {
+      csv.row([
+        csvTimestamp(timestamp),
+        csvNumber(pressureValue),
+        csvNumber(temperatureValue)
+      ])
+    }
+  }
+
+  return csvResponse(csv.toString(), 'weather-history.csv')
+}
+
 // ===== Resource Provider Handlers =====
 // These are called by the Signal K server when requests come in to
 // /signalk/v2/api/resources/weather
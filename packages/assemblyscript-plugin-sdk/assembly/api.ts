@@ -23,6 +23,18 @@ declare function sk_handle_message_ffi(
   version: i32
 ): void
 
+/**
+ * @internal
+ * Send a binary message to the server's NMEA outputs
+ */
+@external("env", "sk_handle_binary")
+declare function sk_handle_binary_ffi(
+  kindPtr: usize,
+  kindLen: usize,
+  dataPtr: usize,
+  dataLen: usize
+): i32
+
 /**
  * @internal
  * Set plugin status message
@@ -82,6 +94,27 @@ declare function sk_read_config_ffi(bufPtr: usize, bufLen: usize): i32
 @external("env", "sk_save_config")
 declare function sk_save_config_ffi(configPtr: usize, configLen: usize): i32
 
+/**
+ * @internal
+ * Take a named lock shared by all plugins
+ */
+@external("env", "sk_lock_acquire")
+declare function sk_lock_acquire_ffi(namePtr: usize, nameLen: usize): i32
+
+/**
+ * @internal
+ * Release a named lock
+ */
+@external("env", "sk_lock_release")
+declare function sk_lock_release_ffi(namePtr: usize, nameLen: usize): i32
+
+/**
+ * @internal
+ * Get whether the vessel has internet access
+ */
+@external("env", "sk_get_connectivity")
+declare function sk_get_connectivity_ffi(): i32
+
 // ===== Public API Functions =====
 
 /**
@@ -118,6 +151,70 @@ export function emit(delta: Delta, skVersion: i32 = SK_VERSION_V1): void {
   sk_handle_message_ffi(ptr, buffer.byteLength, skVersion)
 }
 
+function handleBinary(kind: string, data: ArrayBuffer): bool {
+  const kindBuffer = String.UTF8.encode(kind)
+  return (
+    sk_handle_binary_ffi(
+      changetype<usize>(kindBuffer),
+      kindBuffer.byteLength,
+      changetype<usize>(data),
+      data.byteLength
+    ) === 1
+  )
+}
+
+/**
+ * Send an NMEA 2000 message to the server's NMEA 2000 connections
+ *
+ * Requires the dataWrite capability. The source address is set by the
+ * gateway that transmits the message.
+ *
+ * @param priority Message priority, 0-7
+ * @param pgn Parameter group number
+ * @param destination Destination address, 255 for broadcast
+ * @param data PGN data, up to 223 bytes
+ * @returns true if the message was handed to the outputs
+ *
+ * @example
+ * ```typescript
+ * // PGN 127250 Vessel Heading: SID, heading, deviation, variation, reference
+ * const data = new Uint8Array(8)
+ * data[0] = 0xff
+ * store<u16>(data.dataStart + 1, u16(heading * 10000))
+ * store<u16>(data.dataStart + 3, 0x7fff)
+ * store<u16>(data.dataStart + 5, 0x7fff)
+ * data[7] = 0xfd // magnetic
+ * sendNmea2000(2, 127250, 255, data)
+ * ```
+ */
+export function sendNmea2000(
+  priority: u8,
+  pgn: u32,
+  destination: u8,
+  data: Uint8Array
+): bool {
+  const frame = new Uint8Array(5 + data.length)
+  frame[0] = priority
+  frame[1] = u8(pgn & 0xff)
+  frame[2] = u8((pgn >> 8) & 0xff)
+  frame[3] = u8((pgn >> 16) & 0xff)
+  frame[4] = destination
+  frame.set(data, 5)
+  return handleBinary('nmea2000', frame.buffer)
+}
+
+/**
+ * Send an NMEA 0183 sentence to the server's NMEA 0183 outputs
+ *
+ * Requires the dataWrite capability.
+ *
+ * @param sentence Complete sentence including the checksum
+ * @returns true if the sentence was handed to the outputs
+ */
+export function sendNmea0183(sentence: string): bool {
+  return handleBinary('nmea0183', String.UTF8.encode(sentence))
+}
+
 /**
  * Set plugin status message (shown in admin UI)
  *
@@ -284,3 +381,70 @@ export function saveConfig(configJson: string): i32 {
   const ptr = changetype<usize>(buffer)
   return sk_save_config_ffi(ptr, buffer.byteLength)
 }
+
+/**
+ * Take a named lock shared with other plugins, without waiting
+ *
+ * Lets cooperating plugins take turns with something they share, such as
+ * a device. When another plugin holds the lock, try again later, e.g. from
+ * the next poll(). The lock is released by releaseLock() or when the
+ * plugin stops.
+ *
+ * @param name Lock name agreed on by the plugins
+ * @returns true if this plugin holds the lock, also if it already did
+ *
+ * @example
+ * ```typescript
+ * export function poll(): i32 {
+ *   if (!acquireLock('shore-power-meter')) {
+ *     return 0 // Another plugin is talking to the meter
+ *   }
+ *   readMeter()
+ *   releaseLock('shore-power-meter')
+ *   return 0
+ * }
+ * ```
+ */
+export function acquireLock(name: string): bool {
+  const buffer = String.UTF8.encode(name)
+  return sk_lock_acquire_ffi(changetype<usize>(buffer), buffer.byteLength) === 1
+}
+
+/**
+ * Release a named lock taken with acquireLock()
+ *
+ * @param name Lock name
+ * @returns true if the lock was released, false if this plugin did not
+ *   hold it
+ */
+export function releaseLock(name: string): bool {
+  const buffer = String.UTF8.encode(name)
+  return sk_lock_release_ffi(changetype<usize>(buffer), buffer.byteLength) === 1
+}
+
+/** No internet access */
+export const CONNECTIVITY_OFFLINE: i32 = 0
+/** Internet access over a metered link, e.g. satellite */
+export const CONNECTIVITY_METERED: i32 = 1
+/** Internet access */
+export const CONNECTIVITY_ONLINE: i32 = 2
+
+/**
+ * Get whether the vessel has internet access, so remote syncs and uploads
+ * can be paused or deferred instead of failing
+ *
+ * @returns CONNECTIVITY_OFFLINE, CONNECTIVITY_METERED or CONNECTIVITY_ONLINE
+ *
+ * @example
+ * ```typescript
+ * export function poll(): i32 {
+ *   if (getConnectivity() == CONNECTIVITY_ONLINE) {
+ *     uploadPendingLogs()
+ *   }
+ *   return 0
+ * }
+ * ```
+ */
+export function getConnectivity(): i32 {
+  return sk_get_connectivity_ffi()
+}
@@ -0,0 +1,564 @@
+/**
+ * GPX, KML and GeoJSON conversion for AssemblyScript plugins
+ *
+ * Converts between common route and waypoint exchange formats and
+ * Signal K resources:
+ * - GPX 1.1 waypoints and routes, import and export
+ * - KML placemarks (points and line strings), import
+ * - GeoJSON FeatureCollection, export
+ *
+ * The XML readers are deliberately small: they find elements by tag name,
+ * ignore namespace prefixes and do not validate documents. GPX tracks are
+ * not converted.
+ */
+
+// ===== Types =====
+
+/**
+ * A named position: a waypoint, or a point of a route
+ */
+export class GeoPoint {
+  name: string = ''
+  description: string = ''
+  type: string = ''
+  latitude: f64 = 0.0
+  longitude: f64 = 0.0
+}
+
+/**
+ * A named sequence of points
+ */
+export class GeoRoute {
+  name: string = ''
+  description: string = ''
+  points: GeoPoint[] = []
+}
+
+/**
+ * Waypoints and routes read from, or written to, a document
+ */
+export class GeoCollection {
+  waypoints: GeoPoint[] = []
+  routes: GeoRoute[] = []
+}
+
+// ===== XML Helpers =====
+
+class XmlElement {
+  attributes: string = ''
+  content: string = ''
+}
+
+function isSpace(code: i32): bool {
+  return code == 32 || code == 9 || code == 10 || code == 13
+}
+
+function isNameEnd(code: i32): bool {
+  // whitespace, '>' or '/'
+  return isSpace(code) || code == 62 || code == 47
+}
+
+/**
+ * Find the start of the next <tag or <prefix:tag element from position from
+ */
+function findStartTag(xml: string, tag: string, from: i32): i32 {
+  let pos = xml.indexOf('<', from)
+  while (pos >= 0) {
+    const nameStart = pos + 1
+    let nameEnd = nameStart
+    while (nameEnd < xml.length && !isNameEnd(xml.charCodeAt(nameEnd))) {
+      nameEnd++
+    }
+    let name = xml.substring(nameStart, nameEnd)
+    const colon = name.indexOf(':')
+    if (colon >= 0) {
+      name = name.substring(colon + 1)
+    }
+    if (name == tag) {
+      return pos
+    }
+    pos = xml.indexOf('<', pos + 1)
+  }
+  return -1
+}
+
+/**
+ * Find the end tag </tag> or </prefix:tag> from position from
+ * @returns Position of the end tag, or -1
+ */
+function findEndTag(xml: string, tag: string, from: i32): i32 {
+  let pos = xml.indexOf('</', from)
+  while (pos >= 0) {
+    const end = xml.indexOf('>', pos)
+    if (end < 0) {
+      return -1
+    }
+    let name = xml.substring(pos + 2, end).trim()
+    const colon = name.indexOf(':')
+    if (colon >= 0) {
+      name = name.substring(colon + 1)
+    }
+    if (name == tag) {
+      return pos
+    }
+    pos = xml.indexOf('</', pos + 2)
+  }
+  return -1
+}
+
+/**
+ * All elements with the given tag name, in document order
+ * Elements are not expected to nest within themselves.
+ */
+function elements(xml: string, tag: string): XmlElement[] {
+  const result: XmlElement[] = []
+  let pos = findStartTag(xml, tag, 0)
+  while (pos >= 0) {
+    const startEnd = xml.indexOf('>', pos)
+    if (startEnd < 0) {
+      break
+    }
+    const element = new XmlElement()
+    const selfClosing = xml.charCodeAt(startEnd - 1) == 47
+    element.attributes = xml.substring(
+      pos + 1,
+      selfClosing ? startEnd - 1 : startEnd
+    )
+    let next = startEnd + 1
+    if (!selfClosing) {
+      const endTag = findEndTag(xml, tag, startEnd + 1)
+      if (endTag < 0) {
+        break
+      }
+      element.content = xml.substring(startEnd + 1, endTag)
+      next = endTag
+    }
+    result.push(element)
+    pos = findStartTag(xml, tag, next)
+  }
+  return result
+}
+
+/**
+ * Text of the first child element with the given tag, or ''
+ */
+function childText(content: string, tag: string): string {
+  const found = elements(content, tag)
+  if (found.length == 0) {
+    return ''
+  }
+  return decodeXmlText(found[0].content)
+}
+
+/**
+ * Value of an attribute, or '' if it is missing
+ */
+function attribute(attributes: string, name: string): string {
+  let pos = attributes.indexOf(name + '=')
+  while (pos > 0) {
+    const before = attributes.charCodeAt(pos - 1)
+    const valueStart = pos + name.length + 1
+    if (isSpace(before) && valueStart < attributes.length) {
+      const quote = attributes.charAt(valueStart)
+      const valueEnd = attributes.indexOf(quote, valueStart + 1)
+      if (valueEnd > valueStart) {
+        return decodeXmlText(attributes.substring(valueStart + 1, valueEnd))
+      }
+    }
+    pos = attributes.indexOf(name + '=', pos + 1)
+  }
+  return ''
+}
+
+function decodeXmlText(text: string): string {
+  let value = text.trim()
+  if (value.startsWith('<![CDATA[')) {
+    const end = value.indexOf(']]>')
+    return value.substring(9, end >= 0 ? end : value.length)
+  }
+  if (value.indexOf('&') < 0) {
+    return value
+  }
+  value = value
+    .replaceAll('&lt;', '<')
+    .replaceAll('&gt;', '>')
+    .replaceAll('&quot;', '"')
+    .replaceAll('&apos;', "'")
+
+  // Numeric character references, then &amp; last so it is not decoded twice
+  let pos = value.indexOf('&#')
+  while (pos >= 0) {
+    const end = value.indexOf(';', pos)
+    if (end < 0) {
+      break
+    }
+    const hex = value.charAt(pos + 2) == 'x'
+    const digits = value.substring(pos + (hex ? 3 : 2), end)
+    const code = <i32>parseInt(digits, hex ? 16 : 10)
+    if (code > 0) {
+      value =
+        value.substring(0, pos) +
+        String.fromCodePoint(code) +
+        value.substring(end + 1)
+    }
+    pos = value.indexOf('&#', pos + 1)
+  }
+  return value.replaceAll('&amp;', '&')
+}
+
+function encodeXmlText(text: string): string {
+  return text
+    .replaceAll('&', '&amp;')
+    .replaceAll('<', '&lt;')
+    .replaceAll('>', '&gt;')
+    .replaceAll('"', '&quot;')
+}
+
+// ===== JSON Helpers =====
+
+/**
+ * Quote and escape a string for use in JSON
+ */
+export function jsonString(value: string): string {
+  let result = '"'
+  for (let i = 0; i < value.length; i++) {
+    const code = value.charCodeAt(i)
+    if (code == 34) {
+      result += '\\"'
+    } else if (code == 92) {
+      result += '\\\\'
+    } else if (code == 10) {
+      result += '\\n'
+    } else if (code == 13) {
+      result += '\\r'
+    } else if (code == 9) {
+      result += '\\t'
+    } else if (code < 32) {
+      result += '\\u' + code.toString(16).padStart(4, '0')
+    } else {
+      result += value.charAt(i)
+    }
+  }
+  return result + '"'
+}
+
+function coordinates(point: GeoPoint): string {
+  return (
+    '[' + point.longitude.toString() + ',' + point.latitude.toString() + ']'
+  )
+}
+
+// ===== Readers =====
+
+function isValidPosition(latitude: f64, longitude: f64): bool {
+  return (
+    !isNaN(latitude) &&
+    !isNaN(longitude) &&
+    latitude >= -90.0 &&
+    latitude <= 90.0 &&
+    longitude >= -180.0 &&
+    longitude <= 180.0
+  )
+}
+
+function gpxPoint(element: XmlElement): GeoPoint | null {
+  const latitude = parseFloat(attribute(element.attributes, 'lat'))
+  const longitude = parseFloat(attribute(element.attributes, 'lon'))
+  if (!isValidPosition(latitude, longitude)) {
+    return null
+  }
+  const point = new GeoPoint()
+  point.latitude = latitude
+  point.longitude = longitude
+  point.name = childText(element.content, 'name')
+  point.description = childText(element.content, 'desc')
+  point.type = childText(element.content, 'type')
+  return point
+}
+
+/**
+ * Read the waypoints and routes of a GPX document
+ * Points with missing or invalid coordinates are skipped.
+ */
+export function parseGpx(xml: string): GeoCollection {
+  const collection = new GeoCollection()
+
+  const wpts = elements(xml, 'wpt')
+  for (let i = 0; i < wpts.length; i++) {
+    const point = gpxPoint(wpts[i])
+    if (point !== null) {
+      collection.waypoints.push(point)
+    }
+  }
+
+  const rtes = elements(xml, 'rte')
+  for (let i = 0; i < rtes.length; i++) {
+    const content = rtes[i].content
+    // The route's own name and desc come before its points
+    const firstPoint = findStartTag(content, 'rtept', 0)
+    const header = firstPoint >= 0 ? content.substring(0, firstPoint) : content
+
+    const route = new GeoRoute()
+    route.name = childText(header, 'name')
+    route.description = childText(header, 'desc')
+    const rtepts = elements(content, 'rtept')
+    for (let j = 0; j < rtepts.length; j++) {
+      const point = gpxPoint(rtepts[j])
+      if (point !== null) {
+        route.points.push(point)
+      }
+    }
+    if (route.points.length > 0) {
+      collection.routes.push(route)
+    }
+  }
+
+  return collection
+}
+
+/**
+ * Parse a KML coordinates list: lon,lat[,alt] tuples separated by whitespace
+ */
+function kmlCoordinates(text: string): GeoPoint[] {
+  const points: GeoPoint[] = []
+  let start = -1
+  for (let i = 0; i <= text.length; i++) {
+    const space = i == text.length || isSpace(text.charCodeAt(i))
+    if (!space && start < 0) {
+      start = i
+    } else if (space && start >= 0) {
+      const parts = text.substring(start, i).split(',')
+      start = -1
+      if (parts.length < 2) {
+        continue
+      }
+      const longitude = parseFloat(parts[0])
+      const latitude = parseFloat(parts[1])
+      if (isValidPosition(latitude, longitude)) {
+        const point = new GeoPoint()
+        point.latitude = latitude
+        point.longitude = longitude
+        points.push(point)
+      }
+    }
+  }
+  return points
+}
+
+/**
+ * Read the placemarks of a KML document
+ * Point placemarks become waypoints, LineString placemarks become routes.
+ */
+export function parseKml(xml: string): GeoCollection {
+  const collection = new GeoCollection()
+
+  const placemarks = elements(xml, 'Placemark')
+  for (let i = 0; i < placemarks.length; i++) {
+    const content = placemarks[i].content
+    const name = childText(content, 'name')
+    const description = childText(content, 'description')
+
+    const lines = elements(content, 'LineString')
+    if (lines.length > 0) {
+      const route = new GeoRoute()
+      route.name = name
+      route.description = description
+      route.points = kmlCoordinates(childText(lines[0].content, 'coordinates'))
+      if (route.points.length > 0) {
+        collection.routes.push(route)
+      }
+      continue
+    }
+
+    const points = elements(content, 'Point')
+    if (points.length > 0) {
+      const found = kmlCoordinates(childText(points[0].content, 'coordinates'))
+      if (found.length > 0) {
+        const point = found[0]
+        point.name = name
+        point.description = description
+        collection.waypoints.push(point)
+      }
+    }
+  }
+
+  return collection
+}
+
+// ===== Writers =====
+
+function gpxPointElement(
+  tag: string,
+  point: GeoPoint,
+  indent: string
+): string {
+  let result =
+    indent +
+    '<' +
+    tag +
+    ' lat="' +
+    point.latitude.toString() +
+    '" lon="' +
+    point.longitude.toString() +
+    '">'
+  if (point.name.length > 0) {
+    result += '<name>' + encodeXmlText(point.name) + '</name>'
+  }
+  if (point.description.length > 0) {
+    result += '<desc>' + encodeXmlText(point.description) + '</desc>'
+  }
+  if (point.type.length > 0) {
+    result += '<type>' + encodeXmlText(point.type) + '</type>'
+  }
+  return result + '</' + tag + '>\n'
+}
+
+/**
+ * Write waypoints and routes as a GPX 1.1 document
+ */
+export function toGpx(collection: GeoCollection): string {
+  let result =
+    '<?xml version="1.0" encoding="UTF-8"?>\n' +
+    '<gpx version="1.1" creator="Signal K" xmlns="http://www.topografix.com/GPX/1/1">\n'
+  for (let i = 0; i < collection.waypoints.length; i++) {
+    result += gpxPointElement('wpt', collection.waypoints[i], '  ')
+  }
+  for (let i = 0; i < collection.routes.length; i++) {
+    const route = collection.routes[i]
+    result += '  <rte>\n'
+    if (route.name.length > 0) {
+      result += '    <name>' + encodeXmlText(route.name) + '</name>\n'
+    }
+    if (route.description.length > 0) {
+      result += '    <desc>' + encodeXmlText(route.description) + '</desc>\n'
+    }
+    for (let j = 0; j < route.points.length; j++) {
+      result += gpxPointElement('rtept', route.points[j], '    ')
+    }
+    result += '  </rte>\n'
+  }
+  return result + '</gpx>\n'
+}
+
+/**
+ * Write waypoints and routes as a GeoJSON FeatureCollection
+ * Waypoints become Point features and routes LineString features, with
+ * name, description and type (waypoints) or point names (routes) as
+ * properties.
+ */
+export function toGeoJson(collection: GeoCollection): string {
+  const features: string[] = []
+  for (let i = 0; i < collection.waypoints.length; i++) {
+    const point = collection.waypoints[i]
+    features.push(
+      '{"type":"Feature","geometry":{"type":"Point","coordinates":' +
+        coordinates(point) +
+        '},"properties":{"name":' +
+        jsonString(point.name) +
+        ',"description":' +
+        jsonString(point.description) +
+        ',"type":' +
+        jsonString(point.type) +
+        '}}'
+    )
+  }
+  for (let i = 0; i < collection.routes.length; i++) {
+    const route = collection.routes[i]
+    features.push(
+      '{"type":"Feature","geometry":' +
+        lineString(route) +
+        ',"properties":{"name":' +
+        jsonString(route.name) +
+        ',"description":' +
+        jsonString(route.description) +
+        ',"coordinatesMeta":' +
+        coordinatesMeta(route) +
+        '}}'
+    )
+  }
+  return (
+    '{"type":"FeatureCollection","features":[' + features.join(',') + ']}'
+  )
+}
+
+function lineString(route: GeoRoute): string {
+  const coords: string[] = []
+  for (let i = 0; i < route.points.length; i++) {
+    coords.push(coordinates(route.points[i]))
+  }
+  return '{"type":"LineString","coordinates":[' + coords.join(',') + ']}'
+}
+
+function coordinatesMeta(route: GeoRoute): string {
+  const meta: string[] = []
+  for (let i = 0; i < route.points.length; i++) {
+    meta.push('{"name":' + jsonString(route.points[i].name) + '}')
+  }
+  return '[' + meta.join(',') + ']'
+}
+
+// ===== Signal K Resources =====
+
+const EARTH_RADIUS: f64 = 6371008.8 // meters, mean radius
+
+/**
+ * Length of a route along great circles between its points, in meters
+ */
+export function routeDistance(route: GeoRoute): f64 {
+  let distance: f64 = 0.0
+  for (let i = 1; i < route.points.length; i++) {
+    const from = route.points[i - 1]
+    const to = route.points[i]
+    const lat1 = (from.latitude * Math.PI) / 180.0
+    const lat2 = (to.latitude * Math.PI) / 180.0
+    const dLat = lat2 - lat1
+    const dLon = ((to.longitude - from.longitude) * Math.PI) / 180.0
+    const a =
+      Math.sin(dLat / 2) * Math.sin(dLat / 2) +
+      Math.cos(lat1) *
+        Math.cos(lat2) *
+        Math.sin(dLon / 2) *
+        Math.sin(dLon / 2)
+    distance += 2 * EARTH_RADIUS * Math.asin(Math.sqrt(a))
+  }
+  return distance
+}
+
+/**
+ * A point as a Signal K waypoint resource
+ */
+export function waypointResource(point: GeoPoint): string {
+  let result = '{"name":' + jsonString(point.name)
+  if (point.description.length > 0) {
+    result += ',"description":' + jsonString(point.description)
+  }
+  if (point.type.length > 0) {
+    result += ',"type":' + jsonString(point.type)
+  }
+  return (
+    result +
+    ',"feature":{"type":"Feature","geometry":{"type":"Point","coordinates":' +
+    coordinates(point) +
+    '},"properties":{}}}'
+  )
+}
+
+/**
+ * A route as a Signal K route resource
+ */
+export function routeResource(route: GeoRoute): string {
+  let result = '{"name":' + jsonString(route.name)
+  if (route.description.length > 0) {
+    result += ',"description":' + jsonString(route.description)
+  }
+  return (
+    result +
+    ',"distance":' +
+    Math.round(routeDistance(route)).toString() +
+    ',"feature":{"type":"Feature","geometry":' +
+    lineString(route) +
+    ',"properties":{"coordinatesMeta":' +
+    coordinatesMeta(route) +
+    '}}}'
+  )
+}
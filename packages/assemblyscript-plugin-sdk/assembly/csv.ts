@@ -0,0 +1,188 @@
+/**
+ * CSV export helpers for AssemblyScript plugins
+ *
+ * Builds CSV downloads of data a plugin has collected, such as a trip log
+ * or a weather history, for HTTP endpoint handlers:
+ * - RFC 4180 quoting of fields
+ * - Column selection from a query parameter, e.g. ?columns=timestamp,value
+ * - Rows are buffered in chunks, so large exports are joined only once
+ *
+ * @example
+ * ```typescript
+ * const csv = new CsvExport(['timestamp', 'pressure', 'temperature'], columns)
+ * if (!csv.isValid()) {
+ *   return errorResponse(400, 'Unknown columns: ' + columns)
+ * }
+ * for (let i = 0; i < samples.length; i++) {
+ *   csv.row([
+ *     csvTimestamp(samples[i].time),
+ *     csvNumber(samples[i].pressure),
+ *     csvNumber(samples[i].temperature)
+ *   ])
+ * }
+ * return csvResponse(csv.toString(), 'weather.csv')
+ * ```
+ */
+
+import { jsonString } from './convert'
+
+// Rows per chunk before they are joined into one string
+const ROWS_PER_CHUNK: i32 = 256
+
+/**
+ * Quote a CSV field if it contains a comma, quote or line break
+ */
+export function csvField(value: string): string {
+  if (
+    value.indexOf(',') < 0 &&
+    value.indexOf('"') < 0 &&
+    value.indexOf('\n') < 0 &&
+    value.indexOf('\r') < 0
+  ) {
+    return value
+  }
+  return '"' + value.replaceAll('"', '""') + '"'
+}
+
+/**
+ * Format a number for CSV, leaving the field empty for NaN
+ */
+export function csvNumber(value: f64): string {
+  if (isNaN(value) || !isFinite(value)) {
+    return ''
+  }
+  return value.toString()
+}
+
+function pad(value: i64, width: i32): string {
+  return value.toString().padStart(width, '0')
+}
+
+/**
+ * Format milliseconds since the Unix epoch as an ISO 8601 UTC timestamp
+ */
+export function csvTimestamp(ms: f64): string {
+  const totalMs = i64(Math.floor(ms))
+  let days = totalMs / 86400000
+  let dayMs = totalMs % 86400000
+  if (dayMs < 0) {
+    dayMs += 86400000
+    days -= 1
+  }
+
+  // Civil date from days since 1970-01-01 (Howard Hinnant's algorithm)
+  const z = days + 719468
+  const era = (z >= 0 ? z : z - 146096) / 146097
+  const doe = z - era * 146097
+  const yoe = (doe - doe / 1460 + doe / 36524 - doe / 146096) / 365
+  const doy = doe - (365 * yoe + yoe / 4 - yoe / 100)
+  const mp = (5 * doy + 2) / 153
+  const day = doy - (153 * mp + 2) / 5 + 1
+  const month = mp < 10 ? mp + 3 : mp - 9
+  const year = yoe + era * 400 + <i64>(month <= 2 ? 1 : 0)
+
+  return (
+    pad(year, 4) +
+    '-' +
+    pad(month, 2) +
+    '-' +
+    pad(day, 2) +
+    'T' +
+    pad(dayMs / 3600000, 2) +
+    ':' +
+    pad((dayMs / 60000) % 60, 2) +
+    ':' +
+    pad((dayMs / 1000) % 60, 2) +
+    '.' +
+    pad(dayMs % 1000, 3) +
+    'Z'
+  )
+}
+
+/**
+ * A CSV document with a header row, restricted to the selected columns
+ */
+export class CsvExport {
+  private selected: i32[] = []
+  private chunks: string[] = []
+  private pending: string[] = []
+  private unknown: bool = false
+
+  /**
+   * @param columns All columns the plugin can export, in row order
+   * @param selection Comma separated column names to export, in the
+   *   requested order; empty for all columns
+   */
+  constructor(columns: string[], selection: string = '') {
+    if (selection.length == 0) {
+      for (let i = 0; i < columns.length; i++) {
+        this.selected.push(i)
+      }
+    } else {
+      const names = selection.split(',')
+      for (let i = 0; i < names.length; i++) {
+        const index = columns.indexOf(names[i].trim())
+        if (index < 0) {
+          this.unknown = true
+        } else {
+          this.selected.push(index)
+        }
+      }
+    }
+
+    const header: string[] = []
+    for (let i = 0; i < this.selected.length; i++) {
+      header.push(csvField(columns[this.selected[i]]))
+    }
+    this.pending.push(header.join(',') + '\r\n')
+  }
+
+  /**
+   * False if the selection named unknown columns or no columns at all
+   */
+  isValid(): bool {
+    return !this.unknown && this.selected.length > 0
+  }
+
+  /**
+   * Add a row
+   * @param values Field values for all columns, in the order given to the
+   *   constructor, already formatted; they are quoted as needed
+   */
+  row(values: string[]): void {
+    const fields: string[] = []
+    for (let i = 0; i < this.selected.length; i++) {
+      const index = this.selected[i]
+      fields.push(index < values.length ? csvField(values[index]) : '')
+    }
+    this.pending.push(fields.join(',') + '\r\n')
+    if (this.pending.length >= ROWS_PER_CHUNK) {
+      this.chunks.push(this.pending.join(''))
+      this.pending = []
+    }
+  }
+
+  toString(): string {
+    if (this.pending.length > 0) {
+      this.chunks.push(this.pending.join(''))
+      this.pending = []
+    }
+    return this.chunks.join('')
+  }
+}
+
+/**
+ * HTTP endpoint response that downloads a CSV document
+ * @param csv The document, e.g. from CsvExport.toString()
+ * @param filename Suggested file name for the download
+ */
+export function csvResponse(csv: string, filename: string): string {
+  return (
+    '{"statusCode":200,"headers":{"Content-Type":"text/csv; charset=utf-8",' +
+    '"Content-Disposition":' +
+    jsonString('attachment; filename="' + filename + '"') +
+    '},"body":' +
+    jsonString(csv) +
+    '}'
+  )
+}
@@ -10,6 +10,9 @@ export * from './signalk'
 export * from './api'
 export * from './network'
 export * from './resources'
+export * from './convert'
+export * from './csv'
+export * from './vfs'
 
 // Re-export JSON parsing library for plugin authors
 export { JSON } from 'assemblyscript-json/assembly'
@@ -15,7 +15,9 @@ import { JSON } from 'assemblyscript-json/assembly'
 @external("env", "sk_register_resource_provider")
 declare function sk_register_resource_provider_ffi(
   typePtr: usize,
-  typeLen: usize
+  typeLen: usize,
+  schemaPtr: usize,
+  schemaLen: usize
 ): i32
 
 // ===== Public API Functions =====
@@ -26,10 +28,23 @@ declare function sk_register_resource_provider_ffi(
  * After calling this, the plugin must export the following handler functions:
  * - resources_list_resources(queryJson: string): string - List resources matching query
  * - resources_get_resource(requestJson: string): string - Get a single resource
- * - resources_set_resource(requestJson: string): void - Create/update a resource
- * - resources_delete_resource(requestJson: string): void - Delete a resource
+ * - resources_set_resource(requestJson: string): string - Create/update a resource
+ * - resources_delete_resource(requestJson: string): string - Delete a resource
+ *
+ * The set and delete handlers return an error message, which fails the
+ * request, or an empty string on success.
+ *
+ * Custom resource types can pass a JSON Schema. The server rejects
+ * resources that do not match it before resources_set_resource is called.
+ * Servers before WASM ABI version 2 ignore the schema.
+ * For checks a schema cannot express, also export
+ * resources_validate_resource(requestJson: string): string, returning an
+ * error message, or an empty string if the resource is valid.
  *
  * @param resourceType The type of resources to provide (e.g., "weather", "routes", "waypoints")
+ * @param schema JSON Schema for resources of a custom type, empty for none.
+ *   Not allowed for the Signal K resource types, which are validated against
+ *   the specification.
  * @returns true if registration succeeded, false otherwise
  *
  * @example
@@ -54,10 +69,20 @@ declare function sk_register_resource_provider_ffi(
  * }
  * ```
  */
-export function registerResourceProvider(resourceType: string): bool {
+export function registerResourceProvider(
+  resourceType: string,
+  schema: string = ''
+): bool {
   const buffer = String.UTF8.encode(resourceType)
   const ptr = changetype<usize>(buffer)
-  const result = sk_register_resource_provider_ffi(ptr, buffer.byteLength)
+  const schemaBuffer = String.UTF8.encode(schema)
+  const schemaPtr = changetype<usize>(schemaBuffer)
+  const result = sk_register_resource_provider_ffi(
+    ptr,
+    buffer.byteLength,
+    schemaPtr,
+    schemaBuffer.byteLength
+  )
   return result === 1
 }
 
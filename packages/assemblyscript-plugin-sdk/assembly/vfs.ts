@@ -0,0 +1,313 @@
+/**
+ * VFS file access for AssemblyScript plugins
+ *
+ * AssemblyScript has no filesystem API of its own, so these helpers call
+ * the WASI Preview 1 functions the server provides directly. Paths are
+ * relative to the plugin's VFS root, e.g. 'data/state.json'.
+ *
+ * Files are replaced atomically: new contents are written to a temporary
+ * file next to the target, flushed to disk and renamed over it, so after a
+ * power loss a file has either its old or its new contents, never part of
+ * them.
+ *
+ * @example
+ * ```typescript
+ * ensureDir('data')
+ * if (!writeFile('data/state.json', state.toJSON())) {
+ *   setError('Could not save state')
+ * }
+ * const saved = readFile('data/state.json')
+ * ```
+ */
+
+@external("wasi_snapshot_preview1", "path_open")
+declare function path_open(
+  fd: u32,
+  dirflags: u32,
+  pathPtr: usize,
+  pathLen: usize,
+  oflags: u32,
+  rightsBase: u64,
+  rightsInheriting: u64,
+  fdflags: u32,
+  openedFdPtr: usize
+): u32
+
+@external("wasi_snapshot_preview1", "path_create_directory")
+declare function path_create_directory(
+  fd: u32,
+  pathPtr: usize,
+  pathLen: usize
+): u32
+
+@external("wasi_snapshot_preview1", "path_rename")
+declare function path_rename(
+  fd: u32,
+  oldPathPtr: usize,
+  oldPathLen: usize,
+  newFd: u32,
+  newPathPtr: usize,
+  newPathLen: usize
+): u32
+
+@external("wasi_snapshot_preview1", "path_unlink_file")
+declare function path_unlink_file(
+  fd: u32,
+  pathPtr: usize,
+  pathLen: usize
+): u32
+
+@external("wasi_snapshot_preview1", "fd_read")
+declare function fd_read(
+  fd: u32,
+  iovsPtr: usize,
+  iovsLen: usize,
+  nreadPtr: usize
+): u32
+
+@external("wasi_snapshot_preview1", "fd_write")
+declare function fd_write(
+  fd: u32,
+  iovsPtr: usize,
+  iovsLen: usize,
+  nwrittenPtr: usize
+): u32
+
+@external("wasi_snapshot_preview1", "fd_sync")
+declare function fd_sync(fd: u32): u32
+
+@external("wasi_snapshot_preview1", "fd_close")
+declare function fd_close(fd: u32): u32
+
+// The plugin's VFS root is preopened as the first descriptor after stdio
+const VFS_ROOT_FD: u32 = 3
+const OFLAGS_CREAT: u32 = 1
+const OFLAGS_TRUNC: u32 = 8
+const RIGHTS_FD_READ: u64 = 1 << 1
+const RIGHTS_FD_SYNC: u64 = 1 << 4
+const RIGHTS_FD_WRITE: u64 = 1 << 6
+const ERRNO_EXIST: u32 = 20
+const READ_CHUNK: i32 = 4096
+
+// Suffix of the temporary file new contents are written to
+const TEMP_SUFFIX = '.tmp'
+
+function openFile(path: string, oflags: u32, rights: u64): i32 {
+  const pathBytes = String.UTF8.encode(path)
+  const fdOut = new Uint32Array(1)
+  const errno = path_open(
+    VFS_ROOT_FD,
+    0,
+    changetype<usize>(pathBytes),
+    pathBytes.byteLength,
+    oflags,
+    rights,
+    0,
+    0,
+    fdOut.dataStart
+  )
+  return errno === 0 ? i32(fdOut[0]) : -1
+}
+
+/**
+ * Write contents to the temporary file for path and flush it to disk
+ * @returns true if everything was written, otherwise the file is removed
+ */
+function writeTemp(path: string, contents: string): bool {
+  const tempPath = path + TEMP_SUFFIX
+  const fd = openFile(
+    tempPath,
+    OFLAGS_CREAT | OFLAGS_TRUNC,
+    RIGHTS_FD_WRITE | RIGHTS_FD_SYNC
+  )
+  if (fd < 0) {
+    return false
+  }
+
+  const data = String.UTF8.encode(contents)
+  const iov = new Uint32Array(2)
+  const nwritten = new Uint32Array(1)
+  let offset: i32 = 0
+  let ok = true
+  while (offset < data.byteLength) {
+    iov[0] = u32(changetype<usize>(data) + <usize>offset)
+    iov[1] = u32(data.byteLength - offset)
+    if (
+      fd_write(u32(fd), iov.dataStart, 1, nwritten.dataStart) !== 0 ||
+      nwritten[0] === 0
+    ) {
+      ok = false
+      break
+    }
+    offset += i32(nwritten[0])
+  }
+  if (ok && fd_sync(u32(fd)) !== 0) {
+    ok = false
+  }
+  fd_close(u32(fd))
+
+  if (!ok) {
+    removeFile(tempPath)
+  }
+  return ok
+}
+
+/**
+ * Replace path with its temporary file
+ */
+function commitTemp(path: string): bool {
+  const tempBytes = String.UTF8.encode(path + TEMP_SUFFIX)
+  const pathBytes = String.UTF8.encode(path)
+  return (
+    path_rename(
+      VFS_ROOT_FD,
+      changetype<usize>(tempBytes),
+      tempBytes.byteLength,
+      VFS_ROOT_FD,
+      changetype<usize>(pathBytes),
+      pathBytes.byteLength
+    ) === 0
+  )
+}
+
+/**
+ * Create a directory in the VFS, succeeding if it already exists
+ */
+export function ensureDir(path: string): bool {
+  const pathBytes = String.UTF8.encode(path)
+  const errno = path_create_directory(
+    VFS_ROOT_FD,
+    changetype<usize>(pathBytes),
+    pathBytes.byteLength
+  )
+  return errno === 0 || errno === ERRNO_EXIST
+}
+
+/**
+ * Read a whole file from the VFS
+ * @returns File contents, or null if it cannot be opened
+ */
+export function readFile(path: string): string | null {
+  const fd = openFile(path, 0, RIGHTS_FD_READ)
+  if (fd < 0) {
+    return null
+  }
+
+  const chunks: ArrayBuffer[] = []
+  let total: i32 = 0
+  const iov = new Uint32Array(2)
+  const nread = new Uint32Array(1)
+  while (true) {
+    const chunk = new ArrayBuffer(READ_CHUNK)
+    iov[0] = u32(changetype<usize>(chunk))
+    iov[1] = u32(READ_CHUNK)
+    if (fd_read(u32(fd), iov.dataStart, 1, nread.dataStart) !== 0) {
+      fd_close(u32(fd))
+      return null
+    }
+    const n = i32(nread[0])
+    if (n === 0) {
+      break
+    }
+    chunks.push(chunk.slice(0, n))
+    total += n
+  }
+  fd_close(u32(fd))
+
+  const bytes = new Uint8Array(total)
+  let offset: i32 = 0
+  for (let i = 0; i < chunks.length; i++) {
+    bytes.set(Uint8Array.wrap(chunks[i]), offset)
+    offset += chunks[i].byteLength
+  }
+  return String.UTF8.decode(bytes.buffer)
+}
+
+/**
+ * Atomically replace a file in the VFS with the given contents
+ * @returns true if the new contents were written; if not, the file is
+ *   left unchanged
+ */
+export function writeFile(path: string, contents: string): bool {
+  return writeTemp(path, contents) && commitTemp(path)
+}
+
+/**
+ * Remove a file from the VFS
+ * @returns true if the file was removed
+ */
+export function removeFile(path: string): bool {
+  const pathBytes = String.UTF8.encode(path)
+  return (
+    path_unlink_file(
+      VFS_ROOT_FD,
+      changetype<usize>(pathBytes),
+      pathBytes.byteLength
+    ) === 0
+  )
+}
+
+/**
+ * A set of files written together
+ *
+ * commit() writes every file to its temporary file first and only renames
+ * them once all were written, so a failed write, e.g. with the disk full,
+ * leaves all files unchanged. A power loss during the renames can still
+ * leave some files at their new and some at their old contents, each of
+ * them complete.
+ *
+ * @example
+ * ```typescript
+ * const batch = new VfsBatch()
+ * batch.write('data/charts.json', chartsJson)
+ * batch.write('data/groups.json', groupsJson)
+ * if (!batch.commit()) {
+ *   setError('Could not save the chart catalog')
+ * }
+ * ```
+ */
+export class VfsBatch {
+  private paths: string[] = []
+  private contents: string[] = []
+
+  /**
+   * Add a file to the batch, replacing an earlier write to the same path
+   */
+  write(path: string, contents: string): void {
+    const index = this.paths.indexOf(path)
+    if (index >= 0) {
+      this.contents[index] = contents
+    } else {
+      this.paths.push(path)
+      this.contents.push(contents)
+    }
+  }
+
+  /**
+   * Write all files of the batch and empty it
+   * @returns true if all files were replaced
+   */
+  commit(): bool {
+    const paths = this.paths
+    const contents = this.contents
+    this.paths = []
+    this.contents = []
+
+    for (let i = 0; i < paths.length; i++) {
+      if (!writeTemp(paths[i], contents[i])) {
+        for (let j = 0; j < i; j++) {
+          removeFile(paths[j] + TEMP_SUFFIX)
+        }
+        return false
+      }
+    }
+    let ok = true
+    for (let i = 0; i < paths.length; i++) {
+      if (!commitTemp(paths[i])) {
+        removeFile(paths[i] + TEMP_SUFFIX)
+        ok = false
+      }
+    }
+    return ok
+  }
+}
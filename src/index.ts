@@ -78,6 +78,7 @@ import helmet from 'helmet'
 const debug = createDebug('signalk-server')
 
 import { migrateSourceRef } from './sourceref-migration'
+import { endpointBodyLimitParser } from './wasm/loader/body-limits'
 import { StreamBundle } from './streambundle'
 
 /**
@@ -144,6 +145,8 @@ class Server {
         crossOriginResourcePolicy: false
       })
     )
+    // Smaller limits declared by WASM plugin endpoints come first
+    app.use(endpointBodyLimitParser)
     app.use(bodyParser.json({ limit: FILEUPLOADSIZELIMIT }))
     app.use(bodyParser.urlencoded({ extended: true }))
 
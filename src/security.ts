@@ -198,6 +198,7 @@ export interface SecurityStrategy {
     id: string,
     expiration: string
   ) => void
+  generatePluginToken: (pluginId: string, expiration: string) => string
 
   getUsers: (theConfig: SecurityConfig) => UserData[]
   addUser: (
@@ -241,6 +242,9 @@ export interface SecurityStrategy {
     permissions: RoutePermission[]
   ) => void
 
+  /** Forget the recorded access levels of a plugin's routes (optional - only available when token security is active) */
+  clearPluginRoutePermissions?: (pluginId: string) => void
+
   /** Update OIDC config in memory (optional - only available when token security is active) */
   updateOIDCConfig?: (newOidcConfig: PartialOIDCConfig) => void
 
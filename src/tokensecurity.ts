@@ -126,6 +126,7 @@ interface Principal {
 interface JWTPayload {
   id?: string
   device?: string
+  plugin?: string
   exp?: number
   iat?: number
   rememberMe?: boolean
@@ -238,6 +239,7 @@ function tokenSecurityFactory(
   const RESERVED_PLUGIN_PATHS = ['/', '/config']
 
   const pluginRoutePermissions: Array<{
+    pluginId: string
     method: string
     regex: RegExp
     permission: 'readwrite' | 'readonly'
@@ -256,6 +258,7 @@ function tokenSecurityFactory(
       }
       const fullPath = `/plugins/${pluginId}${normalizedPath}`
       pluginRoutePermissions.push({
+        pluginId,
         method: method.toUpperCase(),
         regex: pathToRegexp(fullPath),
         permission
@@ -263,6 +266,14 @@ function tokenSecurityFactory(
     }
   }
 
+  strategy.clearPluginRoutePermissions = function (pluginId: string): void {
+    for (let i = pluginRoutePermissions.length - 1; i >= 0; i--) {
+      if (pluginRoutePermissions[i].pluginId === pluginId) {
+        pluginRoutePermissions.splice(i, 1)
+      }
+    }
+  }
+
   const { expiration = 'NEVER' } = config
 
   let {
@@ -984,6 +995,17 @@ function tokenSecurityFactory(
     res.type('text/plain').send(token)
   }
 
+  strategy.generatePluginToken = function (
+    pluginId: string,
+    theExpiration: string
+  ): string {
+    const configuration = getConfiguration()
+    const payload: JWTPayload = { plugin: pluginId }
+    return jwt.sign(payload, configuration.secretKey, {
+      expiresIn: theExpiration as StringValue
+    })
+  }
+
   strategy.allowReadOnly = function (): boolean {
     const configuration = getConfiguration()
     return configuration.allow_readonly
@@ -1664,6 +1686,12 @@ function tokenSecurityFactory(
           permissions: device.permissions
         }
       }
+    } else if (payload.plugin) {
+      // Plugin tokens are minted by the server itself and are read-only
+      principal = {
+        identifier: `plugin:${payload.plugin}`,
+        permissions: 'readonly'
+      }
     }
     return principal
   }
@@ -0,0 +1,164 @@
+/* eslint-disable @typescript-eslint/no-explicit-any */
+/**
+ * Access Request FFI Bindings
+ *
+ * Lets WASM plugins drive the Signal K device access request flow, e.g. a
+ * plugin managing companion devices that needs to obtain a device token and
+ * report pairing status.
+ *
+ * Requests are created asynchronously by the security strategy, so the host
+ * tracks the latest reply per request and plugins poll it. Replies are
+ * forgotten once the plugin has read a completed one, or an hour after
+ * submission, when the server prunes the request itself.
+ */
+
+import Debug from 'debug'
+import { randomUUID } from 'crypto'
+import { requestAccess } from '../../security'
+import { Reply } from '../../requestResponse'
+import { WasmCapabilities } from '../types'
+
+const debug = Debug('signalk:wasm:access-requests')
+
+// Same as the pruning timeout of the server's request list
+const REPLY_TTL = 60 * 60 * 1000
+
+/**
+ * Create the sk_request_access and sk_get_access_request host bindings
+ *
+ * @param pluginId - Plugin identifier
+ * @param capabilities - Plugin capabilities
+ * @param app - SignalK application instance
+ * @param readUtf8String - Function to read UTF-8 strings from WASM memory
+ * @param writeUtf8String - Function to write UTF-8 strings into WASM memory
+ * @returns FFI binding functions
+ */
+export function createAccessRequestBindings(
+  pluginId: string,
+  capabilities: WasmCapabilities,
+  app: any,
+  readUtf8String: (ptr: number, len: number) => string,
+  writeUtf8String: (value: string, ptr: number, maxLen: number) => number
+) {
+  // Only requests submitted by this plugin are visible to it
+  const replies: Map<string, { reply: Partial<Reply>; submitted: number }> =
+    new Map()
+
+  const pruneReplies = () => {
+    const now = Date.now()
+    for (const [requestId, { submitted }] of replies) {
+      if (now - submitted > REPLY_TTL) {
+        debug(`[${pluginId}] Forgetting expired access request ${requestId}`)
+        replies.delete(requestId)
+      }
+    }
+  }
+
+  // Replies arriving after the request was forgotten are dropped
+  const updateReply = (requestId: string, reply: Partial<Reply>) => {
+    const entry = replies.get(requestId)
+    if (entry) {
+      entry.reply = reply
+    }
+  }
+
+  return {
+    /**
+     * Submit a device access request
+     * @param reqPtr - Pointer to request JSON: {"clientId", "description", "permissions"?}
+     * @param reqLen - Length of request JSON
+     * @param outPtr - Buffer to write the generated request ID into
+     * @param outMaxLen - Maximum buffer size
+     * @returns Length of request ID, or 0 on error
+     */
+    sk_request_access: (
+      reqPtr: number,
+      reqLen: number,
+      outPtr: number,
+      outMaxLen: number
+    ): number => {
+      try {
+        if (!capabilities.accessRequests) {
+          debug(`[${pluginId}] accessRequests capability not granted`)
+          return 0
+        }
+        if (!app?.securityStrategy || app.securityStrategy.isDummy()) {
+          debug(`[${pluginId}] Access requests require security to be enabled`)
+          return 0
+        }
+
+        const accessRequest = JSON.parse(readUtf8String(reqPtr, reqLen))
+        pruneReplies()
+        const requestId = randomUUID()
+        debug(
+          `[${pluginId}] Requesting access for clientId=${accessRequest.clientId}`
+        )
+
+        replies.set(requestId, {
+          reply: { requestId, state: 'PENDING', statusCode: 202 },
+          submitted: Date.now()
+        })
+        requestAccess(
+          app,
+          { requestId, accessRequest },
+          `plugin:${pluginId}`,
+          (reply: Reply) => updateReply(requestId, reply)
+        )
+          .then((reply: Reply) => updateReply(requestId, reply))
+          .catch((err: any) => {
+            debug(`[${pluginId}] Access request failed: ${err.message}`)
+            updateReply(requestId, {
+              requestId,
+              state: 'COMPLETED',
+              statusCode: err.statusCode || 500,
+              message: err.message
+            })
+          })
+
+        return writeUtf8String(requestId, outPtr, outMaxLen)
+      } catch (error) {
+        debug(`[${pluginId}] sk_request_access error: ${error}`)
+        return 0
+      }
+    },
+
+    /**
+     * Read the current state of an access request made by this plugin
+     * Once approved, the reply's accessRequest.token holds the device token.
+     * A completed reply can only be read once.
+     * @param idPtr - Pointer to request ID string
+     * @param idLen - Length of request ID
+     * @param outPtr - Buffer to write the reply JSON into
+     * @param outMaxLen - Maximum buffer size
+     * @returns Length of reply JSON, or 0 if unknown / buffer too small
+     */
+    sk_get_access_request: (
+      idPtr: number,
+      idLen: number,
+      outPtr: number,
+      outMaxLen: number
+    ): number => {
+      try {
+        const requestId = readUtf8String(idPtr, idLen)
+        pruneReplies()
+        const entry = replies.get(requestId)
+        if (!entry) {
+          debug(`[${pluginId}] Unknown access request: ${requestId}`)
+          return 0
+        }
+        const written = writeUtf8String(
+          JSON.stringify(entry.reply),
+          outPtr,
+          outMaxLen
+        )
+        if (written > 0 && entry.reply.state === 'COMPLETED') {
+          replies.delete(requestId)
+        }
+        return written
+      } catch (error) {
+        debug(`[${pluginId}] sk_get_access_request error: ${error}`)
+        return 0
+      }
+    }
+  }
+}
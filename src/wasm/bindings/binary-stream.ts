@@ -3,10 +3,12 @@
  * Binary Stream FFI Bindings
  *
  * Provides FFI bindings for WASM plugins to emit binary data streams
- * to connected WebSocket clients.
+ * to connected WebSocket clients, and binary messages to the server's
+ * NMEA outputs.
  */
 
 import Debug from 'debug'
+import { WasmCapabilities } from '../types'
 
 const debug = Debug('signalk:wasm:binary-stream')
 
@@ -93,3 +95,102 @@ export function createBinaryStreamBinding(
     }
   }
 }
+
+/**
+ * Format an NMEA 2000 frame from sk_handle_binary in the Actisense plain
+ * format accepted on nmea2000out:
+ * byte 0 priority, bytes 1-3 PGN (little endian), byte 4 destination,
+ * then the PGN data. The source address is left to the gateway.
+ */
+export function formatN2kFrame(data: Buffer, timestamp = new Date()): string {
+  if (data.length < 6) {
+    throw new Error(`NMEA 2000 frame too short: ${data.length} bytes`)
+  }
+  const priority = data[0]
+  const pgn = data.readUIntLE(1, 3)
+  const destination = data[4]
+  const payload = data.subarray(5)
+  if (priority > 7) {
+    throw new Error(`Invalid NMEA 2000 priority: ${priority}`)
+  }
+  if (payload.length > 223) {
+    throw new Error(`NMEA 2000 data too long: ${payload.length} bytes`)
+  }
+  const bytes = Array.from(payload, (b) => b.toString(16).padStart(2, '0'))
+  return [
+    timestamp.toISOString(),
+    priority,
+    pgn,
+    0,
+    destination,
+    payload.length,
+    ...bytes
+  ].join(',')
+}
+
+/**
+ * Create the sk_handle_binary host binding
+ *
+ * WASM plugins call this to send binary messages to the server's outputs
+ * without encoding them in a delta:
+ * - "nmea2000": a frame as described in formatN2kFrame, emitted on
+ *   nmea2000out for the NMEA 2000 connections to transmit
+ * - "nmea0183": the bytes of a sentence, emitted on nmea0183out
+ *
+ * @param pluginId - Plugin identifier
+ * @param capabilities - Plugin capabilities, requires dataWrite
+ * @param app - SignalK application instance
+ * @param readUtf8String - Function to read UTF-8 strings from WASM memory
+ * @param readBinaryData - Function to read binary data from WASM memory
+ * @returns FFI binding function
+ */
+export function createBinaryOutputBinding(
+  pluginId: string,
+  capabilities: WasmCapabilities,
+  app: any,
+  readUtf8String: (ptr: number, len: number) => string,
+  readBinaryData: (ptr: number, len: number) => Buffer
+): (
+  kindPtr: number,
+  kindLen: number,
+  dataPtr: number,
+  dataLen: number
+) => number {
+  return (
+    kindPtr: number,
+    kindLen: number,
+    dataPtr: number,
+    dataLen: number
+  ): number => {
+    if (!capabilities.dataWrite) {
+      debug(`[${pluginId}] sk_handle_binary requires the dataWrite capability`)
+      return 0
+    }
+    try {
+      const kind = readUtf8String(kindPtr, kindLen)
+      const data = readBinaryData(dataPtr, dataLen)
+      if (!app || typeof app.emit !== 'function') {
+        debug(`[${pluginId}] sk_handle_binary: app.emit not available`)
+        return 0
+      }
+
+      if (kind === 'nmea2000') {
+        const frame = formatN2kFrame(data)
+        debug(`[${pluginId}] nmea2000out: ${frame}`)
+        app.emit('nmea2000out', frame)
+        return 1
+      }
+      if (kind === 'nmea0183') {
+        const sentence = data.toString('ascii').replace(/[\r\n]+$/, '')
+        debug(`[${pluginId}] nmea0183out: ${sentence}`)
+        app.emit('nmea0183out', sentence)
+        return 1
+      }
+      debug(`[${pluginId}] sk_handle_binary: unknown kind "${kind}"`)
+      return 0
+    } catch (error) {
+      debug(`[${pluginId}] sk_handle_binary error: ${error}`)
+      return 0
+    }
+  }
+}
@@ -0,0 +1,78 @@
+/**
+ * Connectivity FFI Bindings
+ *
+ * Tells plugins whether the vessel has internet access, so they can pause
+ * remote syncs and fall back to cached data while offline. Reachability is
+ * probed in the background with a TCP connection. Whether a link is
+ * metered cannot be detected and is set with WASM_CONNECTIVITY instead.
+ */
+
+import Debug from 'debug'
+import * as net from 'net'
+
+const debug = Debug('signalk:wasm:connectivity')
+
+export const CONNECTIVITY_OFFLINE = 0
+export const CONNECTIVITY_METERED = 1
+export const CONNECTIVITY_ONLINE = 2
+
+// Host probed for reachability, one the app store needs as well
+const PROBE_HOST = 'registry.npmjs.org'
+const PROBE_PORT = 443
+const PROBE_TIMEOUT = 5000
+
+// Probe at most once a minute, as plugins may ask on every poll()
+const PROBE_INTERVAL = 60000
+
+// Assume online until a probe says otherwise
+let reachable = true
+let lastProbe = 0
+let probing = false
+
+function probe(): void {
+  probing = true
+  lastProbe = Date.now()
+  const socket = net.connect({
+    host: PROBE_HOST,
+    port: PROBE_PORT,
+    timeout: PROBE_TIMEOUT
+  })
+  const done = (result: boolean) => {
+    socket.destroy()
+    if (!probing) {
+      return
+    }
+    probing = false
+    if (result !== reachable) {
+      debug(`Internet is ${result ? 'reachable' : 'unreachable'}`)
+    }
+    reachable = result
+  }
+  socket.once('connect', () => done(true))
+  socket.once('timeout', () => done(false))
+  socket.once('error', () => done(false))
+}
+
+/**
+ * Get the connectivity level reported by sk_get_connectivity, probing
+ * again in the background when the last result is stale.
+ *
+ * WASM_CONNECTIVITY=offline or online overrides the probe, metered marks
+ * a reachable link as metered.
+ */
+export function getConnectivity(): number {
+  const configured = process.env.WASM_CONNECTIVITY
+  if (configured === 'offline') {
+    return CONNECTIVITY_OFFLINE
+  }
+  if (configured === 'online') {
+    return CONNECTIVITY_ONLINE
+  }
+  if (!probing && Date.now() - lastProbe > PROBE_INTERVAL) {
+    probe()
+  }
+  if (!reachable) {
+    return CONNECTIVITY_OFFLINE
+  }
+  return configured === 'metered' ? CONNECTIVITY_METERED : CONNECTIVITY_ONLINE
+}
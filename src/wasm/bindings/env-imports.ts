@@ -16,16 +16,88 @@ import {
   createRadarEmitSpokesBinding
 } from './radar-provider'
 import {
+  createBinaryOutputBinding,
   createBinaryStreamBinding,
   createBinaryDataReader
 } from './binary-stream'
 import { socketManager, tcpSocketManager } from './socket-manager'
+import { createAccessRequestBindings } from './access-requests'
+import { createResourceQueryBindings } from './resource-queries'
+import { createSqliteBindings } from './sqlite'
+import { createLockBindings } from './locks'
+import { getConnectivity } from './connectivity'
+import { createWebappRegistrationBinding } from './webapp-registration'
 import * as fs from 'fs'
 import * as path from 'path'
+import { randomFillSync } from 'crypto'
 import { atomicWriteFileSync } from '../../atomicWrite'
+import { getActivePreset } from '../../unitpreferences'
 
 const debug = Debug('signalk:wasm:bindings')
 
+// Plugins are expected to fetch a fresh token rather than cache one long-term
+const PLUGIN_TOKEN_EXPIRATION = '1h'
+
+/**
+ * Server settings readable with sk_get_setting. Limited to what plugins
+ * need to follow display preferences and identify the vessel.
+ */
+const READABLE_SETTINGS = new Map<string, (app: any) => unknown>([
+  ['vessel.name', (app) => app.config.vesselName],
+  ['vessel.mmsi', (app) => app.config.vesselMMSI],
+  ['vessel.uuid', (app) => app.config.vesselUUID],
+  ['server.version', (app) => app.config.version],
+  ['server.hostname', (app) => app.config.getExternalHostname()],
+  ['server.port', (app) => app.config.getExternalPort()],
+  ['server.ssl', (app) => app.config.isExternalSsl()],
+  ['units.preset', () => getActivePreset()]
+])
+
+/**
+ * Heap usage reported by a plugin's own runtime, in bytes
+ */
+export interface ReportedMemory {
+  heapInUse: number
+  heapPeak: number
+}
+
+/**
+ * Heap usage last reported by each plugin with sk_report_memory. The size
+ * of a plugin's linear memory only ever grows, so it overstates what a
+ * garbage-collected plugin actually uses.
+ */
+const reportedMemory = new Map<string, ReportedMemory>()
+
+/**
+ * Get the heap usage a plugin last reported, if any
+ */
+export function getReportedMemory(
+  pluginId: string
+): ReportedMemory | undefined {
+  return reportedMemory.get(pluginId)
+}
+
+/**
+ * Forget a plugin's reported heap usage, e.g. when it stops
+ */
+export function clearReportedMemory(pluginId: string): void {
+  reportedMemory.delete(pluginId)
+}
+
+/**
+ * Version of the host import ABI provided by this server. Bump it when
+ * sk_* imports are added or take new parameters, so plugins built against
+ * newer servers can detect an older host via sk_abi_version /
+ * plugin_abi_version, and list the changes here and in the Go plugin guide.
+ *
+ * 1: sk_abi_version and the imports that preceded it
+ * 2: sk_register_webapp, sk_get_setting, sk_sqlite_*, sk_report_memory,
+ *    sk_handle_binary, sk_lock_acquire, sk_lock_release and
+ *    sk_get_connectivity, and the schema parameters of
+ *    sk_register_resource_provider
+ */
+export const WASM_ABI_VERSION = 2
+
 /**
  * Options for creating environment imports
  */
@@ -38,6 +110,7 @@ export interface EnvImportsOptions {
   asLoaderInstance: { current: any }
   configPath?: string
   packageName?: string
+  vfsRoot?: string
 }
 
 /**
@@ -56,6 +129,26 @@ export function createUtf8Reader(memoryRef: {
   }
 }
 
+/**
+ * Helper to write UTF-8 strings into a plugin-provided WASM buffer
+ * Returns the number of bytes written, or 0 if the buffer is too small
+ */
+export function createUtf8Writer(memoryRef: {
+  current: WebAssembly.Memory | null
+}) {
+  return (value: string, bufPtr: number, bufMaxLen: number): number => {
+    if (!memoryRef.current) {
+      throw new Error('WASM module memory not initialized')
+    }
+    const bytes = Buffer.from(value, 'utf8')
+    if (bytes.length > bufMaxLen) {
+      return 0
+    }
+    new Uint8Array(memoryRef.current.buffer).set(bytes, bufPtr)
+    return bytes.length
+  }
+}
+
 /**
  * Create environment imports for a WASM plugin
  */
@@ -70,10 +163,12 @@ export function createEnvImports(
     rawExports,
     asLoaderInstance,
     configPath,
-    packageName: _packageName
+    packageName: _packageName,
+    vfsRoot
   } = options
 
   const readUtf8String = createUtf8Reader(memoryRef)
+  const writeUtf8String = createUtf8Writer(memoryRef)
   const readBinaryData = createBinaryDataReader(memoryRef)
 
   const envImports: Record<string, any> = {
@@ -115,6 +210,27 @@ export function createEnvImports(
       }
     },
 
+    /**
+     * Host import ABI version
+     * @returns The ABI version implemented by this server
+     */
+    sk_abi_version: (): number => WASM_ABI_VERSION,
+
+    /**
+     * Report heap usage measured by the plugin's own runtime
+     * @param heapInUse - Bytes currently allocated on the heap
+     * @param heapPeak - Highest heapInUse seen since the plugin started
+     */
+    sk_report_memory: (heapInUse: number, heapPeak: number): void => {
+      if (!Number.isFinite(heapInUse) || !Number.isFinite(heapPeak)) {
+        return
+      }
+      reportedMemory.set(pluginId, {
+        heapInUse,
+        heapPeak: Math.max(heapPeak, heapInUse)
+      })
+    },
+
     sk_set_error: (ptr: number, len: number) => {
       try {
         const message = readUtf8String(ptr, len)
@@ -127,6 +243,117 @@ export function createEnvImports(
       }
     },
 
+    // ==========================================================================
+    // Host Clock and Randomness API
+    // WASI time and random support varies between toolchains (notably TinyGo),
+    // so plugins can read both from the host instead
+    // ==========================================================================
+
+    /**
+     * Wall-clock time
+     * @returns Milliseconds since the Unix epoch (f64)
+     */
+    sk_now_ms: (): number => {
+      return Date.now()
+    },
+
+    /**
+     * Monotonic time for measuring intervals, unaffected by clock adjustments
+     * @returns Milliseconds since server process start (f64, sub-ms precision)
+     */
+    sk_monotonic_ms: (): number => {
+      return performance.now()
+    },
+
+    /**
+     * Fill a buffer with cryptographically secure random bytes
+     * @param bufPtr - Buffer to fill
+     * @param bufLen - Number of bytes to write
+     * @returns Number of bytes written, or -1 on error
+     */
+    sk_random_bytes: (bufPtr: number, bufLen: number): number => {
+      try {
+        if (!memoryRef.current) return -1
+        randomFillSync(new Uint8Array(memoryRef.current.buffer, bufPtr, bufLen))
+        return bufLen
+      } catch (error) {
+        debug(`[${pluginId}] sk_random_bytes error: ${error}`)
+        return -1
+      }
+    },
+
+    /**
+     * Get a read-only token for requests to the server's own REST API
+     * Needed when security is enabled, e.g. to read resources owned by other
+     * providers from /signalk/v2/api/resources.
+     * @param bufPtr - Buffer to write the JWT into
+     * @param bufMaxLen - Maximum buffer size
+     * @returns Length of token, or 0 if security is disabled / not permitted
+     */
+    sk_get_server_token: (bufPtr: number, bufMaxLen: number): number => {
+      try {
+        if (!capabilities.dataRead) {
+          debug(`[${pluginId}] dataRead capability not granted`)
+          return 0
+        }
+        if (!app?.securityStrategy || app.securityStrategy.isDummy()) {
+          return 0
+        }
+        const token = app.securityStrategy.generatePluginToken(
+          pluginId,
+          PLUGIN_TOKEN_EXPIRATION
+        )
+        return writeUtf8String(token, bufPtr, bufMaxLen)
+      } catch (error) {
+        debug(`[${pluginId}] sk_get_server_token error: ${error}`)
+        return 0
+      }
+    },
+
+    /**
+     * Read a whitelisted server setting, e.g. vessel.mmsi or units.preset
+     * @param keyPtr - Pointer to setting key
+     * @param keyLen - Length of setting key
+     * @param bufPtr - Buffer to write the JSON value into
+     * @param bufMaxLen - Maximum buffer size
+     * @returns Length of JSON value, or 0 if unknown / unset / buffer too small
+     */
+    sk_get_setting: (
+      keyPtr: number,
+      keyLen: number,
+      bufPtr: number,
+      bufMaxLen: number
+    ): number => {
+      try {
+        if (!capabilities.dataRead) {
+          debug(`[${pluginId}] dataRead capability not granted`)
+          return 0
+        }
+        const key = readUtf8String(keyPtr, keyLen)
+        const readSetting = READABLE_SETTINGS.get(key)
+        if (!readSetting || !app?.config) {
+          debug(`[${pluginId}] Setting not readable: ${key}`)
+          return 0
+        }
+        const value = readSetting(app)
+        if (value === undefined || value === null) {
+          return 0
+        }
+        return writeUtf8String(JSON.stringify(value), bufPtr, bufMaxLen)
+      } catch (error) {
+        debug(`[${pluginId}] sk_get_setting error: ${error}`)
+        return 0
+      }
+    },
+
+    /**
+     * Whether the vessel has internet access, e.g. to pause remote syncs
+     * @returns 0 = offline, 1 = online over a metered link, 2 = online
+     */
+    sk_get_connectivity: (): number => {
+      return getConnectivity()
+    },
+
     // Get value from vessels.self path
     sk_get_self_path: (
       pathPtr: number,
@@ -416,13 +643,16 @@ export function createEnvImports(
       try {
         const capability = readUtf8String(capPtr, capLen)
         debug(`[${pluginId}] Checking capability: ${capability}`)
-        if (capability === 'network') {
-          return capabilities.network ? 1 : 0
+        // Host function names let plugins detect optional imports on
+        // older servers before calling them
+        if (capability.startsWith('sk_')) {
+          return capability in envImports ? 1 : 0
         }
-        if (capability === 'rawSockets') {
-          return capabilities.rawSockets ? 1 : 0
+        if (capability === 'storage') {
+          return capabilities.storage !== 'none' ? 1 : 0
         }
-        return 0
+        const granted = capabilities[capability as keyof WasmCapabilities]
+        return granted === true ? 1 : 0
       } catch (error) {
         debug(`Plugin capability check error: ${error}`)
         return 0
@@ -596,6 +826,44 @@ export function createEnvImports(
       readUtf8String
     ),
 
+    // Webapp Registration (list plugin-served UIs in the admin UI)
+    sk_register_webapp: createWebappRegistrationBinding(
+      pluginId,
+      capabilities,
+      app,
+      readUtf8String
+    ),
+
+    // Resource Queries (read resources from all providers)
+    ...createResourceQueryBindings(
+      pluginId,
+      capabilities,
+      app,
+      readUtf8String,
+      writeUtf8String
+    ),
+
+    // Access Requests (device pairing)
+    ...createAccessRequestBindings(
+      pluginId,
+      capabilities,
+      app,
+      readUtf8String,
+      writeUtf8String
+    ),
+
+    // SQLite (read-only databases in the plugin's VFS, e.g. MBTiles)
+    ...createSqliteBindings(
+      pluginId,
+      capabilities,
+      vfsRoot,
+      readUtf8String,
+      writeUtf8String
+    ),
+
+    // Named locks shared by all plugins
+    ...createLockBindings(pluginId, readUtf8String),
+
     // ==========================================================================
     // Binary Stream API (for high-frequency data streaming)
     // ==========================================================================
@@ -616,6 +884,22 @@ export function createEnvImports(
       readBinaryData
     ),
 
+    /**
+     * Send a binary message to the server's outputs
+     * @param kindPtr - Pointer to message kind: "nmea2000" or "nmea0183"
+     * @param kindLen - Length of message kind
+     * @param dataPtr - Pointer to message bytes
+     * @param dataLen - Length of message bytes
+     * @returns 1 on success, 0 on failure
+     */
+    sk_handle_binary: createBinaryOutputBinding(
+      pluginId,
+      capabilities,
+      app,
+      readUtf8String,
+      readBinaryData
+    ),
+
     /**
      * Emit radar spoke data
      * Convenience wrapper for radar providers
@@ -0,0 +1,113 @@
+/**
+ * Named Lock FFI Bindings
+ *
+ * Lets cooperating plugins take turns with something they share, such as
+ * a device on the network or a file another plugin also writes. Plugins
+ * run one call at a time on the server's event loop, so a lock is never
+ * waited for: sk_lock_acquire returns at once and the plugin tries again
+ * later, for example from its next poll().
+ *
+ * A lock is held until its owner releases it or stops.
+ */
+
+import Debug from 'debug'
+
+const debug = Debug('signalk:wasm:locks')
+
+// Longer names are rejected so they cannot grow the lock table unbounded
+const MAX_LOCK_NAME_LENGTH = 256
+
+// Lock name -> id of the plugin holding it
+const locks: Map<string, string> = new Map()
+
+/**
+ * Release all locks held by a plugin, e.g. when it stops
+ */
+export function releaseAllLocksForPlugin(pluginId: string): void {
+  const toRelease: string[] = []
+  for (const [name, owner] of locks) {
+    if (owner === pluginId) {
+      toRelease.push(name)
+    }
+  }
+  for (const name of toRelease) {
+    locks.delete(name)
+  }
+  if (toRelease.length > 0) {
+    debug(`[${pluginId}] Released ${toRelease.length} locks`)
+  }
+}
+
+/**
+ * Create the sk_lock_* host bindings
+ *
+ * @param pluginId - Plugin identifier
+ * @param readUtf8String - Function to read UTF-8 strings from WASM memory
+ * @returns FFI binding functions
+ */
+export function createLockBindings(
+  pluginId: string,
+  readUtf8String: (ptr: number, len: number) => string
+) {
+  const readName = (namePtr: number, nameLen: number): string | undefined => {
+    const name = readUtf8String(namePtr, nameLen)
+    if (name.length === 0 || name.length > MAX_LOCK_NAME_LENGTH) {
+      debug(`[${pluginId}] Invalid lock name`)
+      return undefined
+    }
+    return name
+  }
+
+  return {
+    /**
+     * Take a named lock without waiting
+     * @param namePtr - Pointer to lock name, shared by all plugins
+     * @param nameLen - Length of lock name
+     * @returns 1 if the plugin now holds the lock, also when it already
+     *   did, 0 if another plugin holds it, -1 on error
+     */
+    sk_lock_acquire: (namePtr: number, nameLen: number): number => {
+      try {
+        const name = readName(namePtr, nameLen)
+        if (name === undefined) {
+          return -1
+        }
+        const owner = locks.get(name)
+        if (owner === undefined) {
+          locks.set(name, pluginId)
+          debug(`[${pluginId}] Acquired lock ${name}`)
+          return 1
+        }
+        return owner === pluginId ? 1 : 0
+      } catch (error) {
+        debug(`[${pluginId}] sk_lock_acquire error: ${error}`)
+        return -1
+      }
+    },
+
+    /**
+     * Release a named lock held by the plugin
+     * @param namePtr - Pointer to lock name
+     * @param nameLen - Length of lock name
+     * @returns 1 if the lock was released, 0 if the plugin did not hold
+     *   it, -1 on error
+     */
+    sk_lock_release: (namePtr: number, nameLen: number): number => {
+      try {
+        const name = readName(namePtr, nameLen)
+        if (name === undefined) {
+          return -1
+        }
+        if (locks.get(name) !== pluginId) {
+          return 0
+        }
+        locks.delete(name)
+        debug(`[${pluginId}] Released lock ${name}`)
+        return 1
+      } catch (error) {
+        debug(`[${pluginId}] sk_lock_release error: ${error}`)
+        return -1
+      }
+    }
+  }
+}
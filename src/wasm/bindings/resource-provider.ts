@@ -5,7 +5,9 @@
  * Handles resource provider registration and handler invocation for WASM plugins
  */
 
+import Ajv from 'ajv'
 import Debug from 'debug'
+import { isSignalKResourceType } from '@signalk/server-api'
 import { WasmResourceProvider, WasmPluginInstance } from '../types'
 
 const debug = Debug('signalk:wasm:resource-provider')
@@ -87,6 +89,33 @@ export function callWasmResourceHandler(
   }
 }
 
+/**
+ * Check whether a plugin exports an optional resource handler
+ */
+function hasResourceHandler(
+  pluginInstance: WasmPluginInstance,
+  handlerName: string
+): boolean {
+  const exports = pluginInstance.asLoader
+    ? pluginInstance.asLoader.exports
+    : (pluginInstance.instance?.exports as any)
+  return typeof exports?.[handlerName] === 'function'
+}
+
+/**
+ * Compile the JSON Schema a plugin registered for a custom resource type
+ * @returns Function returning an error message for invalid resources
+ * @throws If the schema is not valid JSON or not a valid JSON Schema
+ */
+function compileResourceSchema(
+  schemaJson: string
+): (value: object) => string | null {
+  const ajv = new Ajv({ allErrors: true })
+  const validate = ajv.compile(JSON.parse(schemaJson))
+  return (value: object) =>
+    validate(value) ? null : ajv.errorsText(validate.errors)
+}
+
 /**
  * Update resource provider references with a newly loaded plugin instance
  */
@@ -138,14 +167,28 @@ export function cleanupResourceProviders(pluginId: string, app?: any): void {
 
 /**
  * Create the sk_register_resource_provider host binding
+ *
+ * Custom resource types may pass a JSON Schema that resources must match
+ * before they are stored. Built-in types are validated against the
+ * Signal K specification and take no schema.
  */
 export function createResourceProviderBinding(
   pluginId: string,
   capabilities: { resourceProvider?: boolean },
   app: any,
   readUtf8String: (ptr: number, len: number) => string
-): (typePtr: number, typeLen: number) => number {
-  return (typePtr: number, typeLen: number): number => {
+): (
+  typePtr: number,
+  typeLen: number,
+  schemaPtr?: number,
+  schemaLen?: number
+) => number {
+  return (
+    typePtr: number,
+    typeLen: number,
+    schemaPtr: number = 0,
+    schemaLen: number = 0
+  ): number => {
     try {
       const resourceType = readUtf8String(typePtr, typeLen)
       debug(
@@ -164,11 +207,25 @@ export function createResourceProviderBinding(
         return 0
       }
 
+      let validateSchema: ((value: object) => string | null) | undefined
+      if (schemaLen > 0) {
+        if (isSignalKResourceType(resourceType)) {
+          debug(
+            `[${pluginId}] ${resourceType} is a Signal K resource type, custom schemas are not allowed`
+          )
+          return 0
+        }
+        validateSchema = compileResourceSchema(
+          readUtf8String(schemaPtr, schemaLen)
+        )
+      }
+
       // Store the registration (we'll update the pluginInstance reference after instance creation)
       const key = `${pluginId}:${resourceType}`
       wasmResourceProviders.set(key, {
         pluginId,
         resourceType,
+        validateSchema,
         pluginInstance: null // Will be set after full instance creation
       })
 
@@ -207,7 +264,19 @@ export function createResourceProviderBinding(
             'resources_get_resource',
             requestJson
           )
-          return result ? JSON.parse(result) : {}
+          const resource = result ? JSON.parse(result) : {}
+          // Reject unknown ids: ResourcesApi treats any fulfilled lookup as
+          // ownership and would route writes for that id to this plugin.
+          // Answers that are not objects, such as null, are no resource.
+          if (
+            typeof resource !== 'object' ||
+            resource === null ||
+            Object.keys(resource).length === 0 ||
+            resource.error
+          ) {
+            throw new Error(resource?.error || `Resource not found (${id})`)
+          }
+          return resource
         },
         setResource: async (
           id: string,
@@ -221,11 +290,41 @@ export function createResourceProviderBinding(
 
           // Include resourceType so WASM knows which storage to update
           const requestJson = JSON.stringify({ id, value, resourceType })
-          callWasmResourceHandler(
+
+          // Reject the resource before the plugin stores it, first against
+          // the registered schema, then with the plugin's own checks
+          let invalid = provider.validateSchema?.(value) || null
+          if (
+            !invalid &&
+            hasResourceHandler(
+              provider.pluginInstance,
+              'resources_validate_resource'
+            )
+          ) {
+            invalid =
+              callWasmResourceHandler(
+                provider.pluginInstance,
+                'resources_validate_resource',
+                requestJson
+              ) || null
+          }
+          if (invalid) {
+            debug(`[${pluginId}] Invalid ${resourceType} ${id}: ${invalid}`)
+            throw new Error(`Invalid ${resourceType} resource: ${invalid}`)
+          }
+
+          // Handlers return an error message, or an empty string on success
+          const error = callWasmResourceHandler(
             provider.pluginInstance,
             'resources_set_resource',
             requestJson
           )
+          if (error) {
+            debug(
+              `[${pluginId}] Failed to store ${resourceType} ${id}: ${error}`
+            )
+            throw new Error(error)
+          }
         },
         deleteResource: async (id: string): Promise<void> => {
           const provider = wasmResourceProviders.get(key)
@@ -236,11 +335,17 @@ export function createResourceProviderBinding(
 
           // Include resourceType so WASM knows which storage to delete from
           const requestJson = JSON.stringify({ id, resourceType })
-          callWasmResourceHandler(
+          const error = callWasmResourceHandler(
             provider.pluginInstance,
             'resources_delete_resource',
             requestJson
           )
+          if (error) {
+            debug(
+              `[${pluginId}] Failed to delete ${resourceType} ${id}: ${error}`
+            )
+            throw new Error(error)
+          }
         }
       }
 
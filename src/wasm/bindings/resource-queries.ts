@@ -0,0 +1,160 @@
+/* eslint-disable @typescript-eslint/no-explicit-any */
+/**
+ * Resource Query FFI Bindings
+ *
+ * Lets WASM plugins read resources served by all registered providers,
+ * e.g. a chart provider checking whether another provider already exposes
+ * a chart with the same identifier before registering its own.
+ *
+ * ResourcesApi queries are asynchronous, so the host runs the query and
+ * stores the result for the plugin to poll. Results the plugin does not
+ * collect are discarded when it stops.
+ */
+
+import Debug from 'debug'
+
+const debug = Debug('signalk:wasm:resource-queries')
+
+type QueryResult =
+  | { state: 'PENDING' }
+  | { state: 'COMPLETED'; resources: { [id: string]: any } }
+  | { state: 'FAILED'; message: string }
+
+// Query results by plugin, then by query ID
+const pluginQueries: Map<string, Map<number, QueryResult>> = new Map()
+let nextQueryId = 1
+
+/**
+ * Discard the uncollected query results of a plugin, e.g. when it stops
+ */
+export function clearResourceQueriesForPlugin(pluginId: string): void {
+  const queries = pluginQueries.get(pluginId)
+  if (queries && queries.size > 0) {
+    debug(`[${pluginId}] Discarded ${queries.size} resource query results`)
+  }
+  pluginQueries.delete(pluginId)
+}
+
+/**
+ * Create the sk_list_resources and sk_get_resource_list host bindings
+ *
+ * @param pluginId - Plugin identifier
+ * @param capabilities - Plugin capabilities
+ * @param app - SignalK application instance
+ * @param readUtf8String - Function to read UTF-8 strings from WASM memory
+ * @param writeUtf8String - Function to write UTF-8 strings into WASM memory
+ * @returns FFI binding functions
+ */
+export function createResourceQueryBindings(
+  pluginId: string,
+  capabilities: { dataRead: boolean },
+  app: any,
+  readUtf8String: (ptr: number, len: number) => string,
+  writeUtf8String: (value: string, ptr: number, maxLen: number) => number
+) {
+  const getQueries = () => {
+    let queries = pluginQueries.get(pluginId)
+    if (!queries) {
+      queries = new Map()
+      pluginQueries.set(pluginId, queries)
+    }
+    return queries
+  }
+
+  // Results of queries discarded in the meantime are dropped
+  const settle = (queryId: number, result: QueryResult) => {
+    const queries = pluginQueries.get(pluginId)
+    if (queries?.has(queryId)) {
+      queries.set(queryId, result)
+    }
+  }
+
+  return {
+    /**
+     * Start listing resources of a type across all providers
+     * @param typePtr - Pointer to resource type string (e.g. "charts")
+     * @param typeLen - Length of resource type string
+     * @param queryPtr - Pointer to query parameters JSON (may be empty)
+     * @param queryLen - Length of query parameters JSON
+     * @returns Query ID to poll with sk_get_resource_list, or 0 on error
+     */
+    sk_list_resources: (
+      typePtr: number,
+      typeLen: number,
+      queryPtr: number,
+      queryLen: number
+    ): number => {
+      try {
+        if (!capabilities.dataRead) {
+          debug(`[${pluginId}] dataRead capability not granted`)
+          return 0
+        }
+        if (!app?.resourcesApi) {
+          debug(`[${pluginId}] app.resourcesApi not available`)
+          return 0
+        }
+
+        const resourceType = readUtf8String(typePtr, typeLen)
+        const params =
+          queryLen > 0 ? JSON.parse(readUtf8String(queryPtr, queryLen)) : {}
+        const queryId = nextQueryId++
+        debug(
+          `[${pluginId}] Listing ${resourceType} resources (query ${queryId})`
+        )
+
+        getQueries().set(queryId, { state: 'PENDING' })
+        app.resourcesApi
+          .listResources(resourceType, params)
+          .then((resources: { [id: string]: any }) =>
+            settle(queryId, { state: 'COMPLETED', resources })
+          )
+          .catch((err: any) => {
+            debug(
+              `[${pluginId}] Resource query ${queryId} failed: ${err.message}`
+            )
+            settle(queryId, { state: 'FAILED', message: err.message })
+          })
+
+        return queryId
+      } catch (error) {
+        debug(`[${pluginId}] sk_list_resources error: ${error}`)
+        return 0
+      }
+    },
+
+    /**
+     * Read the result of a resource query started by this plugin
+     * Completed and failed results are discarded once delivered.
+     * @param queryId - Query ID returned by sk_list_resources
+     * @param outPtr - Buffer to write the result JSON into
+     * @param outMaxLen - Maximum buffer size
+     * @returns Length of result JSON, or 0 if unknown / buffer too small
+     */
+    sk_get_resource_list: (
+      queryId: number,
+      outPtr: number,
+      outMaxLen: number
+    ): number => {
+      try {
+        const queries = getQueries()
+        const result = queries.get(queryId)
+        if (!result) {
+          debug(`[${pluginId}] Unknown resource query: ${queryId}`)
+          return 0
+        }
+        const written = writeUtf8String(
+          JSON.stringify(result),
+          outPtr,
+          outMaxLen
+        )
+        if (written > 0 && result.state !== 'PENDING') {
+          queries.delete(queryId)
+        }
+        return written
+      } catch (error) {
+        debug(`[${pluginId}] sk_get_resource_list error: ${error}`)
+        return 0
+      }
+    }
+  }
+}
@@ -0,0 +1,319 @@
+/* eslint-disable @typescript-eslint/no-explicit-any */
+/**
+ * SQLite FFI Bindings
+ *
+ * SQLite cannot be compiled into most WASM plugins, so the host opens
+ * databases in the plugin's VFS with Node's built-in node:sqlite module
+ * and streams query results row by row, e.g. tiles from an MBTiles file.
+ *
+ * Databases are opened read-only and cannot attach others. Queries run
+ * synchronously; prefer indexed lookups over large scans.
+ */
+
+import Debug from 'debug'
+import * as fs from 'fs'
+import * as path from 'path'
+
+const debug = Debug('signalk:wasm:sqlite')
+
+// Limit per plugin so a leaking plugin cannot exhaust file descriptors
+const MAX_DATABASES_PER_PLUGIN = 8
+
+// ATTACH opens databases outside the VFS and VACUUM INTO writes files
+// anywhere, even on a read-only connection. node:sqlite has no authorizer
+// before Node 24, so statements mentioning either keyword are refused.
+const FORBIDDEN_SQL = /\b(ATTACH|VACUUM)\b/i
+
+interface OpenDatabase {
+  pluginId: string
+  db: any
+}
+
+interface OpenQuery {
+  pluginId: string
+  dbHandle: number
+  rows: Iterator<Record<string, unknown>>
+  // Row that did not fit the plugin's buffer, returned by the next call
+  pending?: string
+}
+
+const databases: Map<number, OpenDatabase> = new Map()
+const queries: Map<number, OpenQuery> = new Map()
+let nextHandle = 1
+
+let DatabaseSync: any = undefined
+
+/**
+ * Load node:sqlite on first use, it is not available on all Node versions
+ */
+function getDatabaseSync(): any {
+  if (DatabaseSync === undefined) {
+    try {
+      DatabaseSync = require('node:sqlite').DatabaseSync
+    } catch (error) {
+      debug(`node:sqlite not available: ${error}`)
+      DatabaseSync = null
+    }
+  }
+  return DatabaseSync
+}
+
+/**
+ * Resolve a plugin path inside its VFS root, following symlinks
+ * @returns Absolute path, or undefined if it points outside the VFS
+ * @throws If the path does not exist
+ */
+function resolveVfsPath(
+  vfsRoot: string,
+  vfsPath: string
+): string | undefined {
+  const root = fs.realpathSync(vfsRoot)
+  const resolved = fs.realpathSync(
+    path.resolve(root, vfsPath.replace(/^\/+/, ''))
+  )
+  if (resolved !== root && !resolved.startsWith(root + path.sep)) {
+    return undefined
+  }
+  return resolved
+}
+
+// BLOB columns, e.g. MBTiles tile_data, are returned base64 encoded
+function encodeValue(_key: string, value: unknown): unknown {
+  if (value instanceof Uint8Array) {
+    return Buffer.from(value).toString('base64')
+  }
+  if (typeof value === 'bigint') {
+    return Number(value)
+  }
+  return value
+}
+
+function finalizeQuery(queryId: number): void {
+  const query = queries.get(queryId)
+  if (query) {
+    query.rows.return?.()
+    queries.delete(queryId)
+  }
+}
+
+function closeDatabase(handle: number): void {
+  const open = databases.get(handle)
+  if (!open) {
+    return
+  }
+  for (const [queryId, query] of queries) {
+    if (query.dbHandle === handle) {
+      finalizeQuery(queryId)
+    }
+  }
+  try {
+    open.db.close()
+  } catch (error) {
+    debug(`[${open.pluginId}] Error closing database ${handle}: ${error}`)
+  }
+  databases.delete(handle)
+}
+
+/**
+ * Close all databases opened by a plugin, e.g. when it stops
+ */
+export function closeAllSqliteForPlugin(pluginId: string): void {
+  const toClose: number[] = []
+  for (const [handle, open] of databases) {
+    if (open.pluginId === pluginId) {
+      toClose.push(handle)
+    }
+  }
+  for (const handle of toClose) {
+    closeDatabase(handle)
+  }
+  if (toClose.length > 0) {
+    debug(`[${pluginId}] Closed ${toClose.length} SQLite databases`)
+  }
+}
+
+/**
+ * Create the sk_sqlite_* host bindings
+ *
+ * @param pluginId - Plugin identifier
+ * @param capabilities - Plugin capabilities
+ * @param vfsRoot - Plugin VFS root directory, databases must be inside it
+ * @param readUtf8String - Function to read UTF-8 strings from WASM memory
+ * @param writeUtf8String - Function to write UTF-8 strings into WASM memory
+ * @returns FFI binding functions
+ */
+export function createSqliteBindings(
+  pluginId: string,
+  capabilities: { storage: 'vfs-only' | 'none' },
+  vfsRoot: string | undefined,
+  readUtf8String: (ptr: number, len: number) => string,
+  writeUtf8String: (value: string, ptr: number, maxLen: number) => number
+) {
+  const ownDatabase = (handle: number) => {
+    const open = databases.get(handle)
+    return open?.pluginId === pluginId ? open : undefined
+  }
+  const ownQuery = (queryId: number) => {
+    const query = queries.get(queryId)
+    return query?.pluginId === pluginId ? query : undefined
+  }
+
+  return {
+    /**
+     * Open a SQLite database in the plugin's VFS, read-only
+     * @param pathPtr - Pointer to database path, relative to the VFS root
+     * @param pathLen - Length of database path
+     * @returns Database handle (>0), or -1 on error
+     */
+    sk_sqlite_open: (pathPtr: number, pathLen: number): number => {
+      try {
+        if (capabilities.storage === 'none' || !vfsRoot) {
+          debug(`[${pluginId}] storage capability not granted`)
+          return -1
+        }
+        const owned = [...databases.values()].filter(
+          (open) => open.pluginId === pluginId
+        ).length
+        if (owned >= MAX_DATABASES_PER_PLUGIN) {
+          debug(`[${pluginId}] Too many open SQLite databases`)
+          return -1
+        }
+
+        const vfsPath = readUtf8String(pathPtr, pathLen)
+        const dbPath = resolveVfsPath(vfsRoot, vfsPath)
+        if (!dbPath) {
+          debug(`[${pluginId}] SQLite path outside VFS: ${vfsPath}`)
+          return -1
+        }
+        const Database = getDatabaseSync()
+        if (!Database) {
+          return -1
+        }
+
+        const db = new Database(dbPath, { readOnly: true })
+        const handle = nextHandle++
+        databases.set(handle, { pluginId, db })
+        debug(`[${pluginId}] Opened SQLite database ${handle}: ${vfsPath}`)
+        return handle
+      } catch (error) {
+        debug(`[${pluginId}] sk_sqlite_open error: ${error}`)
+        return -1
+      }
+    },
+
+    /**
+     * Run a parameterized query; read the rows with sk_sqlite_next_row
+     * @param dbHandle - Handle returned by sk_sqlite_open
+     * @param sqlPtr - Pointer to SQL statement
+     * @param sqlLen - Length of SQL statement
+     * @param paramsPtr - Pointer to JSON array (positional) or object (named)
+     *   of parameters, may be empty
+     * @param paramsLen - Length of parameters JSON
+     * @returns Query ID (>0), or -1 on error
+     */
+    sk_sqlite_query: (
+      dbHandle: number,
+      sqlPtr: number,
+      sqlLen: number,
+      paramsPtr: number,
+      paramsLen: number
+    ): number => {
+      try {
+        const open = ownDatabase(dbHandle)
+        if (!open) {
+          debug(`[${pluginId}] Unknown SQLite database: ${dbHandle}`)
+          return -1
+        }
+        const sql = readUtf8String(sqlPtr, sqlLen)
+        if (FORBIDDEN_SQL.test(sql)) {
+          debug(`[${pluginId}] Refused SQLite statement: ${sql}`)
+          return -1
+        }
+        const params =
+          paramsLen > 0 ? JSON.parse(readUtf8String(paramsPtr, paramsLen)) : []
+        const args = Array.isArray(params) ? params : [params]
+
+        const statement = open.db.prepare(sql)
+        // StatementSync.iterate() is missing on early node:sqlite versions
+        const rows =
+          typeof statement.iterate === 'function'
+            ? statement.iterate(...args)
+            : statement.all(...args)[Symbol.iterator]()
+
+        const queryId = nextHandle++
+        queries.set(queryId, { pluginId, dbHandle, rows })
+        return queryId
+      } catch (error) {
+        debug(`[${pluginId}] sk_sqlite_query error: ${error}`)
+        return -1
+      }
+    },
+
+    /**
+     * Read the next row of a query as a JSON object keyed by column name
+     * The query is finalized after the last row or an error.
+     * @param queryId - Query ID returned by sk_sqlite_query
+     * @param outPtr - Buffer to write the row JSON into
+     * @param outMaxLen - Maximum buffer size
+     * @returns Length of row JSON, 0 when there are no more rows, -1 on
+     *   error, or minus the required size if the buffer is too small (the
+     *   row is kept for the next call)
+     */
+    sk_sqlite_next_row: (
+      queryId: number,
+      outPtr: number,
+      outMaxLen: number
+    ): number => {
+      try {
+        const query = ownQuery(queryId)
+        if (!query) {
+          debug(`[${pluginId}] Unknown SQLite query: ${queryId}`)
+          return -1
+        }
+
+        let row = query.pending
+        if (row === undefined) {
+          const next = query.rows.next()
+          if (next.done) {
+            finalizeQuery(queryId)
+            return 0
+          }
+          row = JSON.stringify(next.value, encodeValue)
+        }
+
+        const written = writeUtf8String(row, outPtr, outMaxLen)
+        if (written === 0) {
+          query.pending = row
+          return -Buffer.byteLength(row, 'utf8')
+        }
+        query.pending = undefined
+        return written
+      } catch (error) {
+        debug(`[${pluginId}] sk_sqlite_next_row error: ${error}`)
+        finalizeQuery(queryId)
+        return -1
+      }
+    },
+
+    /**
+     * Discard the remaining rows of a query
+     * @param queryId - Query ID returned by sk_sqlite_query
+     */
+    sk_sqlite_finalize: (queryId: number): void => {
+      if (ownQuery(queryId)) {
+        finalizeQuery(queryId)
+      }
+    },
+
+    /**
+     * Close a database and finalize its queries
+     * @param dbHandle - Handle returned by sk_sqlite_open
+     */
+    sk_sqlite_close: (dbHandle: number): void => {
+      if (ownDatabase(dbHandle)) {
+        closeDatabase(dbHandle)
+        debug(`[${pluginId}] Closed SQLite database ${dbHandle}`)
+      }
+    }
+  }
+}
@@ -0,0 +1,106 @@
+/* eslint-disable @typescript-eslint/no-explicit-any */
+/**
+ * Webapp Registration FFI Binding
+ *
+ * Lets WASM plugins that serve a UI from their own HTTP endpoints list it
+ * in the admin UI Webapps launcher. The launcher links to /<name>/, so the
+ * host redirects that path to the plugin's UI route.
+ */
+
+import Debug from 'debug'
+import { derivePluginId } from '../../pluginid'
+
+const debug = Debug('signalk:wasm:webapps')
+
+/**
+ * Redirect targets of webapps registered through sk_register_webapp, per
+ * server app. Express middleware cannot be removed, so each name is
+ * mounted once and later registrations only update its target.
+ */
+const webappTargets: WeakMap<object, Map<string, string>> = new WeakMap()
+
+/**
+ * Create the sk_register_webapp host binding
+ *
+ * @param pluginId - Plugin identifier
+ * @param capabilities - Plugin capabilities
+ * @param app - SignalK application instance
+ * @param readUtf8String - Function to read UTF-8 strings from WASM memory
+ * @returns FFI binding function
+ */
+export function createWebappRegistrationBinding(
+  pluginId: string,
+  capabilities: { httpEndpoints?: boolean },
+  app: any,
+  readUtf8String: (ptr: number, len: number) => string
+): (ptr: number, len: number) => number {
+  /**
+   * Register the plugin's UI as a webapp
+   * @param ptr - Pointer to JSON: {"displayName", "path", "description"?, "appIcon"?}
+   * @param len - Length of JSON
+   * @returns 1 on success, 0 on failure
+   */
+  return (ptr: number, len: number): number => {
+    try {
+      if (!capabilities.httpEndpoints) {
+        debug(`[${pluginId}] httpEndpoints capability not granted`)
+        return 0
+      }
+      if (!app || typeof app.use !== 'function') {
+        debug(`[${pluginId}] app not available`)
+        return 0
+      }
+
+      const { displayName, path, description, appIcon } = JSON.parse(
+        readUtf8String(ptr, len)
+      )
+      if (typeof path !== 'string' || !path.startsWith('/')) {
+        debug(`[${pluginId}] Webapp path must start with /`)
+        return 0
+      }
+
+      if (!webappTargets.has(app)) {
+        webappTargets.set(app, new Map())
+      }
+      const targets = webappTargets.get(app)!
+      if (!app.webapps) {
+        app.webapps = []
+      }
+      const existing = app.webapps.findIndex((w: any) => w.name === pluginId)
+      if (existing !== -1 && !targets.has(pluginId)) {
+        debug(`[${pluginId}] A webapp named ${pluginId} already exists`)
+        return 0
+      }
+
+      // req.url keeps its leading slash, so /<name>/icon.png redirects to
+      // the icon served next to the plugin's UI
+      const routeBase = `/plugins/${derivePluginId(pluginId)}`
+      const target = (routeBase + path).replace(/\/$/, '')
+      if (!targets.has(pluginId)) {
+        app.use('/' + pluginId, (req: any, res: any) => {
+          res.redirect(`${targets.get(pluginId)}${req.url}`)
+        })
+      }
+      targets.set(pluginId, target)
+
+      const webappMetadata = {
+        name: pluginId,
+        description: description || '',
+        // Lets the webapps API hide the entry while the plugin is disabled
+        keywords: ['signalk-wasm-plugin'],
+        signalk: { displayName, appIcon }
+      }
+      if (existing !== -1) {
+        app.webapps[existing] = webappMetadata
+      } else {
+        app.webapps.push(webappMetadata)
+      }
+
+      debug(`[${pluginId}] Registered webapp ${displayName} -> ${target}`)
+      return 1
+    } catch (error) {
+      debug(`[${pluginId}] sk_register_webapp error: ${error}`)
+      return 0
+    }
+  }
+}
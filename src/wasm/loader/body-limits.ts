@@ -0,0 +1,133 @@
+/* eslint-disable @typescript-eslint/no-require-imports */
+/**
+ * WASM Plugin Request Body Limits
+ *
+ * The server parses JSON bodies of all requests before they reach plugin
+ * routers, up to the server-wide FILEUPLOADSIZELIMIT. Bodies of endpoints
+ * declaring a `maxBodySize` are parsed here first, with that limit, so an
+ * oversized body is refused while it is read, also when it is chunked.
+ */
+
+import * as express from 'express'
+import { NextFunction, Request, RequestHandler, Response } from 'express'
+import Debug from 'debug'
+import { SERVERROUTESPREFIX } from '../../constants'
+
+const pathToRegexp: (path: string) => RegExp = require('path-to-regexp')
+
+const debug = Debug('signalk:wasm:loader')
+
+/**
+ * Media types passed to endpoint handlers as a string, such as GPX or KML
+ * documents
+ */
+export const TEXT_BODY_TYPES = [
+  'text/*',
+  'application/xml',
+  'application/*+xml'
+]
+
+interface BodyLimit {
+  method: string
+  regex: RegExp
+  maxBodySize: number
+}
+
+// Declared limits by plugin id
+const bodyLimits: Map<string, BodyLimit[]> = new Map()
+
+// JSON and text parsers by size limit
+const parsers: Map<number, RequestHandler[]> = new Map()
+
+/**
+ * Record the `maxBodySize` limits of a plugin's http_endpoints entries,
+ * replacing those of an earlier setup
+ */
+export function setEndpointBodyLimits(
+  pluginId: string,
+  endpoints: Array<{ method: string; path: string; maxBodySize?: number }>
+): void {
+  const limits: BodyLimit[] = []
+  for (const { method, path, maxBodySize } of endpoints) {
+    if (typeof maxBodySize !== 'number') {
+      continue
+    }
+    const normalizedPath = path.startsWith('/') ? path : `/${path}`
+    limits.push({
+      method: method.toUpperCase(),
+      regex: pathToRegexp(`/plugins/${pluginId}${normalizedPath}`),
+      maxBodySize
+    })
+  }
+  if (limits.length > 0) {
+    bodyLimits.set(pluginId, limits)
+  } else {
+    bodyLimits.delete(pluginId)
+  }
+}
+
+/**
+ * Forget the body limits of a plugin, e.g. when it is unloaded
+ */
+export function clearEndpointBodyLimits(pluginId: string): void {
+  bodyLimits.delete(pluginId)
+}
+
+function getParsers(maxBodySize: number): RequestHandler[] {
+  let limited = parsers.get(maxBodySize)
+  if (!limited) {
+    limited = [
+      express.json({ limit: maxBodySize }),
+      express.text({ type: TEXT_BODY_TYPES, limit: maxBodySize })
+    ]
+    parsers.set(maxBodySize, limited)
+  }
+  return limited
+}
+
+/**
+ * Parse the body of requests to endpoints with a declared `maxBodySize`,
+ * answering 413 once more bytes arrive. Must be installed before the
+ * server-wide body parsers, which then leave the request alone.
+ */
+export function endpointBodyLimitParser(
+  req: Request,
+  res: Response,
+  next: NextFunction
+): void {
+  if (bodyLimits.size === 0) {
+    return next()
+  }
+  const requestPath = req.path.replace(
+    new RegExp(`^${SERVERROUTESPREFIX}`),
+    ''
+  )
+  let maxBodySize: number | undefined
+  for (const limits of bodyLimits.values()) {
+    const match = limits.find(
+      (limit) => limit.method === req.method && limit.regex.test(requestPath)
+    )
+    if (match) {
+      maxBodySize = match.maxBodySize
+      break
+    }
+  }
+  if (maxBodySize === undefined) {
+    return next()
+  }
+
+  const [jsonParser, textParser] = getParsers(maxBodySize)
+  const done = (err?: { type?: string }) => {
+    if (err?.type === 'entity.too.large') {
+      debug(`Rejected ${req.method} ${requestPath}: body too large`)
+      res.status(413).json({
+        error: `Request body exceeds ${maxBodySize} bytes`
+      })
+      return
+    }
+    next(err)
+  }
+  jsonParser(req, res, (err?: { type?: string }) =>
+    err ? done(err) : textParser(req, res, done)
+  )
+}
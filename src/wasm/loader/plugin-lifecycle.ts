@@ -9,15 +9,26 @@
  */
 
 import Debug from 'debug'
+import * as fs from 'fs'
+import * as path from 'path'
 import { WasmPlugin } from './types'
 import { wasmPlugins, restartTimers, setPluginStatus } from './plugin-registry'
 import { getWasmRuntime, resetWasmRuntime } from '../wasm-runtime'
 import { resetSubscriptionManager } from '../wasm-subscriptions'
-import { backwardsCompat } from './plugin-routes'
+import {
+  backwardsCompat,
+  clearSlowHandlerCounts,
+  setupPluginSpecificRoutes
+} from './plugin-routes'
+import { clearEndpointBodyLimits } from './body-limits'
 import { updateResourceProviderInstance } from '../bindings/resource-provider'
 import { updateWeatherProviderInstance } from '../bindings/weather-provider'
 import { updateRadarProviderInstance } from '../bindings/radar-provider'
 import { socketManager } from '../bindings/socket-manager'
+import { closeAllSqliteForPlugin } from '../bindings/sqlite'
+import { clearResourceQueriesForPlugin } from '../bindings/resource-queries'
+import { releaseAllLocksForPlugin } from '../bindings/locks'
+import { clearReportedMemory } from '../bindings/env-imports'
 
 const debug = Debug('signalk:wasm:loader')
 
@@ -27,6 +38,15 @@ const pollTimers: Map<string, NodeJS.Timeout> = new Map()
 // Track delta subscription unsubscribe functions for plugins
 const deltaUnsubscribers: Map<string, () => void> = new Map()
 
+// Track delta input handler unregister functions for plugins
+const deltaInputUnregisters: Map<string, () => void> = new Map()
+
+// Track module file watchers of plugins listed in WATCH_WASM_PLUGINS
+const moduleWatchers: Map<string, fs.FSWatcher> = new Map()
+
+// Wait for a build to finish writing the module before reloading it
+const MODULE_RELOAD_DELAY = 500
+
 // Mutex for serializing network-capable plugin starts
 // as-fetch uses global state that gets corrupted with parallel plugin starts
 let networkPluginStartMutex: Promise<void> = Promise.resolve()
@@ -114,6 +134,8 @@ async function startWasmPluginInternal(
     plugin.crashCount = 0 // Reset crash count on successful start
     plugin.restartBackoff = 1000
 
+    watchPluginModule(app, plugin, pluginId)
+
     // Set up periodic polling for plugins that export poll()
     // This is a generic mechanism for plugins that need to poll hardware,
     // sockets, or external systems (e.g., radar, NMEA receivers, sensors)
@@ -141,22 +163,28 @@ async function startWasmPluginInternal(
     if (plugin.instance?.exports?.delta_handler) {
       debug(`Setting up delta subscription for ${pluginId}`)
 
-      // Subscribe to deltas from the server
-      if (app.signalk && typeof app.signalk.on === 'function') {
-        const deltaHandler = (delta: any) => {
-          try {
-            if (
-              plugin.status === 'running' &&
-              plugin.instance?.exports?.delta_handler
-            ) {
-              const deltaJson = JSON.stringify(delta)
-              plugin.instance.exports.delta_handler(deltaJson)
-            }
-          } catch (deltaError) {
-            debug(`[${pluginId}] delta_handler error: ${deltaError}`)
+      const deltaHandler = (delta: any) => {
+        try {
+          if (
+            plugin.status === 'running' &&
+            plugin.instance?.exports?.delta_handler
+          ) {
+            const deltaJson = JSON.stringify(delta)
+            plugin.instance.exports.delta_handler(deltaJson)
           }
+        } catch (deltaError) {
+          debug(`[${pluginId}] delta_handler error: ${deltaError}`)
         }
+      }
 
+      const manifest = plugin.instance.exports.plugin_subscriptions?.()
+      if (manifest) {
+        // Deliver only the subscribed paths, at the requested periods
+        deltaUnsubscribers.set(
+          pluginId,
+          subscribeFromManifest(app, pluginId, manifest, deltaHandler)
+        )
+      } else if (app.signalk && typeof app.signalk.on === 'function') {
         // Subscribe to delta events
         app.signalk.on('delta', deltaHandler)
 
@@ -173,6 +201,14 @@ async function startWasmPluginInternal(
       }
     }
 
+    // Register delta input handler if plugin exports delta_input_handler
+    if (plugin.instance?.exports?.delta_input_handler) {
+      const unregister = registerWasmDeltaInputHandler(app, plugin, pluginId)
+      if (unregister) {
+        deltaInputUnregisters.set(pluginId, unregister)
+      }
+    }
+
     debug(`Successfully started WASM plugin: ${pluginId}`)
   } catch (error) {
     const errorMsg = error instanceof Error ? error.message : String(error)
@@ -183,6 +219,181 @@ async function startWasmPluginInternal(
   }
 }
 
+/**
+ * Reload a plugin whenever its module changes on disk, if it is listed in
+ * the WATCH_WASM_PLUGINS environment variable. Meant for development: the
+ * watch lasts until the plugin is unloaded, also through failed reloads.
+ */
+function watchPluginModule(
+  app: any,
+  plugin: WasmPlugin,
+  pluginId: string
+): void {
+  const watched = (process.env.WATCH_WASM_PLUGINS || '')
+    .split(',')
+    .map((id) => id.trim())
+  if (moduleWatchers.has(pluginId) || !watched.includes(pluginId)) {
+    return
+  }
+  const wasmPath = plugin.instance?.wasmPath
+  if (!wasmPath) {
+    debug(`[${pluginId}] No module path to watch`)
+    return
+  }
+
+  // Watch the directory, as builds often replace the file
+  let reloadTimer: NodeJS.Timeout | undefined
+  try {
+    const watcher = fs.watch(path.dirname(wasmPath), (_event, filename) => {
+      if (filename !== path.basename(wasmPath)) {
+        return
+      }
+      clearTimeout(reloadTimer)
+      reloadTimer = setTimeout(
+        () => reloadChangedModule(app, pluginId),
+        MODULE_RELOAD_DELAY
+      )
+    })
+    watcher.on('close', () => clearTimeout(reloadTimer))
+    moduleWatchers.set(pluginId, watcher)
+    debug(`Watching ${wasmPath} for changes`)
+  } catch (error) {
+    debug(`[${pluginId}] Cannot watch ${wasmPath}: ${error}`)
+  }
+}
+
+async function reloadChangedModule(app: any, pluginId: string): Promise<void> {
+  const plugin = wasmPlugins.get(pluginId)
+  if (!plugin || !plugin.enabled) {
+    return
+  }
+  debug(`[${pluginId}] Module changed, reloading`)
+  try {
+    await reloadWasmPlugin(app, pluginId)
+    // Also start plugins that had crashed or failed to start
+    if (plugin.status !== 'running') {
+      await startWasmPlugin(app, pluginId)
+    }
+  } catch (error) {
+    debug(`[${pluginId}] Reload after module change failed: ${error}`)
+  }
+}
+
+function unwatchPluginModule(pluginId: string): void {
+  const watcher = moduleWatchers.get(pluginId)
+  if (watcher) {
+    watcher.close()
+    moduleWatchers.delete(pluginId)
+  }
+}
+
+/**
+ * Subscribe a delta handler to the rows of a plugin_subscriptions manifest,
+ * with one subscription per context (vessels.self unless given)
+ *
+ * @returns Function that ends the subscriptions
+ * @throws If the manifest is not a JSON array of rows with a path
+ */
+export function subscribeFromManifest(
+  app: any,
+  pluginId: string,
+  manifestJson: string,
+  deltaHandler: (delta: any) => void
+): () => void {
+  const rows = JSON.parse(manifestJson)
+  if (!Array.isArray(rows)) {
+    throw new Error('plugin_subscriptions must return a JSON array')
+  }
+  if (!app.subscriptionmanager) {
+    throw new Error('app.subscriptionmanager not available')
+  }
+
+  const byContext: Map<string, any[]> = new Map()
+  for (const row of rows) {
+    if (typeof row?.path !== 'string') {
+      throw new Error(
+        `Invalid plugin_subscriptions row: ${JSON.stringify(row)}`
+      )
+    }
+    const { context = 'vessels.self', ...subscription } = row
+    if (!byContext.has(context)) {
+      byContext.set(context, [])
+    }
+    byContext.get(context)!.push(subscription)
+  }
+
+  const unsubscribes: Array<() => void> = []
+  for (const [context, subscribe] of byContext) {
+    debug(
+      `[${pluginId}] Subscribing to ${subscribe.length} path(s) in ${context}`
+    )
+    app.subscriptionmanager.subscribe(
+      { context, subscribe },
+      unsubscribes,
+      (error: unknown) => debug(`[${pluginId}] Subscription error: ${error}`),
+      deltaHandler
+    )
+  }
+  return () => unsubscribes.forEach((unsubscribe) => unsubscribe())
+}
+
+/**
+ * Route incoming deltas through a plugin's delta_input_handler before they
+ * reach the data model. Modifying other providers' data requires the
+ * dataWrite capability.
+ *
+ * @returns Function that removes the handler, or undefined if not registered
+ */
+export function registerWasmDeltaInputHandler(
+  app: any,
+  plugin: WasmPlugin,
+  pluginId: string
+): (() => void) | undefined {
+  if (!plugin.metadata?.capabilities?.dataWrite) {
+    debug(`[${pluginId}] delta_input_handler requires dataWrite capability`)
+    return undefined
+  }
+  if (typeof app.registerDeltaInputHandler !== 'function') {
+    debug(`Warning: app.registerDeltaInputHandler not available`)
+    return undefined
+  }
+
+  debug(`Registering delta input handler for ${pluginId}`)
+  return app.registerDeltaInputHandler(
+    (delta: any, next: (delta: any) => void) => {
+      const handler = plugin.instance?.exports?.delta_input_handler
+      if (plugin.status !== 'running' || !handler) {
+        next(delta)
+        return
+      }
+      let forwarded = delta
+      try {
+        const result = handler(JSON.stringify(delta))
+        if (result) {
+          forwarded = JSON.parse(result)
+        }
+      } catch (error) {
+        debug(`[${pluginId}] delta_input_handler error: ${error}`)
+      }
+      next(forwarded)
+    }
+  )
+}
+
+/**
+ * Clean up any sockets, databases, locks and resource query results held
+ * by a plugin that stopped or crashed. Env bindings know the plugin by the
+ * package name it was loaded with.
+ */
+function releasePluginResources(plugin: WasmPlugin, pluginId: string): void {
+  const bindingId = plugin.packageName ?? pluginId
+  socketManager.closeAllForPlugin(pluginId)
+  closeAllSqliteForPlugin(bindingId)
+  releaseAllLocksForPlugin(bindingId)
+  clearReportedMemory(bindingId)
+  clearResourceQueriesForPlugin(bindingId)
+}
+
 /**
  * Stop a WASM plugin
  */
@@ -218,6 +429,13 @@ export async function stopWasmPlugin(pluginId: string): Promise<void> {
       debug(`Stopped delta subscription for ${pluginId}`)
     }
 
+    const deltaInputUnregister = deltaInputUnregisters.get(pluginId)
+    if (deltaInputUnregister) {
+      deltaInputUnregister()
+      deltaInputUnregisters.delete(pluginId)
+      debug(`Removed delta input handler for ${pluginId}`)
+    }
+
     if (plugin.instance) {
       // Call plugin stop()
       const result = plugin.instance.exports.stop()
@@ -226,8 +444,7 @@ export async function stopWasmPlugin(pluginId: string): Promise<void> {
       }
     }
 
-    // Clean up any sockets opened by this plugin
-    socketManager.closeAllForPlugin(pluginId)
+    releasePluginResources(plugin, pluginId)
 
     setPluginStatus(plugin, 'stopped')
     plugin.statusMessage = 'Stopped'
@@ -260,6 +477,9 @@ export async function unloadWasmPlugin(
     if (plugin.status === 'running') {
       await stopWasmPlugin(pluginId)
     }
+    unwatchPluginModule(pluginId)
+    clearSlowHandlerCounts(pluginId)
+    clearEndpointBodyLimits(pluginId)
 
     // Remove HTTP routes from Express
     if (plugin.router) {
@@ -292,6 +512,7 @@ export async function unloadWasmPlugin(
       })
 
       plugin.router = undefined
+      plugin.endpointRouter = undefined
       debug(`Removed HTTP routes for ${pluginId}`)
     }
 
@@ -317,6 +538,52 @@ export async function unloadWasmPlugin(
   }
 }
 
+/**
+ * Read a running plugin's state with its plugin_export_state export
+ * @returns The state, or undefined if the plugin does not export it
+ */
+export function exportPluginState(
+  plugin: WasmPlugin,
+  pluginId: string
+): string | undefined {
+  const exportState = plugin.instance?.exports.plugin_export_state
+  if (!exportState) {
+    return undefined
+  }
+  try {
+    const state = exportState()
+    debug(`[${pluginId}] Exported ${state.length} characters of state`)
+    return state
+  } catch (error) {
+    debug(`[${pluginId}] plugin_export_state failed: ${error}`)
+    return undefined
+  }
+}
+
+/**
+ * Hand exported state to a reloaded plugin before it is started. A plugin
+ * that rejects it starts without it, as after a server restart.
+ */
+export function importPluginState(
+  plugin: WasmPlugin,
+  pluginId: string,
+  state: string
+): void {
+  const importState = plugin.instance?.exports.plugin_import_state
+  if (!importState) {
+    debug(`[${pluginId}] New module does not import state, discarding it`)
+    return
+  }
+  try {
+    const result = importState(state)
+    if (result !== 0) {
+      debug(`[${pluginId}] plugin_import_state returned: ${result}`)
+    }
+  } catch (error) {
+    debug(`[${pluginId}] plugin_import_state failed: ${error}`)
+  }
+}
+
 /**
  * Reload a WASM plugin (hot-reload without server restart)
  */
@@ -334,6 +601,10 @@ export async function reloadWasmPlugin(
   try {
     const wasRunning = plugin.status === 'running'
 
+    // Take the in-memory state over to the new module, only from a running
+    // instance: a crashed one may have left it inconsistent
+    const state = wasRunning ? exportPluginState(plugin, pluginId) : undefined
+
     // Stop the plugin
     if (wasRunning) {
       await stopWasmPlugin(pluginId)
@@ -342,12 +613,13 @@ export async function reloadWasmPlugin(
     // Save current configuration
     const savedConfig = plugin.configuration
 
-    // Reload WASM module
+    // Reload WASM module, loaded under the package name like env bindings
     const runtime = getWasmRuntime()
-    await runtime.reloadPlugin(pluginId)
+    const runtimeId = plugin.packageName ?? pluginId
+    await runtime.reloadPlugin(runtimeId, app)
 
     // Get new instance
-    const newInstance = runtime.getInstance(pluginId)
+    const newInstance = runtime.getInstance(runtimeId)
     if (!newInstance) {
       throw new Error('Failed to get reloaded instance')
     }
@@ -358,6 +630,13 @@ export async function reloadWasmPlugin(
     const schemaJson = newInstance.exports.schema()
     plugin.schema = schemaJson ? JSON.parse(schemaJson) : {}
 
+    // Serve the endpoints of the new module, with their declared levels
+    setupPluginSpecificRoutes(app, plugin)
+
+    if (state !== undefined) {
+      importPluginState(plugin, pluginId, state)
+    }
+
     // Restart if it was running
     if (wasRunning) {
       await startWasmPlugin(app, pluginId)
@@ -396,6 +675,10 @@ export async function handleWasmPluginCrash(
     `WASM plugin ${pluginId} crashed (count: ${plugin.crashCount}): ${error.message}`
   )
 
+  // Other plugins must not wait for a restart that may never come, and
+  // the restarted module opens its own databases
+  releasePluginResources(plugin, pluginId)
+
   // Give up after 3 crashes in quick succession
   if (plugin.crashCount >= 3) {
     setPluginStatus(plugin, 'error')
@@ -438,6 +721,10 @@ export async function shutdownAllWasmPlugins(): Promise<void> {
   }
   restartTimers.clear()
 
+  for (const pluginId of Array.from(moduleWatchers.keys())) {
+    unwatchPluginModule(pluginId)
+  }
+
   // Stop all plugins
   const plugins = Array.from(wasmPlugins.values())
   debug(
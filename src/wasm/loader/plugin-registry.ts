@@ -194,7 +194,8 @@ export async function registerWasmPlugin(
       resourceProvider: packageJson.wasmCapabilities?.resourceProvider || false,
       weatherProvider: packageJson.wasmCapabilities?.weatherProvider || false,
       radarProvider: packageJson.wasmCapabilities?.radarProvider || false,
-      rawSockets: packageJson.wasmCapabilities?.rawSockets || false
+      rawSockets: packageJson.wasmCapabilities?.rawSockets || false,
+      accessRequests: packageJson.wasmCapabilities?.accessRequests || false
     }
 
     // Load WASM module temporarily to extract schema and display name
@@ -10,21 +10,36 @@
 
 import * as path from 'path'
 import * as express from 'express'
-import { Request, Response } from 'express'
+import { NextFunction, Request, Response } from 'express'
+import { IncomingHttpHeaders } from 'http'
 import { spawn } from 'child_process'
 import * as readline from 'readline'
 import Debug from 'debug'
 import { WasmPlugin } from './types'
+import {
+  clearEndpointBodyLimits,
+  setEndpointBodyLimits,
+  TEXT_BODY_TYPES
+} from './body-limits'
 import { getWasmRuntime } from '../wasm-runtime'
+import { getReportedMemory } from '../bindings/env-imports'
 import {
   getPluginStoragePaths,
   readPluginConfig,
   writePluginConfig
 } from '../wasm-storage'
 import { SERVERROUTESPREFIX } from '../../constants'
+import { RouteAccessLevel, RoutePermission } from '@signalk/server-api'
 
 const debug = Debug('signalk:wasm:loader')
 
+// Text request bodies, such as GPX or KML documents, reach custom endpoint
+// handlers as a string in the request's body field
+const textBodyParser = express.text({
+  type: TEXT_BODY_TYPES,
+  limit: process.env.FILEUPLOADSIZELIMIT || '10mb'
+})
+
 /**
  * Helper to support both prefixed and non-prefixed routes
  */
@@ -32,6 +47,78 @@ export function backwardsCompat(url: string) {
   return [`${SERVERROUTESPREFIX}${url}`, url]
 }
 
+/**
+ * Memory usage of a running plugin: the size of its linear memory, plus
+ * the heap usage it reported itself with sk_report_memory, which is
+ * recorded under the package name the module was loaded with
+ */
+export function getPluginMemoryUsage(plugin: WasmPlugin) {
+  const memory = plugin.instance?.instance?.exports?.memory
+  if (!(memory instanceof WebAssembly.Memory)) {
+    return undefined
+  }
+  return {
+    linearMemory: memory.buffer.byteLength,
+    ...getReportedMemory(plugin.packageName ?? plugin.id)
+  }
+}
+
+/**
+ * Milliseconds an HTTP endpoint handler may take before a slow handler
+ * warning is logged, unless overridden with WASM_HANDLER_BUDGET
+ */
+const DEFAULT_HANDLER_BUDGET = 500
+
+// Number of over-budget handler calls per plugin and endpoint
+const slowHandlerCounts = new Map<string, Map<string, number>>()
+
+/**
+ * Record how long an endpoint handler ran, warning and counting the call
+ * if it took longer than the budget
+ */
+export function recordHandlerDuration(
+  pluginId: string,
+  endpoint: string,
+  durationMs: number
+): void {
+  const configured = Number(process.env.WASM_HANDLER_BUDGET)
+  const budgetMs = configured > 0 ? configured : DEFAULT_HANDLER_BUDGET
+  if (durationMs <= budgetMs) {
+    return
+  }
+  const counts = slowHandlerCounts.get(pluginId) ?? new Map<string, number>()
+  const count = (counts.get(endpoint) ?? 0) + 1
+  counts.set(endpoint, count)
+  slowHandlerCounts.set(pluginId, counts)
+  console.warn(
+    `WASM plugin ${pluginId} handler exceeded its time budget`,
+    JSON.stringify({
+      endpoint,
+      durationMs: Math.round(durationMs),
+      budgetMs,
+      count
+    })
+  )
+}
+
+/**
+ * Get the number of over-budget calls of each endpoint of a plugin, keyed
+ * by method and path, if any
+ */
+export function getSlowHandlerCounts(
+  pluginId: string
+): Record<string, number> | undefined {
+  const counts = slowHandlerCounts.get(pluginId)
+  return counts ? Object.fromEntries(counts) : undefined
+}
+
+/**
+ * Forget a plugin's slow handler counts, e.g. when it is unloaded
+ */
+export function clearSlowHandlerCounts(pluginId: string): void {
+  slowHandlerCounts.delete(pluginId)
+}
+
 /**
  * Handle /api/logs request directly in Node.js (for signalk-logviewer plugin)
  * This avoids WASM memory buffer limitations (~64KB) when streaming large logs
@@ -149,11 +236,172 @@ export async function handleLogViewerRequest(
   }
 }
 
+/**
+ * Access levels an http_endpoints entry can declare in its `permission`
+ * field. `admin` maps to no registration, as every plugin route is
+ * admin-only unless recorded otherwise.
+ */
+const ENDPOINT_ACCESS_LEVELS: Record<string, RouteAccessLevel | null> = {
+  read: 'readonly',
+  write: 'readwrite',
+  admin: null
+}
+
+/**
+ * Record the declared permissions of http_endpoints entries with the
+ * security strategy, so the /plugins gate enforces them before the
+ * handler is invoked, replacing those of an earlier registration.
+ * Entries without a permission stay admin-only.
+ */
+export function registerEndpointPermissions(
+  app: any,
+  pluginId: string,
+  endpoints: Array<{ method: string; path: string; permission?: string }>
+): void {
+  const permissions: RoutePermission[] = []
+  for (const { method, path: endpointPath, permission } of endpoints) {
+    if (permission === undefined) {
+      continue
+    }
+    const level = ENDPOINT_ACCESS_LEVELS[permission]
+    if (level === undefined) {
+      debug(
+        `[${pluginId}] Unknown permission '${permission}' for ${method} ${endpointPath}, keeping admin-only`
+      )
+      continue
+    }
+    if (level) {
+      permissions.push({
+        method: method.toUpperCase() as RoutePermission['method'],
+        path: endpointPath,
+        permission: level
+      })
+    }
+  }
+  // Not implemented by the dummy strategy, where every route is reachable.
+  // Entries from an earlier registration are dropped first, as the first
+  // match wins and a route tightened on reload must not keep its old level.
+  app.securityStrategy.clearPluginRoutePermissions?.(pluginId)
+  if (permissions.length > 0) {
+    app.securityStrategy.registerPluginRoutePermissions?.(pluginId, permissions)
+  }
+}
+
+/**
+ * Path of the endpoint index served for plugins with http_endpoints,
+ * unless a plugin declares a GET handler for it itself
+ */
+export const ENDPOINT_INDEX_PATH = '/api'
+
+/**
+ * Describe http_endpoints entries for the GET /api endpoint index, with
+ * the access level the server enforces for each of them
+ */
+export function buildEndpointIndex(
+  endpoints: Array<{
+    method: string
+    path: string
+    permission?: string
+    description?: string
+  }>
+): {
+  endpoints: Array<{
+    method: string
+    path: string
+    permission: string
+    description?: string
+  }>
+} {
+  return {
+    endpoints: endpoints.map(
+      ({ method, path: endpointPath, permission, description }) => ({
+        method: method.toUpperCase(),
+        path: endpointPath,
+        // Unknown levels are admin-only, see registerEndpointPermissions
+        permission:
+          permission !== undefined && ENDPOINT_ACCESS_LEVELS[permission]
+            ? permission
+            : 'admin',
+        ...(typeof description === 'string' ? { description } : {})
+      })
+    )
+  }
+}
+
+/**
+ * Check a request against the optional `maxBodySize` (bytes) and
+ * `contentTypes` limits of its http_endpoints entry, so oversized or
+ * unexpected bodies never reach plugin memory. Returns the status and
+ * error message for rejected requests. Chunked bodies have no length to
+ * check, endpointBodyLimitParser refuses them while they are read.
+ */
+export function checkRequestBody(
+  limits: { maxBodySize?: number; contentTypes?: string[] },
+  headers: IncomingHttpHeaders
+): { status: 413 | 415; error: string } | undefined {
+  const contentLength = headers['content-length']
+  const hasBody =
+    Number(contentLength) > 0 || headers['transfer-encoding'] !== undefined
+  if (!hasBody) {
+    return undefined
+  }
+
+  if (
+    typeof limits.maxBodySize === 'number' &&
+    Number(contentLength) > limits.maxBodySize
+  ) {
+    return {
+      status: 413,
+      error: `Request body exceeds ${limits.maxBodySize} bytes`
+    }
+  }
+
+  if (Array.isArray(limits.contentTypes)) {
+    const type = (headers['content-type'] ?? '')
+      .split(';')[0]
+      .trim()
+      .toLowerCase()
+    const accepted = limits.contentTypes.some(
+      (allowed) =>
+        allowed === type ||
+        (allowed.endsWith('/*') && type.startsWith(allowed.slice(0, -1)))
+    )
+    if (!accepted) {
+      return {
+        status: 415,
+        error: `Unsupported content type, expected ${limits.contentTypes.join(', ')}`
+      }
+    }
+  }
+  return undefined
+}
+
+/**
+ * The authenticated caller ({identifier, permissions}) passed to handlers,
+ * null when security is disabled or the request is anonymous. Anonymous
+ * requests allowed by allow_readonly carry an AUTO principal, no user.
+ */
+export function requestUser(
+  req: Request
+): { identifier: string; permissions: string } | null {
+  const principal = (req as any).skPrincipal
+  if (!principal || principal.identifier === 'AUTO') {
+    return null
+  }
+  return principal
+}
+
+// Plugin routers that already dispatch to the plugin's endpoint router
+const endpointDispatchers = new WeakSet<express.IRouter>()
+
 /**
  * Add plugin-specific HTTP endpoints to an existing router
- * This is called when enabling a previously disabled plugin
+ * This is called when enabling a previously disabled plugin.
+ * The endpoints live in a router of their own that replaces the one of an
+ * earlier setup, as Express routes cannot be removed and the first
+ * matching one wins.
  */
-export function setupPluginSpecificRoutes(plugin: WasmPlugin): void {
+export function setupPluginSpecificRoutes(app: any, plugin: WasmPlugin): void {
   if (!plugin.router) {
     debug(
       `Warning: Cannot setup plugin-specific routes - no router found for ${plugin.id}`
@@ -161,6 +409,22 @@ export function setupPluginSpecificRoutes(plugin: WasmPlugin): void {
     return
   }
 
+  if (!endpointDispatchers.has(plugin.router)) {
+    plugin.router.use((req: Request, res: Response, next: NextFunction) => {
+      if (!plugin.endpointRouter) {
+        return next()
+      }
+      plugin.endpointRouter(req, res, next)
+    })
+    endpointDispatchers.add(plugin.router)
+  }
+  const router = express.Router()
+  plugin.endpointRouter = router
+  // The levels and body limits of earlier endpoints go too, a reloaded
+  // module may declare none at all
+  app.securityStrategy?.clearPluginRoutePermissions?.(plugin.id)
+  clearEndpointBodyLimits(plugin.id)
+
   if (!plugin.instance) {
     debug(`No instance for ${plugin.id}`)
     return
@@ -180,8 +444,6 @@ export function setupPluginSpecificRoutes(plugin: WasmPlugin): void {
     return
   }
 
-  const router = plugin.router
-
   // Register custom HTTP endpoints
   try {
     let endpointsJson: string
@@ -228,6 +490,27 @@ export function setupPluginSpecificRoutes(plugin: WasmPlugin): void {
 
     const endpoints = JSON.parse(endpointsJson)
     debug(`Registering ${endpoints.length} HTTP endpoints for ${plugin.id}`)
+    setEndpointBodyLimits(plugin.id, endpoints)
+
+    // Serve an index of the endpoints at GET /api, readable by any
+    // authenticated user, unless the plugin handles that path itself
+    const hasOwnIndex = endpoints.some(
+      (endpoint: { method: string; path: string }) =>
+        endpoint.method.toUpperCase() === 'GET' &&
+        endpoint.path === ENDPOINT_INDEX_PATH
+    )
+    if (hasOwnIndex) {
+      registerEndpointPermissions(app, plugin.id, endpoints)
+    } else {
+      const index = buildEndpointIndex(endpoints)
+      registerEndpointPermissions(app, plugin.id, [
+        ...endpoints,
+        { method: 'GET', path: ENDPOINT_INDEX_PATH, permission: 'read' }
+      ])
+      router.get(ENDPOINT_INDEX_PATH, (req: Request, res: Response) => {
+        res.json(index)
+      })
+    }
 
     for (const endpoint of endpoints) {
       const { method, path: endpointPath, handler } = endpoint
@@ -244,6 +527,7 @@ export function setupPluginSpecificRoutes(plugin: WasmPlugin): void {
       router[routeMethod](endpointPath, async (req: Request, res: Response) => {
         // Set a timeout to catch hangs (declare outside try so catch can access it)
         let timeout: NodeJS.Timeout | null = null
+        const started = performance.now()
 
         try {
           debug(
@@ -261,6 +545,12 @@ export function setupPluginSpecificRoutes(plugin: WasmPlugin): void {
             return handleLogViewerRequest(req, res)
           }
 
+          const rejection = checkRequestBody(endpoint, req.headers)
+          if (rejection) {
+            debug(`Rejected ${method} ${endpointPath}: ${rejection.error}`)
+            return res.status(rejection.status).json({ error: rejection.error })
+          }
+
           // Build request context for WASM plugin
           const requestContext = JSON.stringify({
             method: req.method,
@@ -268,7 +558,8 @@ export function setupPluginSpecificRoutes(plugin: WasmPlugin): void {
             query: req.query,
             params: req.params,
             body: req.body,
-            headers: req.headers
+            headers: req.headers,
+            user: requestUser(req)
           })
 
           debug(
@@ -466,6 +757,12 @@ export function setupPluginSpecificRoutes(plugin: WasmPlugin): void {
           debug(`Error in HTTP endpoint ${method} ${endpointPath}: ${errorMsg}`)
           debug(`Stack trace: ${stack}`)
           res.status(500).json({ error: errorMsg })
+        } finally {
+          recordHandlerDuration(
+            plugin.id,
+            `${method.toUpperCase()} ${endpointPath}`,
+            performance.now() - started
+          )
         }
       })
     }
@@ -495,6 +792,7 @@ export function setupWasmPluginRoutes(
   stopWasmPlugin: (pluginId: string) => Promise<void>
 ): void {
   const router = express.Router()
+  router.use(textBodyParser)
 
   // GET /plugins/:id - Get plugin info
   router.get('/', (req: Request, res: Response) => {
@@ -503,7 +801,9 @@ export function setupWasmPluginRoutes(
       enabledByDefault: false,
       id: plugin.id,
       name: plugin.name,
-      version: plugin.version
+      version: plugin.version,
+      memory: getPluginMemoryUsage(plugin),
+      slowHandlers: getSlowHandlerCounts(plugin.id)
     })
   })
 
@@ -601,7 +901,7 @@ export function setupWasmPluginRoutes(
 
             // Add plugin-specific HTTP endpoints to existing router
             // (basic routes were already set up when plugin was registered as disabled)
-            setupPluginSpecificRoutes(plugin)
+            setupPluginSpecificRoutes(app, plugin)
 
             debug(`Successfully loaded WASM binary for ${plugin.id}`)
           }
@@ -655,7 +955,7 @@ export function setupWasmPluginRoutes(
   plugin.router = router
 
   // Register custom HTTP endpoints if plugin instance is loaded
-  setupPluginSpecificRoutes(plugin)
+  setupPluginSpecificRoutes(app, plugin)
 
   debug(`Set up REST API routes for WASM plugin: ${plugin.id}`)
 }
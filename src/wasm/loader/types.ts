@@ -5,7 +5,7 @@
  * Shared types and interfaces for WASM plugin system
  */
 
-import { IRouter } from 'express'
+import { IRouter, Router } from 'express'
 import {
   WasmPluginInstance,
   WasmCapabilities,
@@ -42,6 +42,7 @@ export interface WasmPlugin {
   metadata: WasmPluginMetadata
   instance?: WasmPluginInstance
   router?: IRouter // Express router for plugin routes
+  endpointRouter?: Router // Routes from http_endpoints, replaced on setup
   status: 'stopped' | 'starting' | 'running' | 'error' | 'crashed'
   statusMessage?: string
   errorMessage?: string
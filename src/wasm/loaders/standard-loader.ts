@@ -11,7 +11,7 @@ import * as fs from 'fs'
 import Debug from 'debug'
 import loader from '@assemblyscript/loader'
 import { WasmPluginInstance, WasmCapabilities } from '../types'
-import { createEnvImports } from '../bindings/env-imports'
+import { createEnvImports, WASM_ABI_VERSION } from '../bindings/env-imports'
 import { updateResourceProviderInstance } from '../bindings/resource-provider'
 import { updateWeatherProviderInstance } from '../bindings/weather-provider'
 import { updateRadarProviderInstance } from '../bindings/radar-provider'
@@ -23,6 +23,80 @@ const debug = Debug('signalk:wasm:loader:standard')
 
 const { WASI } = require('node:wasi')
 
+/**
+ * Link sk_* host imports this server does not provide to stubs that throw
+ * a clear error when called, instead of failing instantiation with a
+ * LinkError. Plugins built against a newer server can detect the missing
+ * functions with sk_has_capability and degrade gracefully.
+ */
+export function withMissingImportStubs(
+  pluginId: string,
+  moduleImports: WebAssembly.ModuleImportDescriptor[],
+  envImports: Record<string, any>
+): Record<string, any> {
+  const missing = moduleImports
+    .filter((i) => i.module === 'env' && i.name.startsWith('sk_'))
+    .map((i) => i.name)
+    .filter((name) => !(name in envImports))
+  if (missing.length === 0) {
+    return envImports
+  }
+  debug(
+    `Plugin ${pluginId} imports host functions not provided by this server: ${missing.join(', ')}`
+  )
+  const stubs: Record<string, any> = {}
+  for (const name of missing) {
+    stubs[name] = () => {
+      throw new Error(
+        `Host function ${name} is not provided by this server, upgrade Signal K server to use it`
+      )
+    }
+  }
+  return { ...stubs, ...envImports }
+}
+
+/**
+ * Reject plugins that declare, via the optional plugin_abi_version
+ * export, a newer host ABI than this server implements
+ */
+export function assertAbiVersionSupported(
+  pluginId: string,
+  rawExports: any
+): void {
+  if (typeof rawExports.plugin_abi_version !== 'function') {
+    return
+  }
+  const pluginAbiVersion = rawExports.plugin_abi_version()
+  debug(
+    `Plugin ${pluginId} ABI version ${pluginAbiVersion}, host ${WASM_ABI_VERSION}`
+  )
+  if (pluginAbiVersion > WASM_ABI_VERSION) {
+    throw new Error(
+      `Plugin ${pluginId} requires WASM ABI version ${pluginAbiVersion}, this server provides version ${WASM_ABI_VERSION}`
+    )
+  }
+}
+
+/**
+ * Bind WASI to an AssemblyScript plugin's memory if the plugin imports
+ * WASI functions. AssemblyScript has no WASI runtime of its own, but
+ * plugins may call WASI directly, e.g. for VFS storage.
+ */
+export function initializeAssemblyScriptWasi(
+  pluginId: string,
+  wasi: { initialize?: (instance: WebAssembly.Instance) => void },
+  instance: WebAssembly.Instance,
+  moduleImports: WebAssembly.ModuleImportDescriptor[]
+): void {
+  const usesWasi = moduleImports.some(
+    (i) => i.module === 'wasi_snapshot_preview1'
+  )
+  if (usesWasi && typeof wasi.initialize === 'function') {
+    debug(`Calling wasi.initialize() for AssemblyScript plugin ${pluginId}`)
+    wasi.initialize(instance)
+  }
+}
+
 /**
  * Load a standard WASI P1 plugin (AssemblyScript or Rust library)
  */
@@ -104,8 +178,10 @@ export async function loadStandardPlugin(
     app,
     memoryRef,
     rawExports: rawExportsRef,
-    asLoaderInstance: asLoaderRef
+    asLoaderInstance: asLoaderRef,
+    vfsRoot
   })
+  const linkedEnvImports = withMissingImportStubs(pluginId, imports, envImports)
 
   // Initialize as-fetch handler for network capability
   let fetchHandler: any = null
@@ -162,7 +238,7 @@ export async function loadStandardPlugin(
 
     asLoaderInstance = await loader.instantiate(module, {
       wasi_snapshot_preview1: wasiImports.wasi_snapshot_preview1 || wasiImports,
-      env: envImports,
+      env: linkedEnvImports,
       ...fetchImports
     })
 
@@ -174,7 +250,7 @@ export async function loadStandardPlugin(
     // Standard WebAssembly instantiation for Rust plugins
     instance = await WebAssembly.instantiate(module, {
       wasi_snapshot_preview1: wasiImports.wasi_snapshot_preview1 || wasiImports,
-      env: envImports,
+      env: linkedEnvImports,
       ...fetchImports
     } as any)
     rawExports = instance.exports as any
@@ -187,6 +263,8 @@ export async function loadStandardPlugin(
     memoryRef.current = rawExports.memory as WebAssembly.Memory
   }
 
+  assertAbiVersionSupported(pluginId, rawExports)
+
   // Store reference for Asyncify resume
   let asyncifyResumeFunction: (() => any) | null = null
 
@@ -213,6 +291,7 @@ export async function loadStandardPlugin(
     }
   } else if (isAssemblyScriptPlugin) {
     debug(`Initialized AssemblyScript plugin: ${pluginId}`)
+    initializeAssemblyScriptWasi(pluginId, wasi, instance, imports)
   } else {
     throw new Error(`Unknown WASM plugin format for ${pluginId}`)
   }
@@ -277,6 +356,7 @@ function createPluginExports(
   let schemaFunc: () => string
   let startFunc: (config: string) => number | Promise<number>
   let stopFunc: () => number
+  let subscriptionsFunc: (() => string) | undefined = undefined
 
   if (isAssemblyScriptPlugin && asLoaderInstance) {
     idFunc = () => {
@@ -389,6 +469,12 @@ function createPluginExports(
       return result
     }
     stopFunc = () => asLoaderInstance.exports.plugin_stop()
+    if (rawExports.plugin_subscriptions) {
+      subscriptionsFunc = () => {
+        const ptr = asLoaderInstance.exports.plugin_subscriptions()
+        return asLoaderInstance.exports.__getString(ptr)
+      }
+    }
   } else if (isRustLibraryPlugin) {
     debug(`Setting up Rust library plugin exports with buffer-based strings`)
 
@@ -434,6 +520,9 @@ function createPluginExports(
     idFunc = () => callRustStringFunc('plugin_id')
     nameFunc = () => callRustStringFunc('plugin_name')
     schemaFunc = () => callRustStringFunc('plugin_schema')
+    if (rawExports.plugin_subscriptions) {
+      subscriptionsFunc = () => callRustStringFunc('plugin_subscriptions')
+    }
 
     startFunc = (config: string) => {
       debug(
@@ -475,6 +564,7 @@ function createPluginExports(
     schemaFunc = rawExports.schema
     startFunc = rawExports.start
     stopFunc = rawExports.stop
+    subscriptionsFunc = rawExports.plugin_subscriptions
   }
 
   // Wrap http_endpoints if it exists
@@ -535,6 +625,110 @@ function createPluginExports(
     }
   }
 
+  // Wrap delta_input_handler if it exists (for plugins that modify deltas)
+  let deltaInputHandlerFunc: ((deltaJson: string) => string) | undefined =
+    undefined
+  if (rawExports.delta_input_handler) {
+    if (isAssemblyScriptPlugin && asLoaderInstance) {
+      deltaInputHandlerFunc = (deltaJson: string) => {
+        const ptr = asLoaderInstance.exports.__newString(deltaJson)
+        const resultPtr = asLoaderInstance.exports.delta_input_handler(ptr)
+        return asLoaderInstance.exports.__getString(resultPtr)
+      }
+    } else if (isRustLibraryPlugin) {
+      // Rust: (delta_ptr, delta_len, out_ptr, out_max_len) -> written_len
+      deltaInputHandlerFunc = (deltaJson: string) => {
+        const allocate = rawExports.allocate
+        if (typeof allocate !== 'function') {
+          debug('Rust plugin missing allocate export for delta_input_handler')
+          return ''
+        }
+
+        const deltaBytes = Buffer.from(deltaJson, 'utf8')
+        const deltaPtr = allocate(deltaBytes.length)
+        const outMaxLen = 65536 // 64KB, same as provider responses
+        const outPtr = allocate(outMaxLen)
+        try {
+          const memory = rawExports.memory as WebAssembly.Memory
+          new Uint8Array(memory.buffer).set(deltaBytes, deltaPtr)
+          const written = rawExports.delta_input_handler(
+            deltaPtr,
+            deltaBytes.length,
+            outPtr,
+            outMaxLen
+          )
+          return written > 0
+            ? Buffer.from(memory.buffer, outPtr, written).toString('utf8')
+            : ''
+        } finally {
+          const deallocate = rawExports.deallocate
+          if (typeof deallocate === 'function') {
+            deallocate(deltaPtr, deltaBytes.length)
+            deallocate(outPtr, outMaxLen)
+          }
+        }
+      }
+    } else {
+      deltaInputHandlerFunc = rawExports.delta_input_handler
+    }
+  }
+
+  // Wrap plugin_export_state/plugin_import_state if they exist (for plugins
+  // that keep their in-memory state across a module reload)
+  let exportStateFunc: (() => string) | undefined = undefined
+  let importStateFunc: ((state: string) => number) | undefined = undefined
+  if (rawExports.plugin_export_state && rawExports.plugin_import_state) {
+    if (isAssemblyScriptPlugin && asLoaderInstance) {
+      exportStateFunc = () =>
+        asLoaderInstance.exports.__getString(
+          asLoaderInstance.exports.plugin_export_state()
+        )
+      importStateFunc = (state: string) =>
+        asLoaderInstance.exports.plugin_import_state(
+          asLoaderInstance.exports.__newString(state)
+        )
+    } else if (isRustLibraryPlugin) {
+      // Rust: plugin_export_state(out_ptr, out_max_len) -> written_len, or
+      // minus the required size if the buffer is too small
+      exportStateFunc = () => {
+        let maxLen = 65536
+        for (let attempt = 0; attempt < 2; attempt++) {
+          const outLen = maxLen
+          const outPtr = rawExports.allocate(outLen)
+          try {
+            const written = rawExports.plugin_export_state(outPtr, outLen)
+            if (written >= 0) {
+              const memory = rawExports.memory as WebAssembly.Memory
+              return Buffer.from(memory.buffer, outPtr, written).toString(
+                'utf8'
+              )
+            }
+            maxLen = -written
+          } finally {
+            if (typeof rawExports.deallocate === 'function') {
+              rawExports.deallocate(outPtr, outLen)
+            }
+          }
+        }
+        throw new Error('plugin_export_state did not fit its buffer')
+      }
+      // Rust: plugin_import_state(state_ptr, state_len) -> i32
+      importStateFunc = (state: string) => {
+        const stateBytes = Buffer.from(state, 'utf8')
+        const statePtr = rawExports.allocate(stateBytes.length)
+        try {
+          const memory = rawExports.memory as WebAssembly.Memory
+          new Uint8Array(memory.buffer).set(stateBytes, statePtr)
+          return rawExports.plugin_import_state(statePtr, stateBytes.length)
+        } finally {
+          if (typeof rawExports.deallocate === 'function') {
+            rawExports.deallocate(statePtr, stateBytes.length)
+          }
+        }
+      }
+    }
+  }
+
   return {
     id: idFunc,
     name: nameFunc,
@@ -544,6 +738,12 @@ function createPluginExports(
     memory: rawExports.memory,
     ...(httpEndpointsFunc && { http_endpoints: httpEndpointsFunc }),
     ...(pollFunc && { poll: pollFunc }),
-    ...(deltaHandlerFunc && { delta_handler: deltaHandlerFunc })
+    ...(deltaHandlerFunc && { delta_handler: deltaHandlerFunc }),
+    ...(deltaInputHandlerFunc && {
+      delta_input_handler: deltaInputHandlerFunc
+    }),
+    ...(subscriptionsFunc && { plugin_subscriptions: subscriptionsFunc }),
+    ...(exportStateFunc && { plugin_export_state: exportStateFunc }),
+    ...(importStateFunc && { plugin_import_state: importStateFunc })
   }
 }
@@ -20,6 +20,7 @@ export interface WasmCapabilities {
   weatherProvider?: boolean // Can register as a weather provider
   radarProvider?: boolean // Can register as a radar provider
   rawSockets?: boolean // Can open UDP/TCP sockets for radar, NMEA, etc.
+  accessRequests?: boolean // Can submit device access requests
 }
 
 /**
@@ -65,6 +66,19 @@ export interface WasmPluginExports {
   // Optional: Delta handler - receives Signal K deltas as JSON strings
   // Enables plugins to react to navigation data changes, course updates, etc.
   delta_handler?: (deltaJson: string) => void
+  // Optional: Delta input handler - sees deltas before they reach the data
+  // model and returns the JSON to forward, e.g. with calibrated values.
+  // An empty result forwards the delta unchanged.
+  delta_input_handler?: (deltaJson: string) => string
+  // Optional: Subscription manifest - JSON array of { path, context?,
+  // period?, policy?, minPeriod? } rows. When present, delta_handler only
+  // receives deltas matching these subscriptions instead of every delta.
+  plugin_subscriptions?: () => string
+  // Optional: State hand-over when the module is reloaded. The running
+  // instance's plugin_export_state result is passed to the new instance's
+  // plugin_import_state before it is started; 0 = success.
+  plugin_export_state?: () => string
+  plugin_import_state?: (state: string) => number
 }
 
 /**
@@ -73,6 +87,9 @@ export interface WasmPluginExports {
 export interface WasmResourceProvider {
   pluginId: string
   resourceType: string
+  // Validator for the JSON Schema of a custom resource type, returns an
+  // error message for invalid resources
+  validateSchema?: (value: object) => string | null
   // Reference to the plugin instance for calling handlers
   pluginInstance: WasmPluginInstance | null
 }
@@ -171,8 +171,14 @@ export class WasmRuntime {
 
   /**
    * Reload a WASM plugin (unload + load)
+   * @param pluginId The plugin ID the instance was loaded with
+   * @param app Signal K app reference, so the new instance can emit deltas
+   *   and register providers
    */
-  async reloadPlugin(pluginId: string): Promise<WasmPluginInstance> {
+  async reloadPlugin(
+    pluginId: string,
+    app?: any
+  ): Promise<WasmPluginInstance> {
     const oldInstance = this.instances.get(pluginId)
     if (!oldInstance) {
       throw new Error(`Plugin ${pluginId} not loaded`)
@@ -181,10 +187,10 @@ export class WasmRuntime {
     const { wasmPath, vfsRoot, capabilities } = oldInstance
 
     // Unload old instance
-    await this.unloadPlugin(pluginId)
+    await this.unloadPlugin(pluginId, app)
 
     // Load new instance
-    return this.loadPlugin(pluginId, wasmPath, vfsRoot, capabilities)
+    return this.loadPlugin(pluginId, wasmPath, vfsRoot, capabilities, app)
   }
 
   /**
@@ -475,6 +475,32 @@ describe('Security', () => {
     result.status.should.equal(200)
   })
 
+  it('plugin token allows read', async function () {
+    const pluginToken = server.app.securityStrategy.generatePluginToken(
+      'test-plugin',
+      '1h'
+    )
+    const result = await fetch(`${url}/signalk/v1/api/vessels/self`, {
+      headers: {
+        Authorization: `JWT ${pluginToken}`
+      }
+    })
+    result.status.should.equal(200)
+  })
+
+  it('plugin token does not grant admin access', async function () {
+    const pluginToken = server.app.securityStrategy.generatePluginToken(
+      'test-plugin',
+      '1h'
+    )
+    const result = await fetch(`${url}/skServer/plugins`, {
+      headers: {
+        Authorization: `JWT ${pluginToken}`
+      }
+    })
+    result.status.should.equal(401)
+  })
+
   it('admin request fails', async function () {
     const result = await fetch(`${url}/skServer/plugins`)
     result.status.should.equal(401)
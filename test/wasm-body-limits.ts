@@ -0,0 +1,94 @@
+import { expect } from 'chai'
+import express, { Request, Response } from 'express'
+import * as http from 'http'
+import { AddressInfo } from 'net'
+import {
+  clearEndpointBodyLimits,
+  endpointBodyLimitParser,
+  setEndpointBodyLimits
+} from '../src/wasm/loader/body-limits'
+
+describe('WASM endpoint body limits', () => {
+  let server: http.Server
+  let port: number
+
+  before(async () => {
+    const app = express()
+    app.use(endpointBodyLimitParser)
+    app.use(express.json({ limit: '10mb' }))
+    app.post('*', (req: Request, res: Response) => res.json(req.body))
+    server = app.listen(0, '127.0.0.1')
+    await new Promise((resolve) => server.once('listening', resolve))
+    port = (server.address() as AddressInfo).port
+  })
+
+  after(() => server.close())
+
+  beforeEach(() =>
+    setEndpointBodyLimits('charts', [
+      { method: 'post', path: '/api/import', maxBodySize: 100 },
+      { method: 'POST', path: '/api/rescan' }
+    ])
+  )
+
+  afterEach(() => clearEndpointBodyLimits('charts'))
+
+  // Send a JSON body in chunks, without a Content-Length header
+  function postChunked(
+    path: string,
+    body: string
+  ): Promise<{ status: number; body: unknown }> {
+    return new Promise((resolve, reject) => {
+      const req = http.request(
+        {
+          host: '127.0.0.1',
+          port,
+          path,
+          method: 'POST',
+          headers: { 'content-type': 'application/json' }
+        },
+        (res) => {
+          let data = ''
+          res.on('data', (chunk) => (data += chunk))
+          res.on('end', () =>
+            resolve({ status: res.statusCode!, body: JSON.parse(data) })
+          )
+        }
+      )
+      req.on('error', reject)
+      for (let i = 0; i < body.length; i += 16) {
+        req.write(body.substring(i, i + 16))
+      }
+      req.end()
+    })
+  }
+
+  const largeBody = JSON.stringify({ name: 'x'.repeat(200) })
+
+  it('refuses chunked bodies over the declared limit', async () => {
+    const response = await postChunked('/plugins/charts/api/import', largeBody)
+    expect(response).to.deep.equal({
+      status: 413,
+      body: { error: 'Request body exceeds 100 bytes' }
+    })
+  })
+
+  it('passes bodies within the limit on to the handler', async () => {
+    const response = await postChunked(
+      '/skServer/plugins/charts/api/import',
+      '{"name":"Harbour"}'
+    )
+    expect(response).to.deep.equal({ status: 200, body: { name: 'Harbour' } })
+  })
+
+  it('leaves endpoints without a limit to the server-wide parser', async () => {
+    const response = await postChunked('/plugins/charts/api/rescan', largeBody)
+    expect(response.status).to.equal(200)
+  })
+
+  it('forgets the limits of cleared plugins', async () => {
+    clearEndpointBodyLimits('charts')
+    const response = await postChunked('/plugins/charts/api/import', largeBody)
+    expect(response.status).to.equal(200)
+  })
+})
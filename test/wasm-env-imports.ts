@@ -0,0 +1,709 @@
+import { expect } from 'chai'
+import * as fs from 'fs'
+import * as os from 'os'
+import * as path from 'path'
+import {
+  clearReportedMemory,
+  createEnvImports,
+  getReportedMemory
+} from '../src/wasm/bindings/env-imports'
+import { releaseAllLocksForPlugin } from '../src/wasm/bindings/locks'
+import { WasmCapabilities } from '../src/wasm/types'
+
+const defaultCapabilities: WasmCapabilities = {
+  network: false,
+  storage: 'vfs-only',
+  dataRead: true,
+  dataWrite: true,
+  serialPorts: false,
+  putHandlers: false
+}
+
+function createImports(
+  capabilities: Partial<WasmCapabilities> = {},
+  app?: object,
+  vfsRoot?: string
+) {
+  const memoryRef = { current: new WebAssembly.Memory({ initial: 1 }) }
+  const imports = createEnvImports({
+    pluginId: 'test-plugin',
+    capabilities: { ...defaultCapabilities, ...capabilities },
+    app,
+    memoryRef,
+    rawExports: { current: null },
+    asLoaderInstance: { current: null },
+    vfsRoot
+  })
+  return { imports, memory: memoryRef.current }
+}
+
+function writeString(memory: WebAssembly.Memory, ptr: number, value: string) {
+  const bytes = Buffer.from(value, 'utf8')
+  new Uint8Array(memory.buffer).set(bytes, ptr)
+  return bytes.length
+}
+
+function readString(memory: WebAssembly.Memory, ptr: number, len: number) {
+  return Buffer.from(memory.buffer, ptr, len).toString('utf8')
+}
+
+const OUT_PTR = 4096
+const OUT_MAX_LEN = 4096
+
+describe('WASM env imports', () => {
+  describe('host clock', () => {
+    it('sk_now_ms returns wall-clock epoch milliseconds', () => {
+      const { imports } = createImports()
+      const before = Date.now()
+      const now = imports.sk_now_ms()
+      expect(now).to.be.within(before, Date.now())
+    })
+
+    it('sk_monotonic_ms never goes backwards', () => {
+      const { imports } = createImports()
+      const first = imports.sk_monotonic_ms()
+      const second = imports.sk_monotonic_ms()
+      expect(second).to.be.at.least(first)
+    })
+  })
+
+  describe('sk_get_connectivity', () => {
+    afterEach(() => {
+      delete process.env.WASM_CONNECTIVITY
+    })
+
+    it('reports the level set with WASM_CONNECTIVITY', () => {
+      const { imports } = createImports()
+      process.env.WASM_CONNECTIVITY = 'offline'
+      expect(imports.sk_get_connectivity()).to.equal(0)
+      process.env.WASM_CONNECTIVITY = 'online'
+      expect(imports.sk_get_connectivity()).to.equal(2)
+    })
+  })
+
+  describe('sk_report_memory', () => {
+    afterEach(() => clearReportedMemory('test-plugin'))
+
+    it('records the heap usage reported by the plugin', () => {
+      const { imports } = createImports()
+      imports.sk_report_memory(2048, 4096)
+      expect(getReportedMemory('test-plugin')).to.deep.equal({
+        heapInUse: 2048,
+        heapPeak: 4096
+      })
+      imports.sk_report_memory(8192, 4096)
+      expect(getReportedMemory('test-plugin')?.heapPeak).to.equal(8192)
+    })
+
+    it('ignores invalid values', () => {
+      const { imports } = createImports()
+      imports.sk_report_memory(NaN, Infinity)
+      expect(getReportedMemory('test-plugin')).to.equal(undefined)
+    })
+  })
+
+  describe('sk_random_bytes', () => {
+    it('fills the requested region of plugin memory', () => {
+      const { imports, memory } = createImports()
+      const view = new Uint8Array(memory.buffer, 0, 64)
+      expect(imports.sk_random_bytes(16, 32)).to.equal(32)
+      expect(view.subarray(0, 16).every((b) => b === 0)).to.equal(true)
+      expect(view.subarray(48, 64).every((b) => b === 0)).to.equal(true)
+      expect(view.subarray(16, 48).some((b) => b !== 0)).to.equal(true)
+    })
+
+    it('returns -1 when the region is outside plugin memory', () => {
+      const { imports, memory } = createImports()
+      const nearEnd = memory.buffer.byteLength - 4
+      expect(imports.sk_random_bytes(nearEnd, 8)).to.equal(-1)
+    })
+  })
+
+  describe('access requests', () => {
+    type UpdateCb = (reply: object) => void
+    interface SubmittedRequest {
+      requestId: string
+      accessRequest: { clientId: string }
+    }
+
+    function createSecureApp() {
+      const submitted: {
+        request?: SubmittedRequest
+        ip?: string
+        updateCb?: UpdateCb
+      } = {}
+      const app = {
+        securityStrategy: {
+          isDummy: () => false,
+          configFromArguments: true,
+          securityConfig: {},
+          requestAccess: (
+            _config: object,
+            request: SubmittedRequest,
+            ip: string,
+            updateCb: UpdateCb
+          ) => {
+            Object.assign(submitted, { request, ip, updateCb })
+            return Promise.resolve({
+              state: 'PENDING',
+              requestId: request.requestId,
+              statusCode: 202
+            })
+          }
+        }
+      }
+      return { app, submitted }
+    }
+
+    it('submits a request and exposes the approved token once', async () => {
+      const { app, submitted } = createSecureApp()
+      const { imports, memory } = createImports({ accessRequests: true }, app)
+      const reqLen = writeString(
+        memory,
+        0,
+        JSON.stringify({ clientId: 'tablet-1', description: 'Cockpit tablet' })
+      )
+
+      const idLen = imports.sk_request_access(0, reqLen, OUT_PTR, OUT_MAX_LEN)
+      expect(idLen).to.be.greaterThan(0)
+      const requestId = readString(memory, OUT_PTR, idLen)
+      expect(submitted.request?.requestId).to.equal(requestId)
+      expect(submitted.request?.accessRequest.clientId).to.equal('tablet-1')
+      expect(submitted.ip).to.equal('plugin:test-plugin')
+
+      await Promise.resolve()
+      submitted.updateCb!({
+        state: 'COMPLETED',
+        requestId,
+        statusCode: 200,
+        accessRequest: { permission: 'APPROVED', token: 'secret-token' }
+      })
+
+      const idPtr = 8192
+      writeString(memory, idPtr, requestId)
+      const replyLen = imports.sk_get_access_request(
+        idPtr,
+        idLen,
+        OUT_PTR,
+        OUT_MAX_LEN
+      )
+      const reply = JSON.parse(readString(memory, OUT_PTR, replyLen))
+      expect(reply.accessRequest.token).to.equal('secret-token')
+      expect(
+        imports.sk_get_access_request(idPtr, idLen, OUT_PTR, OUT_MAX_LEN)
+      ).to.equal(0)
+    })
+
+    it('requires the accessRequests capability', () => {
+      const { app, submitted } = createSecureApp()
+      const { imports, memory } = createImports({}, app)
+      const reqLen = writeString(memory, 0, '{"clientId":"x"}')
+      const idLen = imports.sk_request_access(0, reqLen, OUT_PTR, OUT_MAX_LEN)
+      expect(idLen).to.equal(0)
+      expect(submitted.request).to.equal(undefined)
+    })
+
+    it('refuses requests when security is disabled', () => {
+      const app = { securityStrategy: { isDummy: () => true } }
+      const { imports, memory } = createImports({ accessRequests: true }, app)
+      const reqLen = writeString(memory, 0, '{"clientId":"x"}')
+      const idLen = imports.sk_request_access(0, reqLen, OUT_PTR, OUT_MAX_LEN)
+      expect(idLen).to.equal(0)
+    })
+
+    it('does not reveal requests made by other plugins', () => {
+      const { imports, memory } = createImports()
+      const idLen = writeString(memory, 0, 'someone-elses-request')
+      const replyLen = imports.sk_get_access_request(
+        0,
+        idLen,
+        OUT_PTR,
+        OUT_MAX_LEN
+      )
+      expect(replyLen).to.equal(0)
+    })
+  })
+
+  describe('sk_get_server_token', () => {
+    const secureApp = {
+      securityStrategy: {
+        isDummy: () => false,
+        generatePluginToken: (pluginId: string, expiration: string) =>
+          `token-for-${pluginId}-${expiration}`
+      }
+    }
+
+    it('returns a plugin-scoped token when security is enabled', () => {
+      const { imports, memory } = createImports({}, secureApp)
+      const len = imports.sk_get_server_token(OUT_PTR, OUT_MAX_LEN)
+      expect(readString(memory, OUT_PTR, len)).to.equal(
+        'token-for-test-plugin-1h'
+      )
+    })
+
+    it('requires the dataRead capability', () => {
+      const { imports } = createImports({ dataRead: false }, secureApp)
+      expect(imports.sk_get_server_token(OUT_PTR, OUT_MAX_LEN)).to.equal(0)
+    })
+
+    it('returns nothing when security is disabled', () => {
+      const app = { securityStrategy: { isDummy: () => true } }
+      const { imports } = createImports({}, app)
+      expect(imports.sk_get_server_token(OUT_PTR, OUT_MAX_LEN)).to.equal(0)
+    })
+  })
+
+  describe('resource queries', () => {
+    function createResourcesApp(
+      listResources: (type: string, params: object) => Promise<object>
+    ) {
+      return { resourcesApi: { listResources } }
+    }
+
+    it('lists resources of a type across providers', async () => {
+      const seen: { type?: string; params?: object } = {}
+      const app = createResourcesApp((type, params) => {
+        Object.assign(seen, { type, params })
+        return Promise.resolve({ 'chart-1': { name: 'Harbour' } })
+      })
+      const { imports, memory } = createImports({}, app)
+      const typeLen = writeString(memory, 0, 'charts')
+      const queryLen = writeString(memory, 64, '{"format":"mbtiles"}')
+
+      const queryId = imports.sk_list_resources(0, typeLen, 64, queryLen)
+      expect(queryId).to.be.greaterThan(0)
+      expect(seen).to.deep.equal({
+        type: 'charts',
+        params: { format: 'mbtiles' }
+      })
+
+      await Promise.resolve()
+      const len = imports.sk_get_resource_list(queryId, OUT_PTR, OUT_MAX_LEN)
+      expect(JSON.parse(readString(memory, OUT_PTR, len))).to.deep.equal({
+        state: 'COMPLETED',
+        resources: { 'chart-1': { name: 'Harbour' } }
+      })
+      const again = imports.sk_get_resource_list(queryId, OUT_PTR, OUT_MAX_LEN)
+      expect(again).to.equal(0)
+    })
+
+    it('reports pending and failed queries', async () => {
+      const app = createResourcesApp(() =>
+        Promise.reject(new Error('No provider for charts'))
+      )
+      const { imports, memory } = createImports({}, app)
+      const typeLen = writeString(memory, 0, 'charts')
+      const queryId = imports.sk_list_resources(0, typeLen, 0, 0)
+
+      const pendingLen = imports.sk_get_resource_list(
+        queryId,
+        OUT_PTR,
+        OUT_MAX_LEN
+      )
+      const pending = JSON.parse(readString(memory, OUT_PTR, pendingLen))
+      expect(pending.state).to.equal('PENDING')
+
+      await Promise.resolve()
+      await Promise.resolve()
+      const len = imports.sk_get_resource_list(queryId, OUT_PTR, OUT_MAX_LEN)
+      const failed = JSON.parse(readString(memory, OUT_PTR, len))
+      expect(failed).to.deep.equal({
+        state: 'FAILED',
+        message: 'No provider for charts'
+      })
+    })
+
+    it('requires the dataRead capability', () => {
+      const app = createResourcesApp(() => Promise.resolve({}))
+      const { imports, memory } = createImports({ dataRead: false }, app)
+      const typeLen = writeString(memory, 0, 'charts')
+      expect(imports.sk_list_resources(0, typeLen, 0, 0)).to.equal(0)
+    })
+  })
+
+  describe('sk_has_capability', () => {
+    function hasCapability(
+      name: string,
+      capabilities: Partial<WasmCapabilities> = {}
+    ) {
+      const { imports, memory } = createImports(capabilities)
+      const len = writeString(memory, 0, name)
+      return imports.sk_has_capability(0, len)
+    }
+
+    it('reports granted capabilities', () => {
+      expect(hasCapability('network', { network: true })).to.equal(1)
+      expect(hasCapability('network')).to.equal(0)
+      expect(hasCapability('dataRead')).to.equal(1)
+      expect(hasCapability('resourceProvider')).to.equal(0)
+    })
+
+    it('reports storage unless it is none', () => {
+      expect(hasCapability('storage')).to.equal(1)
+      expect(hasCapability('storage', { storage: 'none' })).to.equal(0)
+    })
+
+    it('reports whether a host function is provided', () => {
+      expect(hasCapability('sk_now_ms')).to.equal(1)
+      expect(hasCapability('sk_from_the_future')).to.equal(0)
+    })
+
+    it('returns 0 for unknown capabilities', () => {
+      expect(hasCapability('teleport')).to.equal(0)
+    })
+  })
+
+  describe('sk_handle_binary', () => {
+    function createEmitter() {
+      const emitted: Array<{ event: string; value: unknown }> = []
+      const app = {
+        emit: (event: string, value: unknown) => {
+          emitted.push({ event, value })
+          return true
+        }
+      }
+      return { app, emitted }
+    }
+
+    function send(
+      imports: ReturnType<typeof createImports>['imports'],
+      memory: WebAssembly.Memory,
+      kind: string,
+      data: number[]
+    ) {
+      const kindLen = writeString(memory, 0, kind)
+      new Uint8Array(memory.buffer).set(data, 64)
+      return imports.sk_handle_binary(0, kindLen, 64, data.length)
+    }
+
+    it('emits NMEA 2000 frames in Actisense format', () => {
+      const { app, emitted } = createEmitter()
+      const { imports, memory } = createImports({}, app)
+      // Priority 2, PGN 127250 (0x01f112), broadcast
+      const frame = [2, 0x12, 0xf1, 0x01, 255, 0xff, 0x2e, 0x00, 0x0a]
+      expect(send(imports, memory, 'nmea2000', frame)).to.equal(1)
+      expect(emitted).to.have.length(1)
+      expect(emitted[0].event).to.equal('nmea2000out')
+      expect(String(emitted[0].value).split(',').slice(1)).to.deep.equal([
+        '2',
+        '127250',
+        '0',
+        '255',
+        '4',
+        'ff',
+        '2e',
+        '00',
+        '0a'
+      ])
+    })
+
+    it('emits NMEA 0183 sentences without the line ending', () => {
+      const { app, emitted } = createEmitter()
+      const { imports, memory } = createImports({}, app)
+      const sentence = Array.from(Buffer.from('$IIMWV,045,R,5.2,N,A*25\r\n'))
+      expect(send(imports, memory, 'nmea0183', sentence)).to.equal(1)
+      expect(emitted).to.deep.equal([
+        { event: 'nmea0183out', value: '$IIMWV,045,R,5.2,N,A*25' }
+      ])
+    })
+
+    it('rejects unknown kinds and invalid frames', () => {
+      const { app, emitted } = createEmitter()
+      const { imports, memory } = createImports({}, app)
+      expect(send(imports, memory, 'can', [1, 2, 3])).to.equal(0)
+      expect(send(imports, memory, 'nmea2000', [2, 0x12, 0xf1])).to.equal(0)
+      expect(
+        send(imports, memory, 'nmea2000', [9, 0x12, 0xf1, 0x01, 255, 0])
+      ).to.equal(0)
+      expect(emitted).to.have.length(0)
+    })
+
+    it('requires the dataWrite capability', () => {
+      const { app, emitted } = createEmitter()
+      const { imports, memory } = createImports({ dataWrite: false }, app)
+      expect(send(imports, memory, 'nmea0183', [36])).to.equal(0)
+      expect(emitted).to.have.length(0)
+    })
+  })
+
+  describe('named locks', () => {
+    afterEach(() => {
+      releaseAllLocksForPlugin('test-plugin')
+      releaseAllLocksForPlugin('other-plugin')
+    })
+
+    function createPlugin(pluginId: string) {
+      const memory = new WebAssembly.Memory({ initial: 1 })
+      const imports = createEnvImports({
+        pluginId,
+        capabilities: defaultCapabilities,
+        memoryRef: { current: memory },
+        rawExports: { current: null },
+        asLoaderInstance: { current: null }
+      })
+      const len = writeString(memory, 0, 'charts-import')
+      return {
+        acquire: () => imports.sk_lock_acquire(0, len),
+        release: () => imports.sk_lock_release(0, len)
+      }
+    }
+
+    it('gives a lock to one plugin at a time', () => {
+      const first = createPlugin('test-plugin')
+      const second = createPlugin('other-plugin')
+      expect(first.acquire()).to.equal(1)
+      expect(first.acquire()).to.equal(1)
+      expect(second.acquire()).to.equal(0)
+      expect(second.release()).to.equal(0)
+      expect(first.release()).to.equal(1)
+      expect(second.acquire()).to.equal(1)
+    })
+
+    it('releases the locks of a stopped plugin', () => {
+      const first = createPlugin('test-plugin')
+      const second = createPlugin('other-plugin')
+      expect(first.acquire()).to.equal(1)
+      releaseAllLocksForPlugin('test-plugin')
+      expect(second.acquire()).to.equal(1)
+    })
+
+    it('rejects empty lock names', () => {
+      const { imports } = createImports()
+      expect(imports.sk_lock_acquire(0, 0)).to.equal(-1)
+      expect(imports.sk_lock_release(0, 0)).to.equal(-1)
+    })
+  })
+
+  describe('sk_register_webapp', () => {
+    type Middleware = (
+      req: { url: string },
+      res: { redirect: (url: string) => void }
+    ) => void
+    interface WebappEntry {
+      name: string
+      keywords: string[]
+      signalk: { displayName: string; appIcon?: string }
+    }
+
+    function createWebappsApp(webapps: WebappEntry[] = []) {
+      const mounted: { [path: string]: Middleware } = {}
+      const app = {
+        webapps,
+        use: (path: string, handler: Middleware) => {
+          mounted[path] = handler
+        }
+      }
+      return { app, mounted }
+    }
+
+    function register(app: object, webapp: object) {
+      const { imports, memory } = createImports({ httpEndpoints: true }, app)
+      const len = writeString(memory, 0, JSON.stringify(webapp))
+      return imports.sk_register_webapp(0, len)
+    }
+
+    function redirectOf(handler: Middleware, url: string) {
+      let location = ''
+      handler({ url }, { redirect: (target) => (location = target) })
+      return location
+    }
+
+    it('lists the plugin UI and redirects to its route', () => {
+      const { app, mounted } = createWebappsApp()
+      const result = register(app, {
+        displayName: 'Chart Manager',
+        path: '/ui/',
+        appIcon: 'icon.png'
+      })
+      expect(result).to.equal(1)
+      expect(app.webapps).to.have.length(1)
+      expect(app.webapps[0].name).to.equal('test-plugin')
+      expect(app.webapps[0].keywords).to.include('signalk-wasm-plugin')
+      expect(app.webapps[0].signalk.displayName).to.equal('Chart Manager')
+
+      const handler = mounted['/test-plugin']
+      expect(redirectOf(handler, '/')).to.equal('/plugins/test-plugin/ui/')
+      expect(redirectOf(handler, '/icon.png')).to.equal(
+        '/plugins/test-plugin/ui/icon.png'
+      )
+    })
+
+    it('updates its own entry when registered again', () => {
+      const { app, mounted } = createWebappsApp()
+      register(app, { displayName: 'Old', path: '/old/' })
+      expect(register(app, { displayName: 'New', path: '/new/' })).to.equal(1)
+      expect(app.webapps).to.have.length(1)
+      expect(app.webapps[0].signalk.displayName).to.equal('New')
+      const location = redirectOf(mounted['/test-plugin'], '/')
+      expect(location).to.equal('/plugins/test-plugin/new/')
+    })
+
+    it('does not replace a webapp installed from the package', () => {
+      const packaged = {
+        name: 'test-plugin',
+        keywords: ['signalk-webapp'],
+        signalk: { displayName: 'Packaged' }
+      }
+      const { app } = createWebappsApp([packaged])
+      expect(register(app, { displayName: 'X', path: '/ui/' })).to.equal(0)
+      expect(app.webapps).to.deep.equal([packaged])
+    })
+
+    it('requires the httpEndpoints capability', () => {
+      const { app } = createWebappsApp()
+      const { imports, memory } = createImports({}, app)
+      const len = writeString(memory, 0, '{"displayName":"X","path":"/ui/"}')
+      expect(imports.sk_register_webapp(0, len)).to.equal(0)
+    })
+  })
+
+  describe('sk_get_setting', () => {
+    const app = {
+      config: {
+        vesselName: 'Albatross',
+        vesselMMSI: '230123456',
+        getExternalPort: () => 3000,
+        settings: { security: { secretKey: 'do-not-leak' } }
+      }
+    }
+
+    function getSetting(
+      key: string,
+      capabilities: Partial<WasmCapabilities> = {}
+    ) {
+      const { imports, memory } = createImports(capabilities, app)
+      const keyLen = writeString(memory, 0, key)
+      const len = imports.sk_get_setting(0, keyLen, OUT_PTR, OUT_MAX_LEN)
+      return len > 0 ? JSON.parse(readString(memory, OUT_PTR, len)) : undefined
+    }
+
+    it('returns whitelisted settings as JSON', () => {
+      expect(getSetting('vessel.name')).to.equal('Albatross')
+      expect(getSetting('vessel.mmsi')).to.equal('230123456')
+      expect(getSetting('server.port')).to.equal(3000)
+    })
+
+    it('returns nothing for unset or unlisted settings', () => {
+      expect(getSetting('vessel.uuid')).to.equal(undefined)
+      expect(getSetting('settings.security')).to.equal(undefined)
+      expect(getSetting('constructor')).to.equal(undefined)
+    })
+
+    it('requires the dataRead capability', () => {
+      expect(getSetting('vessel.name', { dataRead: false })).to.equal(undefined)
+    })
+  })
+
+  describe('sqlite', () => {
+    let vfsRoot: string
+
+    beforeEach(() => {
+      vfsRoot = fs.mkdtempSync(path.join(os.tmpdir(), 'sk-wasm-sqlite-'))
+      fs.mkdirSync(path.join(vfsRoot, 'data'))
+    })
+
+    afterEach(() => {
+      fs.rmSync(vfsRoot, { recursive: true, force: true })
+    })
+
+    function open(
+      dbPath: string,
+      capabilities: Partial<WasmCapabilities> = {}
+    ) {
+      const { imports, memory } = createImports(
+        capabilities,
+        undefined,
+        vfsRoot
+      )
+      const len = writeString(memory, 0, dbPath)
+      return { imports, memory, handle: imports.sk_sqlite_open(0, len) }
+    }
+
+    it('requires the storage capability', () => {
+      const { handle } = open('data/tiles.mbtiles', { storage: 'none' })
+      expect(handle).to.equal(-1)
+    })
+
+    it('refuses databases outside the VFS', () => {
+      const outside = `${vfsRoot}-outside.db`
+      fs.writeFileSync(outside, '')
+      fs.symlinkSync(outside, path.join(vfsRoot, 'data/link.db'))
+      try {
+        expect(open(`../${path.basename(outside)}`).handle).to.equal(-1)
+        expect(open('data/link.db').handle).to.equal(-1)
+      } finally {
+        fs.rmSync(outside)
+      }
+    })
+
+    it('refuses ATTACH and VACUUM statements', () => {
+      fs.writeFileSync(path.join(vfsRoot, 'data/tiles.mbtiles'), '')
+      const { imports, memory, handle } = open('data/tiles.mbtiles')
+      for (const sql of [
+        `ATTACH DATABASE '${vfsRoot}-other.db' AS other`,
+        `vacuum into '${vfsRoot}-copy.db'`
+      ]) {
+        const sqlLen = writeString(memory, 0, sql)
+        expect(imports.sk_sqlite_query(handle, 0, sqlLen, 0, 0)).to.equal(-1)
+      }
+      expect(fs.existsSync(`${vfsRoot}-copy.db`)).to.equal(false)
+    })
+
+    it('rejects unknown database and query handles', () => {
+      const { imports } = createImports({}, undefined, vfsRoot)
+      expect(imports.sk_sqlite_query(999, 0, 0, 0, 0)).to.equal(-1)
+      expect(imports.sk_sqlite_next_row(999, OUT_PTR, 64)).to.equal(-1)
+    })
+
+    it('streams rows of a parameterized query', function () {
+      let DatabaseSync: new (file: string) => {
+        exec(sql: string): void
+        prepare(sql: string): { run(...params: unknown[]): unknown }
+        close(): void
+      }
+      try {
+        DatabaseSync = require('node:sqlite').DatabaseSync
+      } catch {
+        this.skip()
+      }
+      const setup = new DatabaseSync(path.join(vfsRoot, 'data/tiles.mbtiles'))
+      setup.exec(
+        'CREATE TABLE tiles ' +
+          '(zoom_level INTEGER, tile_row INTEGER, tile_data BLOB)'
+      )
+      const insert = setup.prepare('INSERT INTO tiles VALUES (?, ?, ?)')
+      insert.run(1, 0, Buffer.from('a'))
+      insert.run(1, 1, Buffer.from('b'))
+      insert.run(2, 0, Buffer.from('c'))
+      setup.close()
+
+      const { imports, memory, handle } = open('/data/tiles.mbtiles')
+      expect(handle).to.be.above(0)
+      const sqlLen = writeString(
+        memory,
+        0,
+        'SELECT tile_row, tile_data FROM tiles ' +
+          'WHERE zoom_level = ? ORDER BY tile_row'
+      )
+      const paramsLen = writeString(memory, 1024, '[1]')
+      const query = imports.sk_sqlite_query(handle, 0, sqlLen, 1024, paramsLen)
+      expect(query).to.be.above(0)
+
+      const nextRow = (maxLen = OUT_MAX_LEN) =>
+        imports.sk_sqlite_next_row(query, OUT_PTR, maxLen)
+      const first = '{"tile_row":0,"tile_data":"YQ=="}'
+      expect(nextRow(8)).to.equal(-first.length)
+      expect(readString(memory, OUT_PTR, nextRow())).to.equal(first)
+      const second = readString(memory, OUT_PTR, nextRow())
+      expect(JSON.parse(second)).to.deep.equal({
+        tile_row: 1,
+        tile_data: 'Yg=='
+      })
+      expect(nextRow()).to.equal(0)
+      expect(nextRow()).to.equal(-1)
+
+      imports.sk_sqlite_close(handle)
+      expect(imports.sk_sqlite_query(handle, 0, sqlLen, 0, 0)).to.equal(-1)
+    })
+  })
+})
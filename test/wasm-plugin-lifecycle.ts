@@ -0,0 +1,577 @@
+import { expect } from 'chai'
+import express from 'express'
+import * as fs from 'fs'
+import { AddressInfo } from 'net'
+import * as os from 'os'
+import * as path from 'path'
+import {
+  Delta,
+  DeltaInputHandler,
+  RoutePermission
+} from '@signalk/server-api'
+import { WasmPlugin } from '../src/wasm/loader/types'
+import { WasmCapabilities } from '../src/wasm/types'
+import { getWasmRuntime } from '../src/wasm/wasm-runtime'
+import { wasmPlugins } from '../src/wasm/loader/plugin-registry'
+import { derivePluginId } from '../src/pluginid'
+import { createEnvImports } from '../src/wasm/bindings/env-imports'
+import { createLockBindings } from '../src/wasm/bindings/locks'
+import { getPluginMemoryUsage } from '../src/wasm/loader/plugin-routes'
+import {
+  exportPluginState,
+  handleWasmPluginCrash,
+  importPluginState,
+  registerWasmDeltaInputHandler,
+  reloadWasmPlugin,
+  shutdownAllWasmPlugins,
+  startWasmPlugin,
+  stopWasmPlugin,
+  subscribeFromManifest
+} from '../src/wasm/loader/plugin-lifecycle'
+
+function uleb(value: number): number[] {
+  const bytes: number[] = []
+  do {
+    let byte = value & 0x7f
+    value >>>= 7
+    if (value !== 0) {
+      byte |= 0x80
+    }
+    bytes.push(byte)
+  } while (value !== 0)
+  return bytes
+}
+
+// Signed LEB128 of a non-negative value, as i32.const takes
+function sleb(value: number): number[] {
+  const bytes: number[] = []
+  for (;;) {
+    const byte = value & 0x7f
+    value >>>= 7
+    if (value === 0 && (byte & 0x40) === 0) {
+      bytes.push(byte)
+      return bytes
+    }
+    bytes.push(byte | 0x80)
+  }
+}
+
+function vec(items: number[][]): number[] {
+  return [...uleb(items.length), ...items.flat()]
+}
+
+function section(id: number, body: number[]): number[] {
+  return [id, ...uleb(body.length), ...body]
+}
+
+/**
+ * A minimal Rust-style library plugin whose state is a string kept in
+ * memory at offset 1024, set with plugin_import_state and returned by
+ * plugin_export_state. A fresh instance has an empty state.
+ * http_endpoints returns the given endpoint list from offset 2048.
+ */
+function statePluginModule(endpoints: object[] = []): Buffer {
+  const I32 = 0x7f
+  const STATE_OFFSET = [0x41, 0x80, 0x08] // i32.const 1024
+  const ENDPOINTS_OFFSET = [0x41, 0x80, 0x10] // i32.const 2048
+  const MEMORY_COPY = [0xfc, 0x0a, 0x00, 0x00]
+  const endpointsJson = [...Buffer.from(JSON.stringify(endpoints))]
+  const ENDPOINTS_LEN = [0x41, ...sleb(endpointsJson.length)]
+  const bodies = [
+    // plugin_id, plugin_start, plugin_stop: return 0
+    [0x41, 0x00],
+    [0x41, 0x00],
+    [0x41, 0x00],
+    // allocate: one scratch buffer at offset 4096
+    [0x41, 0x80, 0x20],
+    // plugin_export_state(out_ptr, out_max_len): copy the state out
+    [0x20, 0x00, ...STATE_OFFSET, 0x23, 0x00, ...MEMORY_COPY, 0x23, 0x00],
+    // plugin_import_state(state_ptr, state_len): copy the state in
+    [
+      ...STATE_OFFSET,
+      0x20,
+      0x00,
+      0x20,
+      0x01,
+      ...MEMORY_COPY,
+      0x20,
+      0x01,
+      0x24,
+      0x00,
+      0x41,
+      0x00
+    ],
+    // http_endpoints(out_ptr, out_max_len): copy the endpoint list out
+    [0x20, 0x00, ...ENDPOINTS_OFFSET, ...ENDPOINTS_LEN, ...MEMORY_COPY].concat(
+      ENDPOINTS_LEN
+    )
+  ].map((code) => [0x00, ...code, 0x0b])
+  const exports: Array<[string, number, number]> = [
+    ['memory', 2, 0],
+    ['plugin_id', 0, 0],
+    ['plugin_start', 0, 1],
+    ['plugin_stop', 0, 2],
+    ['allocate', 0, 3],
+    ['plugin_export_state', 0, 4],
+    ['plugin_import_state', 0, 5],
+    ['http_endpoints', 0, 6]
+  ]
+  return Buffer.from([
+    ...[0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00],
+    // Types: (i32, i32) -> i32, () -> i32, (i32) -> i32
+    ...section(
+      1,
+      vec([
+        [0x60, ...vec([[I32], [I32]]), ...vec([[I32]])],
+        [0x60, 0x00, ...vec([[I32]])],
+        [0x60, ...vec([[I32]]), ...vec([[I32]])]
+      ])
+    ),
+    ...section(3, vec([[0], [0], [1], [2], [0], [0], [0]])),
+    // Two pages of memory, and a mutable i32 global for the state length
+    ...section(5, vec([[0x00, 0x02]])),
+    ...section(6, vec([[I32, 0x01, 0x41, 0x00, 0x0b]])),
+    ...section(
+      7,
+      vec(
+        exports.map(([name, kind, index]) => [
+          ...uleb(name.length),
+          ...Buffer.from(name),
+          kind,
+          index
+        ])
+      )
+    ),
+    ...section(10, vec(bodies.map((body) => [...uleb(body.length), ...body]))),
+    // The endpoint list, placed at offset 2048
+    ...section(
+      11,
+      vec([
+        [0x00, ...ENDPOINTS_OFFSET, 0x0b, ...uleb(endpointsJson.length)].concat(
+          endpointsJson
+        )
+      ])
+    )
+  ])
+}
+
+async function waitFor(condition: () => boolean): Promise<void> {
+  for (let i = 0; i < 60 && !condition(); i++) {
+    await new Promise((resolve) => setTimeout(resolve, 50))
+  }
+  expect(condition()).to.equal(true)
+}
+
+describe('WASM plugin lifecycle', () => {
+  describe('registerWasmDeltaInputHandler', () => {
+    const delta = {
+      context: 'vessels.self',
+      updates: [{ values: [{ path: 'navigation.headingMagnetic', value: 1 }] }]
+    } as Delta
+
+    function createApp() {
+      const handlers: DeltaInputHandler[] = []
+      const app = {
+        registerDeltaInputHandler: (handler: DeltaInputHandler) => {
+          handlers.push(handler)
+          return () => handlers.splice(handlers.indexOf(handler), 1)
+        }
+      }
+      const process = (input: Delta) => {
+        const forwarded: Delta[] = []
+        handlers[0](input, (d: Delta) => forwarded.push(d))
+        return forwarded
+      }
+      return { app, handlers, process }
+    }
+
+    function createPlugin(
+      deltaInputHandler: (deltaJson: string) => string,
+      dataWrite = true
+    ) {
+      return {
+        status: 'running',
+        metadata: { capabilities: { dataWrite } },
+        instance: { exports: { delta_input_handler: deltaInputHandler } }
+      } as unknown as WasmPlugin
+    }
+
+    it('forwards the delta returned by the plugin', () => {
+      const { app, process } = createApp()
+      const plugin = createPlugin((deltaJson) =>
+        deltaJson.replace('"value":1', '"value":1.5')
+      )
+      registerWasmDeltaInputHandler(app, plugin, 'calibration')
+      expect(process(delta)).to.deep.equal([
+        {
+          context: 'vessels.self',
+          updates: [
+            { values: [{ path: 'navigation.headingMagnetic', value: 1.5 }] }
+          ]
+        }
+      ])
+    })
+
+    it('forwards the delta unchanged on an empty result or error', () => {
+      const { app, process } = createApp()
+      registerWasmDeltaInputHandler(
+        app,
+        createPlugin(() => ''),
+        'calibration'
+      )
+      expect(process(delta)).to.deep.equal([delta])
+
+      const failing = createApp()
+      registerWasmDeltaInputHandler(
+        failing.app,
+        createPlugin(() => 'not json'),
+        'calibration'
+      )
+      expect(failing.process(delta)).to.deep.equal([delta])
+    })
+
+    it('skips plugins that are not running', () => {
+      const { app, process } = createApp()
+      const plugin = createPlugin(() => {
+        throw new Error('should not be called')
+      })
+      plugin.status = 'stopped'
+      registerWasmDeltaInputHandler(app, plugin, 'calibration')
+      expect(process(delta)).to.deep.equal([delta])
+    })
+
+    it('requires the dataWrite capability', () => {
+      const { app, handlers } = createApp()
+      const unregister = registerWasmDeltaInputHandler(
+        app,
+        createPlugin(() => '', false),
+        'calibration'
+      )
+      expect(unregister).to.equal(undefined)
+      expect(handlers).to.have.length(0)
+    })
+
+    it('returns a function that removes the handler', () => {
+      const { app, handlers } = createApp()
+      const unregister = registerWasmDeltaInputHandler(
+        app,
+        createPlugin(() => ''),
+        'calibration'
+      )
+      expect(handlers).to.have.length(1)
+      unregister!()
+      expect(handlers).to.have.length(0)
+    })
+  })
+
+  describe('subscribeFromManifest', () => {
+    interface Subscription {
+      context: string
+      subscribe: object[]
+    }
+
+    function createApp() {
+      const subscriptions: Subscription[] = []
+      let unsubscribed = 0
+      const app = {
+        subscriptionmanager: {
+          subscribe: (
+            command: Subscription,
+            unsubscribes: Array<() => void>
+          ) => {
+            subscriptions.push(command)
+            unsubscribes.push(() => unsubscribed++)
+          }
+        }
+      }
+      return { app, subscriptions, unsubscribed: () => unsubscribed }
+    }
+
+    it('subscribes to the declared paths, one subscription per context', () => {
+      const { app, subscriptions, unsubscribed } = createApp()
+      const manifest = JSON.stringify([
+        { path: 'navigation.position', period: 1000 },
+        { path: 'environment.depth.*', policy: 'instant' },
+        { context: 'vessels.*', path: 'navigation.position', period: 5000 }
+      ])
+      const unsubscribe = subscribeFromManifest(app, 'ais', manifest, () => {})
+      expect(subscriptions).to.deep.equal([
+        {
+          context: 'vessels.self',
+          subscribe: [
+            { path: 'navigation.position', period: 1000 },
+            { path: 'environment.depth.*', policy: 'instant' }
+          ]
+        },
+        {
+          context: 'vessels.*',
+          subscribe: [{ path: 'navigation.position', period: 5000 }]
+        }
+      ])
+      unsubscribe()
+      expect(unsubscribed()).to.equal(2)
+    })
+
+    it('rejects manifests that are not an array of paths', () => {
+      const { app, subscriptions } = createApp()
+      expect(() => subscribeFromManifest(app, 'ais', '{}', () => {})).to.throw(
+        'must return a JSON array'
+      )
+      expect(() =>
+        subscribeFromManifest(app, 'ais', '[{"period":1000}]', () => {})
+      ).to.throw('Invalid plugin_subscriptions row')
+      expect(subscriptions).to.have.length(0)
+    })
+  })
+
+  describe('plugin state hand-over', () => {
+    function createPlugin(exports: object) {
+      return { instance: { exports } } as unknown as WasmPlugin
+    }
+
+    it('passes the exported state to the new instance', () => {
+      const imported: string[] = []
+      const state = exportPluginState(
+        createPlugin({ plugin_export_state: () => '{"charts":3}' }),
+        'charts'
+      )
+      expect(state).to.equal('{"charts":3}')
+      importPluginState(
+        createPlugin({
+          plugin_import_state: (s: string) => {
+            imported.push(s)
+            return 0
+          }
+        }),
+        'charts',
+        state!
+      )
+      expect(imported).to.deep.equal(['{"charts":3}'])
+    })
+
+    it('reloads without state when export or import fails', () => {
+      const failing = () => {
+        throw new Error('unreachable')
+      }
+      expect(
+        exportPluginState(createPlugin({ plugin_export_state: failing }), 'a')
+      ).to.equal(undefined)
+      expect(exportPluginState(createPlugin({}), 'a')).to.equal(undefined)
+      expect(() =>
+        importPluginState(
+          createPlugin({ plugin_import_state: failing }),
+          'a',
+          '{}'
+        )
+      ).to.not.throw()
+    })
+  })
+
+  describe('plugins with a scoped package name', () => {
+    const packageName = '@signalk/example-state'
+    const pluginId = derivePluginId(packageName)
+    const capabilities: WasmCapabilities = {
+      network: false,
+      storage: 'vfs-only',
+      dataRead: true,
+      dataWrite: true,
+      serialPorts: false,
+      putHandlers: false
+    }
+    const app = {}
+    let dir: string
+    let wasmPath: string
+    let plugin: WasmPlugin
+
+    beforeEach(async () => {
+      dir = fs.mkdtempSync(path.join(os.tmpdir(), 'wasm-reload-'))
+      wasmPath = path.join(dir, 'plugin.wasm')
+      fs.writeFileSync(wasmPath, statePluginModule())
+      // Loaded under the package name, as the plugin registry does
+      const instance = await getWasmRuntime().loadPlugin(
+        packageName,
+        wasmPath,
+        path.join(dir, 'vfs'),
+        capabilities,
+        app
+      )
+      plugin = {
+        id: pluginId,
+        packageName,
+        status: 'stopped',
+        enabled: true,
+        configuration: {},
+        metadata: { capabilities },
+        instance,
+        crashCount: 0,
+        restartBackoff: 1000
+      } as unknown as WasmPlugin
+      wasmPlugins.set(pluginId, plugin)
+    })
+
+    // Host bindings as the loader creates them, under the package name
+    function createBindings(bindingsApp: object = app) {
+      const memory = new WebAssembly.Memory({ initial: 1 })
+      const imports = createEnvImports({
+        pluginId: packageName,
+        capabilities,
+        app: bindingsApp,
+        memoryRef: { current: memory },
+        rawExports: { current: null },
+        asLoaderInstance: { current: null },
+        vfsRoot: path.join(dir, 'vfs')
+      })
+      const write = (value: string) => {
+        const bytes = Buffer.from(value, 'utf8')
+        new Uint8Array(memory.buffer).set(bytes, 0)
+        return bytes.length
+      }
+      return { imports, write }
+    }
+
+    afterEach(async () => {
+      delete process.env.WATCH_WASM_PLUGINS
+      await shutdownAllWasmPlugins()
+      fs.rmSync(dir, { recursive: true, force: true })
+    })
+
+    it('reloads a watched plugin on rebuild', async function () {
+      this.timeout(5000)
+      process.env.WATCH_WASM_PLUGINS = pluginId
+      await startWasmPlugin(app, pluginId)
+      const previous = plugin.instance
+
+      fs.writeFileSync(wasmPath, statePluginModule())
+      await waitFor(
+        () => plugin.instance !== previous && plugin.status === 'running'
+      )
+      expect(getWasmRuntime().getInstance(packageName)).to.equal(
+        plugin.instance
+      )
+    })
+
+    it('hands the running state over to the reloaded module', async () => {
+      await startWasmPlugin(app, pluginId)
+      importPluginState(plugin, pluginId, 'v1:42')
+      const previous = plugin.instance
+
+      await reloadWasmPlugin(app, pluginId)
+      expect(plugin.instance).to.not.equal(previous)
+      expect(plugin.status).to.equal('running')
+      expect(exportPluginState(plugin, pluginId)).to.equal('v1:42')
+    })
+
+    it('serves the endpoints of the reloaded module', async () => {
+      const registered: RoutePermission[][] = []
+      const secureApp = {
+        securityStrategy: {
+          registerPluginRoutePermissions: (
+            _pluginId: string,
+            permissions: RoutePermission[]
+          ) => registered.push(permissions),
+          clearPluginRoutePermissions: () => registered.splice(0)
+        }
+      }
+      plugin.router = express.Router()
+      const endpoint = { method: 'GET', handler: 'list' }
+      fs.writeFileSync(
+        wasmPath,
+        statePluginModule([{ ...endpoint, path: '/old', permission: 'read' }])
+      )
+      await reloadWasmPlugin(secureApp, pluginId)
+      fs.writeFileSync(
+        wasmPath,
+        statePluginModule([{ ...endpoint, path: '/new', permission: 'admin' }])
+      )
+      await reloadWasmPlugin(secureApp, pluginId)
+
+      // Only the index stays readable, /new is admin-only
+      expect(registered).to.deep.equal([
+        [{ method: 'GET', path: '/api', permission: 'readonly' }]
+      ])
+      const server = express()
+        .use(`/plugins/${pluginId}`, plugin.router)
+        .listen(0, '127.0.0.1')
+      try {
+        await new Promise((resolve) => server.once('listening', resolve))
+        const { port } = server.address() as AddressInfo
+        const url = `http://127.0.0.1:${port}/plugins/${pluginId}`
+        const index = await (await fetch(`${url}/api`)).json()
+        expect(index.endpoints).to.deep.equal([
+          { method: 'GET', path: '/new', permission: 'admin' }
+        ])
+        expect((await fetch(`${url}/old`)).status).to.equal(404)
+      } finally {
+        server.close()
+      }
+    })
+
+    it('closes its databases when stopped or crashed', async function () {
+      fs.writeFileSync(path.join(dir, 'vfs', 'charts.db'), '')
+      const { imports, write } = createBindings()
+      await startWasmPlugin(app, pluginId)
+      const open = () => imports.sk_sqlite_open(0, write('charts.db'))
+      const query = (handle: number) =>
+        imports.sk_sqlite_query(handle, 0, write('SELECT 1'), 0, 0)
+      const handle = open()
+      if (handle < 0) {
+        this.skip() // node:sqlite is not available
+      }
+      expect(query(handle)).to.be.above(0)
+
+      await stopWasmPlugin(pluginId)
+      expect(query(handle)).to.equal(-1)
+
+      await startWasmPlugin(app, pluginId)
+      const reopened = open()
+      expect(query(reopened)).to.be.above(0)
+      await handleWasmPluginCrash(app, pluginId, new Error('unreachable'))
+      expect(query(reopened)).to.equal(-1)
+    })
+
+    it('releases its locks when stopped or crashed', async () => {
+      const { imports, write } = createBindings()
+      const other = createLockBindings('other-plugin', (_ptr, len) =>
+        'shore-power-meter'.substring(0, len)
+      )
+      const name = write('shore-power-meter')
+      await startWasmPlugin(app, pluginId)
+
+      expect(imports.sk_lock_acquire(0, name)).to.equal(1)
+      expect(other.sk_lock_acquire(0, name)).to.equal(0)
+      await stopWasmPlugin(pluginId)
+      expect(other.sk_lock_acquire(0, name)).to.equal(1)
+      other.sk_lock_release(0, name)
+
+      expect(imports.sk_lock_acquire(0, name)).to.equal(1)
+      await handleWasmPluginCrash(app, pluginId, new Error('unreachable'))
+      expect(other.sk_lock_acquire(0, name)).to.equal(1)
+      other.sk_lock_release(0, name)
+    })
+
+    it('reports its heap usage until stopped', async () => {
+      const { imports } = createBindings()
+      await startWasmPlugin(app, pluginId)
+      imports.sk_report_memory(4096, 8192)
+      expect(getPluginMemoryUsage(plugin)).to.include({
+        heapInUse: 4096,
+        heapPeak: 8192
+      })
+
+      await stopWasmPlugin(pluginId)
+      expect(getPluginMemoryUsage(plugin)).to.not.have.property('heapInUse')
+    })
+
+    it('discards uncollected resource queries when stopped', async () => {
+      const { imports, write } = createBindings({
+        resourcesApi: { listResources: () => Promise.resolve({}) }
+      })
+      await startWasmPlugin(app, pluginId)
+      const queryId = imports.sk_list_resources(0, write('charts'), 0, 0)
+      expect(queryId).to.be.greaterThan(0)
+
+      await stopWasmPlugin(pluginId)
+      expect(imports.sk_get_resource_list(queryId, 4096, 4096)).to.equal(0)
+    })
+  })
+})
@@ -0,0 +1,299 @@
+import { expect } from 'chai'
+import express, { Request } from 'express'
+import * as http from 'http'
+import { AddressInfo } from 'net'
+import { RoutePermission } from '@signalk/server-api'
+import {
+  buildEndpointIndex,
+  checkRequestBody,
+  clearSlowHandlerCounts,
+  getSlowHandlerCounts,
+  recordHandlerDuration,
+  registerEndpointPermissions,
+  requestUser,
+  setupPluginSpecificRoutes
+} from '../src/wasm/loader/plugin-routes'
+import { WasmPlugin } from '../src/wasm/loader/types'
+
+describe('WASM plugin routes', () => {
+  describe('registerEndpointPermissions', () => {
+    function createApp() {
+      const registered: Array<{
+        pluginId: string
+        permissions: RoutePermission[]
+      }> = []
+      const app = {
+        securityStrategy: {
+          registerPluginRoutePermissions: (
+            pluginId: string,
+            permissions: RoutePermission[]
+          ) => registered.push({ pluginId, permissions }),
+          clearPluginRoutePermissions: (pluginId: string) => {
+            for (let i = registered.length - 1; i >= 0; i--) {
+              if (registered[i].pluginId === pluginId) {
+                registered.splice(i, 1)
+              }
+            }
+          }
+        }
+      }
+      return { app, registered }
+    }
+
+    it('maps declared permissions to route access levels', () => {
+      const { app, registered } = createApp()
+      registerEndpointPermissions(app, 'charts', [
+        { method: 'get', path: '/charts', permission: 'read' },
+        { method: 'delete', path: '/charts/:id', permission: 'write' }
+      ])
+      expect(registered).to.deep.equal([
+        {
+          pluginId: 'charts',
+          permissions: [
+            { method: 'GET', path: '/charts', permission: 'readonly' },
+            { method: 'DELETE', path: '/charts/:id', permission: 'readwrite' }
+          ]
+        }
+      ])
+    })
+
+    it('leaves admin, undeclared and unknown permissions admin-only', () => {
+      const { app, registered } = createApp()
+      registerEndpointPermissions(app, 'charts', [
+        { method: 'POST', path: '/import', permission: 'admin' },
+        { method: 'POST', path: '/rescan' },
+        { method: 'POST', path: '/purge', permission: 'everyone' }
+      ])
+      expect(registered).to.have.length(0)
+    })
+
+    it('replaces the levels of an earlier registration', () => {
+      const { app, registered } = createApp()
+      registerEndpointPermissions(app, 'other', [
+        { method: 'GET', path: '/status', permission: 'read' }
+      ])
+      registerEndpointPermissions(app, 'charts', [
+        { method: 'GET', path: '/charts', permission: 'read' },
+        { method: 'POST', path: '/charts', permission: 'read' }
+      ])
+      registerEndpointPermissions(app, 'charts', [
+        { method: 'GET', path: '/charts', permission: 'admin' },
+        { method: 'POST', path: '/charts', permission: 'write' }
+      ])
+      expect(registered).to.deep.equal([
+        {
+          pluginId: 'other',
+          permissions: [
+            { method: 'GET', path: '/status', permission: 'readonly' }
+          ]
+        },
+        {
+          pluginId: 'charts',
+          permissions: [
+            { method: 'POST', path: '/charts', permission: 'readwrite' }
+          ]
+        }
+      ])
+
+      registerEndpointPermissions(app, 'charts', [
+        { method: 'POST', path: '/charts', permission: 'admin' }
+      ])
+      expect(registered.map(({ pluginId }) => pluginId)).to.deep.equal([
+        'other'
+      ])
+    })
+
+    it('is a no-op when security is disabled', () => {
+      const app = { securityStrategy: {} }
+      expect(() =>
+        registerEndpointPermissions(app, 'charts', [
+          { method: 'GET', path: '/charts', permission: 'read' }
+        ])
+      ).to.not.throw()
+    })
+  })
+
+  describe('setupPluginSpecificRoutes', () => {
+    let server: http.Server | undefined
+
+    afterEach(() => server?.close())
+
+    // A plugin whose http_endpoints export returns the current endpoints
+    function createPlugin(endpoints: { current: object[] }) {
+      return {
+        id: 'charts',
+        router: express.Router(),
+        instance: {
+          asLoader: {
+            exports: {
+              http_endpoints: () => JSON.stringify(endpoints.current),
+              __getString: (value: string) => value
+            }
+          }
+        }
+      } as unknown as WasmPlugin
+    }
+
+    async function listen(plugin: WasmPlugin) {
+      const app = express()
+      app.use('/plugins/charts', plugin.router!)
+      server = app.listen(0, '127.0.0.1')
+      await new Promise((resolve) => server!.once('listening', resolve))
+      const { port } = server.address() as AddressInfo
+      return `http://127.0.0.1:${port}/plugins/charts`
+    }
+
+    it('serves the endpoints of the latest setup', async () => {
+      const endpoint = { method: 'GET', handler: 'list', permission: 'read' }
+      const endpoints = { current: [{ ...endpoint, path: '/api/old' }] }
+      const plugin = createPlugin(endpoints)
+      const app = { securityStrategy: {} }
+      setupPluginSpecificRoutes(app, plugin)
+
+      // Re-enabled after an update with a different endpoint set
+      endpoints.current = [{ ...endpoint, path: '/api/new' }]
+      setupPluginSpecificRoutes(app, plugin)
+
+      const url = await listen(plugin)
+      const index = await (await fetch(`${url}/api`)).json()
+      expect(index).to.deep.equal({
+        endpoints: [{ method: 'GET', path: '/api/new', permission: 'read' }]
+      })
+      expect((await fetch(`${url}/api/old`)).status).to.equal(404)
+    })
+  })
+
+  describe('requestUser', () => {
+    const withPrincipal = (skPrincipal?: object) =>
+      ({ skPrincipal }) as unknown as Request
+
+    it('passes the authenticated caller', () => {
+      const user = { identifier: 'skipper', permissions: 'readwrite' }
+      expect(requestUser(withPrincipal(user))).to.deep.equal(user)
+    })
+
+    it('is null for anonymous requests', () => {
+      expect(requestUser(withPrincipal())).to.equal(null)
+      // Anonymous read access under allow_readonly
+      const auto = { identifier: 'AUTO', permissions: 'readonly' }
+      expect(requestUser(withPrincipal(auto))).to.equal(null)
+    })
+  })
+
+  describe('buildEndpointIndex', () => {
+    it('lists methods, paths, access levels and descriptions', () => {
+      expect(
+        buildEndpointIndex([
+          {
+            method: 'get',
+            path: '/api/history',
+            permission: 'read',
+            description: 'Recorded samples as JSON'
+          },
+          { method: 'POST', path: '/api/import', permission: 'write' }
+        ])
+      ).to.deep.equal({
+        endpoints: [
+          {
+            method: 'GET',
+            path: '/api/history',
+            permission: 'read',
+            description: 'Recorded samples as JSON'
+          },
+          { method: 'POST', path: '/api/import', permission: 'write' }
+        ]
+      })
+    })
+
+    it('reports undeclared and unknown permissions as admin', () => {
+      expect(
+        buildEndpointIndex([
+          { method: 'POST', path: '/rescan' },
+          { method: 'POST', path: '/purge', permission: 'everyone' }
+        ]).endpoints.map((endpoint) => endpoint.permission)
+      ).to.deep.equal(['admin', 'admin'])
+    })
+  })
+
+  describe('checkRequestBody', () => {
+    const limits = {
+      maxBodySize: 100,
+      contentTypes: ['application/json', 'text/*']
+    }
+
+    it('accepts requests within the declared limits', () => {
+      expect(checkRequestBody(limits, {})).to.equal(undefined)
+      expect(
+        checkRequestBody(limits, {
+          'content-length': '20',
+          'content-type': 'application/json; charset=utf-8'
+        })
+      ).to.equal(undefined)
+      expect(
+        checkRequestBody(limits, {
+          'content-length': '20',
+          'content-type': 'text/csv'
+        })
+      ).to.equal(undefined)
+    })
+
+    it('rejects oversized bodies with 413', () => {
+      expect(
+        checkRequestBody(limits, {
+          'content-length': '200',
+          'content-type': 'application/json'
+        })?.status
+      ).to.equal(413)
+    })
+
+    it('rejects undeclared content types with 415', () => {
+      expect(
+        checkRequestBody(limits, {
+          'content-length': '20',
+          'content-type': 'application/xml'
+        })?.status
+      ).to.equal(415)
+    })
+  })
+
+  describe('recordHandlerDuration', () => {
+    const originalWarn = console.warn
+    let warnings: unknown[][]
+
+    beforeEach(() => {
+      warnings = []
+      console.warn = (...args: unknown[]) => {
+        warnings.push(args)
+      }
+    })
+
+    afterEach(() => {
+      console.warn = originalWarn
+      delete process.env.WASM_HANDLER_BUDGET
+      clearSlowHandlerCounts('charts')
+    })
+
+    it('counts and warns about calls over the budget', () => {
+      recordHandlerDuration('charts', 'GET /charts', 20)
+      recordHandlerDuration('charts', 'GET /charts', 800)
+      recordHandlerDuration('charts', 'GET /charts', 1200)
+      expect(getSlowHandlerCounts('charts')).to.deep.equal({
+        'GET /charts': 2
+      })
+      expect(warnings).to.have.length(2)
+      expect(JSON.parse(warnings[1][1] as string)).to.deep.equal({
+        endpoint: 'GET /charts',
+        durationMs: 1200,
+        budgetMs: 500,
+        count: 2
+      })
+    })
+
+    it('uses the budget from WASM_HANDLER_BUDGET', () => {
+      process.env.WASM_HANDLER_BUDGET = '2000'
+      recordHandlerDuration('charts', 'GET /charts', 1200)
+      expect(getSlowHandlerCounts('charts')).to.equal(undefined)
+      expect(warnings).to.have.length(0)
+    })
+  })
+})
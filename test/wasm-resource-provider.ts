@@ -0,0 +1,217 @@
+import { expect } from 'chai'
+import {
+  cleanupResourceProviders,
+  createResourceProviderBinding,
+  updateResourceProviderInstance
+} from '../src/wasm/bindings/resource-provider'
+import { WasmPluginInstance } from '../src/wasm/types'
+
+interface ProviderMethods {
+  getResource: (id: string) => Promise<object>
+  setResource: (id: string, value: object) => Promise<void>
+  deleteResource: (id: string) => Promise<void>
+}
+
+describe('WASM resource provider', () => {
+  const pluginId = 'test-provider'
+
+  afterEach(() => cleanupResourceProviders(pluginId))
+
+  // Registers an AssemblyScript-style provider whose resources_get_resource
+  // handler answers with getResponse, next to any other handlers given
+  function registerProvider(
+    getResponse: (requestJson: string) => string,
+    handlers: Record<string, (requestJson: string) => string> = {}
+  ) {
+    const registered: { methods?: ProviderMethods } = {}
+    const app = {
+      resourcesApi: {
+        register: (_id: string, provider: { methods: ProviderMethods }) => {
+          registered.methods = provider.methods
+        }
+      }
+    }
+    const register = createResourceProviderBinding(
+      pluginId,
+      { resourceProvider: true },
+      app,
+      () => 'regions'
+    )
+    expect(register(0, 0)).to.equal(1)
+
+    const instance = {
+      pluginId,
+      asLoader: {
+        exports: {
+          __newString: (value: string) => value,
+          __getString: (value: string) => value,
+          resources_get_resource: getResponse,
+          ...handlers
+        }
+      }
+    } as unknown as WasmPluginInstance
+    updateResourceProviderInstance(pluginId, instance)
+    return registered.methods!
+  }
+
+  it('returns resources the plugin has', async () => {
+    const methods = registerProvider(() => '{"name":"Swing circle"}')
+    const resource = await methods.getResource('region-1')
+    expect(resource).to.deep.equal({ name: 'Swing circle' })
+  })
+
+  it('rejects ids the plugin does not have', async () => {
+    const methods = registerProvider(() => '{}')
+    const error = await methods.getResource('region-1').catch((e) => e)
+    expect(error).to.be.instanceOf(Error)
+  })
+
+  it('rejects lookups the plugin answers with an error', async () => {
+    const methods = registerProvider(() => '{"error":"Region not found"}')
+    const error = await methods.getResource('region-1').catch((e) => e)
+    expect(error.message).to.equal('Region not found')
+  })
+
+  it('rejects lookups the plugin answers with null', async () => {
+    const methods = registerProvider(() => 'null')
+    const error = await methods.getResource('region-1').catch((e) => e)
+    expect(error.message).to.equal('Resource not found (region-1)')
+  })
+
+  it('rejects writes and deletes the plugin refuses', async () => {
+    const methods = registerProvider(() => '{}', {
+      resources_set_resource: () => 'Swing circle is read-only',
+      resources_delete_resource: () => 'Stop the anchor watch instead'
+    })
+    const setError = await methods
+      .setResource('region-1', { name: 'Swing circle' })
+      .catch((e) => e)
+    expect(setError.message).to.equal('Swing circle is read-only')
+    const deleteError = await methods.deleteResource('region-1').catch((e) => e)
+    expect(deleteError.message).to.equal('Stop the anchor watch instead')
+  })
+
+  it('accepts writes and deletes answered with no error', async () => {
+    const methods = registerProvider(() => '{}', {
+      resources_set_resource: () => '',
+      resources_delete_resource: () => ''
+    })
+    await methods.setResource('region-1', { name: 'Swing circle' })
+    await methods.deleteResource('region-1')
+  })
+
+  describe('custom resource types', () => {
+    const schema = JSON.stringify({
+      type: 'object',
+      required: ['name', 'depth'],
+      properties: {
+        name: { type: 'string' },
+        depth: { type: 'number', minimum: 0 }
+      }
+    })
+
+    // Registers a provider for resourceType with the given schema; setResource
+    // requests reaching the plugin are collected in stored
+    function registerCustomProvider(
+      resourceType: string,
+      schemaJson: string,
+      validateResponse?: (requestJson: string) => string
+    ) {
+      const registered: { methods?: ProviderMethods } = {}
+      const stored: string[] = []
+      const app = {
+        resourcesApi: {
+          register: (_id: string, provider: { methods: ProviderMethods }) => {
+            registered.methods = provider.methods
+          }
+        }
+      }
+      const strings = [resourceType, schemaJson]
+      const register = createResourceProviderBinding(
+        pluginId,
+        { resourceProvider: true },
+        app,
+        (ptr: number) => strings[ptr]
+      )
+      const result = register(0, resourceType.length, 1, schemaJson.length)
+
+      const exports: Record<string, unknown> = {
+        __newString: (value: string) => value,
+        __getString: (value: string) => value,
+        resources_set_resource: (requestJson: string) => {
+          stored.push(requestJson)
+          return ''
+        }
+      }
+      if (validateResponse) {
+        exports.resources_validate_resource = validateResponse
+      }
+      const instance = {
+        pluginId,
+        asLoader: { exports }
+      } as unknown as WasmPluginInstance
+      updateResourceProviderInstance(pluginId, instance)
+      return { result, methods: registered.methods, stored }
+    }
+
+    it('stores resources that match the schema', async () => {
+      const { result, methods, stored } = registerCustomProvider(
+        'fishingSpots',
+        schema
+      )
+      expect(result).to.equal(1)
+      await methods!.setResource('spot-1', { name: 'Reef', depth: 12 })
+      expect(stored).to.have.length(1)
+      expect(JSON.parse(stored[0])).to.deep.equal({
+        id: 'spot-1',
+        value: { name: 'Reef', depth: 12 },
+        resourceType: 'fishingSpots'
+      })
+    })
+
+    it('rejects resources that do not match the schema', async () => {
+      const { methods, stored } = registerCustomProvider('fishingSpots', schema)
+      const error = await methods!
+        .setResource('spot-1', { name: 'Reef', depth: -3 })
+        .catch((e) => e)
+      expect(error.message).to.contain('Invalid fishingSpots resource')
+      expect(stored).to.have.length(0)
+    })
+
+    it('rejects resources the plugin validation hook refuses', async () => {
+      const requests: string[] = []
+      const { methods, stored } = registerCustomProvider(
+        'fishingSpots',
+        schema,
+        (requestJson) => {
+          requests.push(requestJson)
+          return JSON.parse(requestJson).value.name === 'Reef'
+            ? 'Spot already exists'
+            : ''
+        }
+      )
+      const error = await methods!
+        .setResource('spot-1', { name: 'Reef', depth: 12 })
+        .catch((e) => e)
+      expect(error.message).to.equal(
+        'Invalid fishingSpots resource: Spot already exists'
+      )
+      await methods!.setResource('spot-2', { name: 'Wreck', depth: 20 })
+      expect(requests).to.have.length(2)
+      expect(stored).to.have.length(1)
+    })
+
+    it('refuses schemas for Signal K resource types', () => {
+      const { result, methods } = registerCustomProvider('waypoints', schema)
+      expect(result).to.equal(0)
+      expect(methods).to.equal(undefined)
+    })
+
+    it('refuses invalid schemas', () => {
+      expect(registerCustomProvider('fishingSpots', '{').result).to.equal(0)
+      expect(
+        registerCustomProvider('fishingSpots', '{"type":"nonsense"}').result
+      ).to.equal(0)
+    })
+  })
+})
@@ -0,0 +1,98 @@
+import { expect } from 'chai'
+import { WASM_ABI_VERSION } from '../src/wasm/bindings/env-imports'
+import {
+  assertAbiVersionSupported,
+  initializeAssemblyScriptWasi,
+  withMissingImportStubs
+} from '../src/wasm/loaders/standard-loader'
+
+describe('WASM standard loader', () => {
+  describe('withMissingImportStubs', () => {
+    const envImports = { sk_debug: () => undefined }
+
+    it('links plugins using only provided host functions as is', () => {
+      const moduleImports: WebAssembly.ModuleImportDescriptor[] = [
+        { module: 'env', name: 'sk_debug', kind: 'function' },
+        { module: 'env', name: 'abort', kind: 'function' },
+        { module: 'wasi_snapshot_preview1', name: 'fd_write', kind: 'function' }
+      ]
+      const linked = withMissingImportStubs(
+        'test-plugin',
+        moduleImports,
+        envImports
+      )
+      expect(linked).to.equal(envImports)
+    })
+
+    it('stubs missing host functions with a descriptive error', () => {
+      const moduleImports: WebAssembly.ModuleImportDescriptor[] = [
+        { module: 'env', name: 'sk_debug', kind: 'function' },
+        { module: 'env', name: 'sk_from_the_future', kind: 'function' }
+      ]
+      const linked = withMissingImportStubs(
+        'test-plugin',
+        moduleImports,
+        envImports
+      )
+      expect(linked.sk_debug).to.equal(envImports.sk_debug)
+      expect(() => linked.sk_from_the_future()).to.throw(/sk_from_the_future/)
+      expect(envImports).to.not.have.property('sk_from_the_future')
+    })
+  })
+
+  describe('initializeAssemblyScriptWasi', () => {
+    const instance = {} as WebAssembly.Instance
+
+    function initialize(moduleImports: WebAssembly.ModuleImportDescriptor[]) {
+      const initialized: WebAssembly.Instance[] = []
+      const wasi = {
+        initialize: (target: WebAssembly.Instance) => initialized.push(target)
+      }
+      initializeAssemblyScriptWasi('test-plugin', wasi, instance, moduleImports)
+      return initialized
+    }
+
+    it('binds WASI for plugins importing WASI functions', () => {
+      const initialized = initialize([
+        { module: 'env', name: 'abort', kind: 'function' },
+        {
+          module: 'wasi_snapshot_preview1',
+          name: 'path_open',
+          kind: 'function'
+        }
+      ])
+      expect(initialized).to.deep.equal([instance])
+    })
+
+    it('leaves plugins without WASI imports alone', () => {
+      const initialized = initialize([
+        { module: 'env', name: 'abort', kind: 'function' }
+      ])
+      expect(initialized).to.have.length(0)
+    })
+  })
+
+  describe('assertAbiVersionSupported', () => {
+    it('accepts plugins without plugin_abi_version', () => {
+      expect(() => assertAbiVersionSupported('test-plugin', {})).to.not.throw()
+    })
+
+    it('accepts plugins built for this or an older ABI', () => {
+      const rawExports = { plugin_abi_version: () => WASM_ABI_VERSION }
+      expect(() =>
+        assertAbiVersionSupported('test-plugin', rawExports)
+      ).to.not.throw()
+      const firstVersion = { plugin_abi_version: () => 1 }
+      expect(() =>
+        assertAbiVersionSupported('test-plugin', firstVersion)
+      ).to.not.throw()
+    })
+
+    it('rejects plugins requiring a newer ABI', () => {
+      const rawExports = { plugin_abi_version: () => WASM_ABI_VERSION + 1 }
+      expect(() =>
+        assertAbiVersionSupported('test-plugin', rawExports)
+      ).to.throw(/requires WASM ABI version/)
+    })
+  })
+})